@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/cloudfoundry/firehose_exporter/check"
+	"github.com/cloudfoundry/firehose_exporter/connection"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+)
+
+var (
+	checkCmd = kingpin.Command("check", "Validate flags and configuration files without connecting to anything, exits with status 1 on errors")
+
+	checkSamples = checkCmd.Flag(
+		"samples", "Path to a file of envelopes as json lines, as printed by the tap command, to convert as the exporter would and print resulting samples",
+	).Default("").String()
+)
+
+func runCheck() {
+	report := check.NewReport(os.Stdout)
+	im := metrics.NewInternalMetrics(*metricsNamespace, *metricsEnvironment)
+
+	check.CheckEvents(report, commaSeparated(*filterEvents))
+	_, err := MakeStreamer(im, connection.NewTracker(*loggingURL, im))
+	report.Error("logging", err)
+	peerRouter, err := MakePeerRouter(im)
+	report.Error("peers", err)
+	_, err = MakeElector(im)
+	report.Error("ha", err)
+	_, err = MakeSourceLimiter(im)
+	report.Error("limits", err)
+	_, err = MakePriorityLanes()
+	report.Error("ingestion.priority_lanes", err)
+	_, err = MakeExpirationPolicy()
+	report.Error("metrics.expiration_rules", err)
+	_, err = MakeMetadataCatalog()
+	report.Error("metrics.metadata_catalog", err)
+	derivedEngine, err := MakeDerivedEngine()
+	report.Error("metrics.derived_rules", err)
+	if derivedEngine != nil && peerRouter != nil {
+		report.Warnf("metrics.derived_rules", "derived rules only see series owned by each instance, derived series of peers are partial")
+	}
+
+	if *checkSamples != "" {
+		opts := make([]check.SampleOption, 0)
+		if derivedEngine != nil {
+			opts = append(opts, check.WithDerivedEngine(derivedEngine))
+		}
+		check.NewSampleChecker(MakeFilterSelector(nil), commaSeparated(*filterDeployments), os.Stdout, opts...).Check(report, *checkSamples)
+	}
+
+	fmt.Printf("%d errors, %d warnings\n", report.Errors(), report.Warnings())
+	if report.Errors() > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,63 @@
+package check
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cloudfoundry/firehose_exporter/nozzle"
+)
+
+// Report prints findings of a check as they come and counts them, errors prevent the exporter
+// from starting or working while warnings are probable mistakes.
+type Report struct {
+	out      io.Writer
+	errors   int
+	warnings int
+}
+
+func NewReport(out io.Writer) *Report {
+	return &Report{out: out}
+}
+
+// Error records err of subject, nothing is recorded when err is nil.
+func (r *Report) Error(subject string, err error) {
+	if err == nil {
+		return
+	}
+	r.errors++
+	fmt.Fprintf(r.out, "ERROR %s: %s\n", subject, err.Error())
+}
+
+func (r *Report) Warnf(subject string, format string, args ...interface{}) {
+	r.warnings++
+	fmt.Fprintf(r.out, "WARN  %s: %s\n", subject, fmt.Sprintf(format, args...))
+}
+
+func (r *Report) Infof(subject string, format string, args ...interface{}) {
+	fmt.Fprintf(r.out, "INFO  %s: %s\n", subject, fmt.Sprintf(format, args...))
+}
+
+func (r *Report) Errors() int {
+	return r.errors
+}
+
+func (r *Report) Warnings() int {
+	return r.warnings
+}
+
+// CheckEvents warns about names of filter.events which are ignored, it is an error when no name is known
+// as no envelope would be received.
+func CheckEvents(report *Report, events []string) {
+	known := 0
+	for _, event := range events {
+		if _, ok := nozzle.FilterSelectorTypeValue[strings.ToLower(event)]; !ok {
+			report.Warnf("filter.events", "unknown event '%s' is ignored, known events are ContainerMetric, CounterEvent, ValueMetric and Http", event)
+			continue
+		}
+		known++
+	}
+	if len(events) > 0 && known == 0 {
+		report.Error("filter.events", fmt.Errorf("no known event, every event is filtered out"))
+	}
+}
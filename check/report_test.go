@@ -0,0 +1,43 @@
+package check_test
+
+import (
+	"bytes"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/firehose_exporter/check"
+)
+
+var _ = ginkgo.Describe("CheckEvents", func() {
+	var out *bytes.Buffer
+	var report *check.Report
+
+	ginkgo.BeforeEach(func() {
+		out = &bytes.Buffer{}
+		report = check.NewReport(out)
+	})
+
+	ginkgo.It("should accept known events in any case", func() {
+		check.CheckEvents(report, []string{"containermetric", "CounterEvent", "Http", "ValueMetric"})
+
+		gomega.Expect(report.Errors()).To(gomega.Equal(0))
+		gomega.Expect(report.Warnings()).To(gomega.Equal(0))
+		gomega.Expect(out.String()).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should warn about unknown events", func() {
+		check.CheckEvents(report, []string{"CounterEvent", "ContainerMetrics"})
+
+		gomega.Expect(report.Errors()).To(gomega.Equal(0))
+		gomega.Expect(report.Warnings()).To(gomega.Equal(1))
+		gomega.Expect(out.String()).To(gomega.HavePrefix("WARN  filter.events: unknown event 'ContainerMetrics' is ignored"))
+	})
+
+	ginkgo.It("should fail when no event is known", func() {
+		check.CheckEvents(report, []string{"Container"})
+
+		gomega.Expect(report.Errors()).To(gomega.Equal(1))
+		gomega.Expect(out.String()).To(gomega.ContainSubstring("ERROR filter.events: no known event"))
+	})
+})
@@ -0,0 +1,119 @@
+package check
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/firehose_exporter/derived"
+	"github.com/cloudfoundry/firehose_exporter/metricmaker"
+	"github.com/cloudfoundry/firehose_exporter/nozzle"
+	"github.com/cloudfoundry/firehose_exporter/tap"
+)
+
+const samplesSubject = "samples"
+
+// SampleChecker dry-runs filters, converters and derived rules against sample envelopes, as printed by the tap
+// command in json, and prints the samples the exporter would store.
+type SampleChecker struct {
+	filterSelector *nozzle.FilterSelector
+	deployments    []string
+	derivedEngine  *derived.Engine
+	out            io.Writer
+}
+
+type SampleOption func(*SampleChecker)
+
+// WithDerivedEngine also prints derived samples computed from converted samples.
+func WithDerivedEngine(derivedEngine *derived.Engine) SampleOption {
+	return func(c *SampleChecker) {
+		c.derivedEngine = derivedEngine
+	}
+}
+
+func NewSampleChecker(filterSelector *nozzle.FilterSelector, deployments []string, out io.Writer, opts ...SampleOption) *SampleChecker {
+	c := &SampleChecker{
+		filterSelector: filterSelector,
+		deployments:    deployments,
+		out:            out,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Check converts envelopes of the file of json lines, unreadable envelopes are errors
+// and deployments of filter.deployments that no envelope has are warnings.
+func (c *SampleChecker) Check(report *Report, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		report.Error(samplesSubject, err)
+		return
+	}
+	defer file.Close()
+
+	filterDeployment := nozzle.NewFilterDeployment(c.deployments...)
+	seenDeployments := make(map[string]bool)
+	var envelopes, notSelected, deploymentFiltered, timers, samples int
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		envelope, err := tap.ParseEnvelopeLine(scanner.Text())
+		if err != nil {
+			report.Error(fmt.Sprintf("%s line %d", samplesSubject, line), err)
+			continue
+		}
+		envelopes++
+		if deployment, ok := envelope.GetTags()["deployment"]; ok {
+			seenDeployments[deployment] = true
+		}
+
+		if !c.filterSelector.Selects(envelope) {
+			notSelected++
+			continue
+		}
+		if filterDeployment.IsFiltered(envelope) {
+			deploymentFiltered++
+			continue
+		}
+		if envelope.GetTimer() != nil {
+			// timers only give rollups computed over time
+			timers++
+			continue
+		}
+		c.filterSelector.FilterGaugeMetrics(envelope)
+		for _, point := range metricmaker.NewRawMetricsFromEnvelop(envelope) {
+			samples++
+			fmt.Fprint(c.out, tap.SampleLine(point))
+			if c.derivedEngine == nil {
+				continue
+			}
+			for _, derivedPoint := range c.derivedEngine.Observe(point, time.Now()) {
+				samples++
+				fmt.Fprint(c.out, tap.SampleLine(derivedPoint))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		report.Error(samplesSubject, err)
+	}
+
+	report.Infof(samplesSubject, "%d envelopes: %d not selected by filter.events or filter.source_ids, %d filtered by filter.deployments, %d timers only giving rollups, %d samples",
+		envelopes, notSelected, deploymentFiltered, timers, samples)
+	for _, deployment := range c.deployments {
+		if !seenDeployments[deployment] {
+			report.Warnf("filter.deployments", "no sample envelope comes from deployment '%s'", deployment)
+		}
+	}
+	if envelopes > 0 && samples == 0 && timers == 0 {
+		report.Warnf(samplesSubject, "no sample envelope gives a metric")
+	}
+}
@@ -0,0 +1,100 @@
+package check_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/firehose_exporter/check"
+	"github.com/cloudfoundry/firehose_exporter/derived"
+	"github.com/cloudfoundry/firehose_exporter/nozzle"
+)
+
+const sampleEnvelopes = `{"source_id":"bbs","tags":{"deployment":"cf","job":"diego-api"},"counter":{"name":"requests","total":"4"}}
+{"source_id":"rep","tags":{"deployment":"cf"},"gauge":{"metrics":{"memory":{"unit":"bytes","value":2},"memory_quota":{"unit":"bytes","value":8},"a_gauge":{"value":1}}}}
+{"source_id":"gorouter","tags":{"deployment":"cf"},"timer":{"name":"http","start":"1","stop":"2"}}
+{"source_id":"bbs","tags":{"deployment":"other"},"counter":{"name":"requests","total":"5"}}
+
+not json
+`
+
+var _ = ginkgo.Describe("SampleChecker", func() {
+	var dir, path string
+	var out, samples *bytes.Buffer
+	var report *check.Report
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "check")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		path = filepath.Join(dir, "samples.jsonl")
+		gomega.Expect(os.WriteFile(path, []byte(sampleEnvelopes), 0o600)).To(gomega.Succeed())
+		out = &bytes.Buffer{}
+		samples = &bytes.Buffer{}
+		report = check.NewReport(out)
+	})
+
+	ginkgo.AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	ginkgo.It("should print samples of envelopes kept by filters", func() {
+		check.NewSampleChecker(nozzle.NewFilterSelector("CounterEvent", "ContainerMetric", "Http"), []string{"cf"}, samples).Check(report, path)
+
+		gomega.Expect(samples.String()).To(gomega.ContainSubstring(`requests{bosh_deployment="cf",bosh_job_name="diego-api",deployment="cf",job="diego-api",source_id="bbs"} 4` + "\n"))
+		gomega.Expect(samples.String()).To(gomega.ContainSubstring(`memory{bosh_deployment="cf",deployment="cf",source_id="rep",unit="bytes"} 2` + "\n"))
+		gomega.Expect(samples.String()).ToNot(gomega.ContainSubstring("a_gauge"))
+		gomega.Expect(samples.String()).ToNot(gomega.ContainSubstring("} 5"))
+		gomega.Expect(out.String()).To(gomega.ContainSubstring("INFO  samples: 4 envelopes: 0 not selected by filter.events or filter.source_ids, 1 filtered by filter.deployments, 1 timers only giving rollups, 3 samples"))
+	})
+
+	ginkgo.It("should report unreadable envelopes as errors", func() {
+		check.NewSampleChecker(nozzle.NewFilterSelector(), nil, samples).Check(report, path)
+
+		gomega.Expect(report.Errors()).To(gomega.Equal(1))
+		gomega.Expect(out.String()).To(gomega.ContainSubstring("ERROR samples line 6:"))
+	})
+
+	ginkgo.It("should warn about deployments no envelope comes from", func() {
+		check.NewSampleChecker(nozzle.NewFilterSelector(), []string{"cf", "cff"}, samples).Check(report, path)
+
+		gomega.Expect(report.Warnings()).To(gomega.Equal(1))
+		gomega.Expect(out.String()).To(gomega.ContainSubstring("WARN  filter.deployments: no sample envelope comes from deployment 'cff'"))
+	})
+
+	ginkgo.It("should warn when no envelope gives a metric", func() {
+		filterSelector := nozzle.NewFilterSelector()
+		filterSelector.CounterSourceIDs("cc")
+		filterSelector.GaugeSourceIDs("cc")
+		filterSelector.TimerSourceIDs("cc")
+		check.NewSampleChecker(filterSelector, nil, samples).Check(report, path)
+
+		gomega.Expect(samples.String()).To(gomega.BeEmpty())
+		gomega.Expect(out.String()).To(gomega.ContainSubstring("4 not selected"))
+		gomega.Expect(out.String()).To(gomega.ContainSubstring("WARN  samples: no sample envelope gives a metric"))
+	})
+
+	ginkgo.It("should print derived samples", func() {
+		engine, err := derived.NewEngine(time.Minute, &derived.Rule{
+			Name:    "memory_utilisation",
+			Op:      derived.OpRatio,
+			Metrics: []string{"memory", "memory_quota"},
+			By:      []string{"source_id"},
+			Scale:   100,
+		})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		check.NewSampleChecker(nozzle.NewFilterSelector(), nil, samples, check.WithDerivedEngine(engine)).Check(report, path)
+
+		gomega.Expect(samples.String()).To(gomega.ContainSubstring(`memory_utilisation{source_id="rep"} 25` + "\n"))
+	})
+
+	ginkgo.It("should fail when file can't be read", func() {
+		check.NewSampleChecker(nozzle.NewFilterSelector(), nil, samples).Check(report, filepath.Join(dir, "missing.jsonl"))
+
+		gomega.Expect(report.Errors()).To(gomega.Equal(1))
+	})
+})
@@ -3,10 +3,13 @@ package collectors_test
 import (
 	"testing"
 
+	"github.com/cloudfoundry/firehose_exporter/metrics"
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
 )
 
+var internalMetric = metrics.NewInternalMetrics("firehose", "test")
+
 func TestCollectors(t *testing.T) {
 	gomega.RegisterFailHandler(ginkgo.Fail)
 	ginkgo.RunSpecs(t, "Collectors Suite")
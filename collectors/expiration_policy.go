@@ -0,0 +1,122 @@
+package collectors
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	dto "github.com/prometheus/client_model/go"
+	"go.yaml.in/yaml/v3"
+)
+
+// ExpirationRule gives an expiration to metrics matching all of its non-empty selectors.
+type ExpirationRule struct {
+	// MetricName is a regex which must match the whole final metric name.
+	MetricName  string        `yaml:"metric_name"`
+	Origin      string        `yaml:"origin"`
+	MetricType  string        `yaml:"metric_type"`
+	Expiration  time.Duration `yaml:"expiration"`
+	NeverExpire bool          `yaml:"never_expire"`
+
+	metricNameRegex *regexp.Regexp
+	metricType      *dto.MetricType
+}
+
+func (r *ExpirationRule) compile() error {
+	if r.Expiration <= 0 && !r.NeverExpire {
+		return fmt.Errorf("rule must have a positive expiration or never_expire set")
+	}
+	if r.MetricName != "" {
+		regex, err := regexp.Compile("^(?:" + r.MetricName + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid metric_name regex: %w", err)
+		}
+		r.metricNameRegex = regex
+	}
+	if r.MetricType != "" {
+		metricType, ok := dto.MetricType_value[strings.ToUpper(r.MetricType)]
+		if !ok {
+			return fmt.Errorf("unknown metric_type '%s'", r.MetricType)
+		}
+		r.metricType = dto.MetricType(metricType).Enum()
+	}
+	return nil
+}
+
+func (r *ExpirationRule) match(metric *metrics.RawMetric) bool {
+	if r.metricNameRegex != nil && !r.metricNameRegex.MatchString(metric.MetricName()) {
+		return false
+	}
+	if r.Origin != "" && r.Origin != metric.Origin() {
+		return false
+	}
+	if r.metricType != nil && *r.metricType != *metric.MetricType() {
+		return false
+	}
+	return true
+}
+
+// ExpirationPolicy resolves for each metric the expiration to use from the first matching rule,
+// metrics which don't match any rule use the default expiration.
+type ExpirationPolicy struct {
+	rules            []*ExpirationRule
+	defaultExpiresIn time.Duration
+	// cache of rule index found by metric name, origin and type, -1 means default
+	ruleIndexCache *sync.Map
+}
+
+func NewExpirationPolicy(defaultExpiresIn time.Duration, rules ...*ExpirationRule) (*ExpirationPolicy, error) {
+	for i, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("expiration rule %d: %w", i, err)
+		}
+	}
+	return &ExpirationPolicy{
+		rules:            rules,
+		defaultExpiresIn: defaultExpiresIn,
+		ruleIndexCache:   &sync.Map{},
+	}, nil
+}
+
+func LoadExpirationRules(path string) ([]*ExpirationRule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]*ExpirationRule, 0)
+	if err := yaml.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("could not parse expiration rules file %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// ExpiresIn gives the expiration to set on the metric, false is returned when metric must never expire.
+func (p *ExpirationPolicy) ExpiresIn(metric *metrics.RawMetric) (time.Duration, bool) {
+	if len(p.rules) == 0 {
+		return p.defaultExpiresIn, true
+	}
+	cacheKey := metric.MetricName() + "\xff" + metric.Origin() + "\xff" + metric.MetricType().String()
+	index, ok := p.ruleIndexCache.Load(cacheKey)
+	if !ok {
+		index = -1
+		for i, rule := range p.rules {
+			if rule.match(metric) {
+				index = i
+				break
+			}
+		}
+		p.ruleIndexCache.Store(cacheKey, index)
+	}
+	if index.(int) < 0 {
+		return p.defaultExpiresIn, true
+	}
+	rule := p.rules[index.(int)]
+	if rule.NeverExpire {
+		return 0, false
+	}
+	return rule.Expiration, true
+}
@@ -0,0 +1,109 @@
+package collectors_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudfoundry/firehose_exporter/collectors"
+	"github.com/cloudfoundry/firehose_exporter/metricmaker"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("ExpirationPolicy", func() {
+	ginkgo.BeforeEach(func() {
+		metricmaker.SetMetricConverters(make([]metricmaker.MetricConverter, 0))
+	})
+
+	ginkgo.It("should use default expiration when no rule match", func() {
+		policy, err := collectors.NewExpirationPolicy(10*time.Minute, &collectors.ExpirationRule{
+			Origin:     "bbs",
+			Expiration: time.Hour,
+		})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		expiresIn, ok := policy.ExpiresIn(metricmaker.NewRawMetricGauge("my_metric", map[string]string{
+			"origin": "rep",
+		}, 1))
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(expiresIn).To(gomega.Equal(10 * time.Minute))
+	})
+
+	ginkgo.It("should use first rule matching all its selectors", func() {
+		policy, err := collectors.NewExpirationPolicy(10*time.Minute,
+			&collectors.ExpirationRule{
+				MetricName: "my_.*",
+				MetricType: "counter",
+				Expiration: time.Hour,
+			},
+			&collectors.ExpirationRule{
+				MetricName: "my_.*",
+				Origin:     "bbs",
+				Expiration: 2 * time.Hour,
+			},
+			&collectors.ExpirationRule{
+				MetricName:  "my_.*",
+				NeverExpire: true,
+			},
+		)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		expiresIn, ok := policy.ExpiresIn(metricmaker.NewRawMetricCounter("my_metric", map[string]string{
+			"origin": "bbs",
+		}, 1))
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(expiresIn).To(gomega.Equal(time.Hour))
+
+		expiresIn, ok = policy.ExpiresIn(metricmaker.NewRawMetricGauge("my_metric", map[string]string{
+			"origin": "bbs",
+		}, 1))
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(expiresIn).To(gomega.Equal(2 * time.Hour))
+
+		_, ok = policy.ExpiresIn(metricmaker.NewRawMetricGauge("my_metric", map[string]string{
+			"origin": "rep",
+		}, 1))
+		gomega.Expect(ok).To(gomega.BeFalse())
+
+		expiresIn, ok = policy.ExpiresIn(metricmaker.NewRawMetricGauge("not_my_metric", map[string]string{
+			"origin": "rep",
+		}, 1))
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(expiresIn).To(gomega.Equal(10 * time.Minute))
+	})
+
+	ginkgo.It("should refuse invalid rules", func() {
+		_, err := collectors.NewExpirationPolicy(10*time.Minute, &collectors.ExpirationRule{
+			Origin: "bbs",
+		})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+
+		_, err = collectors.NewExpirationPolicy(10*time.Minute, &collectors.ExpirationRule{
+			MetricType: "unknown",
+			Expiration: time.Hour,
+		})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should load rules from a yaml file", func() {
+		dir, err := os.MkdirTemp("", "rules")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "rules.yml")
+		gomega.Expect(os.WriteFile(path, []byte(`
+- metric_name: "my_.*"
+  expiration: 15m
+- origin: bbs
+  never_expire: true
+`), 0o600)).To(gomega.Succeed())
+
+		rules, err := collectors.LoadExpirationRules(path)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(rules).To(gomega.HaveLen(2))
+		gomega.Expect(rules[0].MetricName).To(gomega.Equal("my_.*"))
+		gomega.Expect(rules[0].Expiration).To(gomega.Equal(15 * time.Minute))
+		gomega.Expect(rules[1].Origin).To(gomega.Equal("bbs"))
+		gomega.Expect(rules[1].NeverExpire).To(gomega.BeTrue())
+	})
+})
@@ -0,0 +1,602 @@
+package collectors
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"github.com/gogo/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// number of shards for series of a metric family, collect workers writing
+	// in the same family only contend when they hit the same shard
+	storeShardCount = 16
+	// width of expiration buckets, sweeping only visits series of buckets which started
+	expiryBucketWidth = int64(time.Second)
+	// number of points in a row a series rejects as out of order before taking them, a source
+	// whose clock stepped backwards would otherwise never update its series again
+	maxOutOfOrderRejections = 10
+)
+
+var (
+	labelValueEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+	helpEscaper       = strings.NewReplacer("\\", `\\`, "\n", `\n`)
+)
+
+type labelPair struct {
+	name  string
+	value string
+}
+
+// series holds last point received for a set of labels as plain values to keep
+// the number of pointers the garbage collector has to scan low, only points
+// which can't be reduced to a single value (histograms and summaries) keep their dto form.
+type series struct {
+	labels []labelPair
+	// labels already serialized for text exposition format, e.g. `{origin="rep"}`
+	labelsText  string
+	origin      string
+	value       float64
+	timestampMs int64
+	hasTs       bool
+	// unix time in nanoseconds of the envelope of the last point, zero when unknown
+	envelopeTimestamp int64
+	// points rejected as out of order since the last point
+	rejections int
+	// unix time in nanoseconds, zero means series never expire
+	expireAt int64
+	complex  *dto.Metric
+	// counter of points having an exemplar or a created timestamp, which are only exposed in OpenMetrics format,
+	// its value is the one of value
+	counter *dto.Counter
+}
+
+func newSeries(point *metrics.RawMetric) series {
+	pointLabels := point.Metric().GetLabel()
+	labels := make([]labelPair, len(pointLabels))
+	for i, label := range pointLabels {
+		labels[i] = labelPair{name: label.GetName(), value: label.GetValue()}
+	}
+	return series{
+		labels:     labels,
+		labelsText: labelsToText(labels),
+		origin:     point.Origin(),
+	}
+}
+
+func (s *series) setPoint(point *metrics.RawMetric) {
+	metric := point.Metric()
+	s.complex = nil
+	s.counter = nil
+	switch {
+	case metric.Counter != nil:
+		s.value = metric.Counter.GetValue()
+		if metric.Counter.Exemplar != nil || metric.Counter.CreatedTimestamp != nil {
+			s.counter = metric.Counter
+		}
+	case metric.Gauge != nil:
+		s.value = metric.Gauge.GetValue()
+	case metric.Untyped != nil:
+		s.value = metric.Untyped.GetValue()
+	default:
+		s.complex = metric
+	}
+	s.hasTs = metric.TimestampMs != nil
+	s.timestampMs = metric.GetTimestampMs()
+	s.rejections = 0
+	if point.EnvelopeTimestamp() != 0 {
+		s.envelopeTimestamp = point.EnvelopeTimestamp()
+	}
+}
+
+// isOutOfOrder tells if point comes from an envelope older than the one of the last point of the series,
+// unless the series already rejected maxOutOfOrderRejections points in a row.
+func (s *series) isOutOfOrder(point *metrics.RawMetric) bool {
+	return point.EnvelopeTimestamp() != 0 && point.EnvelopeTimestamp() < s.envelopeTimestamp &&
+		s.rejections < maxOutOfOrderRejections
+}
+
+func (s *series) isExpired(now int64) bool {
+	return s.expireAt != 0 && s.expireAt <= now
+}
+
+func (s *series) toMetric(metricType dto.MetricType) *dto.Metric {
+	metric := &dto.Metric{}
+	if s.complex != nil {
+		metric.Histogram = s.complex.Histogram
+		metric.Summary = s.complex.Summary
+	} else {
+		switch metricType {
+		case dto.MetricType_GAUGE:
+			metric.Gauge = &dto.Gauge{Value: proto.Float64(s.value)}
+		case dto.MetricType_UNTYPED:
+			metric.Untyped = &dto.Untyped{Value: proto.Float64(s.value)}
+		default:
+			metric.Counter = &dto.Counter{
+				Value:            proto.Float64(s.value),
+				Exemplar:         s.counter.GetExemplar(),
+				CreatedTimestamp: s.counter.GetCreatedTimestamp(),
+			}
+		}
+	}
+	metric.Label = make([]*dto.LabelPair, len(s.labels))
+	for i, label := range s.labels {
+		metric.Label[i] = &dto.LabelPair{
+			Name:  proto.String(label.name),
+			Value: proto.String(label.value),
+		}
+	}
+	if s.hasTs {
+		metric.TimestampMs = proto.Int64(s.timestampMs)
+	}
+	return metric
+}
+
+type storeShard struct {
+	mu     sync.RWMutex
+	series map[uint64]series
+	// bumped on every write or removal of a series of the shard
+	version uint64
+
+	cacheMu   sync.Mutex
+	textCache renderCache
+}
+
+// writeText writes series of the shard in text exposition format, series are only rendered again
+// when the shard changed since the last render or when one of the rendered series expired.
+// Series filtered by labels are always rendered on the fly.
+func (sh *storeShard) writeText(buf *bytes.Buffer, name string, now int64, shareWindow int64, selector *SeriesSelector) int {
+	if selector.hasLabelMatchers() {
+		nbSeries := 0
+		line := make([]byte, 0, 256)
+		sh.mu.RLock()
+		var current series
+		for _, current = range sh.series {
+			if current.isExpired(now) || !selector.matchLabels(current.labels) {
+				continue
+			}
+			nbSeries++
+			line = appendSeriesText(line[:0], name, &current)
+			buf.Write(line)
+		}
+		sh.mu.RUnlock()
+		return nbSeries
+	}
+
+	sh.cacheMu.Lock()
+	defer sh.cacheMu.Unlock()
+
+	sh.mu.RLock()
+	if !sh.textCache.isFresh(sh.version, "", "", now, shareWindow) {
+		data := sh.textCache.data[:0]
+		nbSeries := 0
+		validUntil := int64(0)
+		var current series
+		for _, current = range sh.series {
+			if current.isExpired(now) {
+				continue
+			}
+			nbSeries++
+			validUntil = minExpireAt(validUntil, current.expireAt)
+			data = appendSeriesText(data, name, &current)
+		}
+		sh.textCache = renderCache{
+			version:    sh.version,
+			renderedAt: now,
+			validUntil: validUntil,
+			nbSeries:   nbSeries,
+			data:       data,
+		}
+	}
+	sh.mu.RUnlock()
+
+	buf.Write(sh.textCache.data)
+	return sh.textCache.nbSeries
+}
+
+func appendSeriesText(data []byte, name string, s *series) []byte {
+	data = append(data, name...)
+	data = append(data, s.labelsText...)
+	data = append(data, ' ')
+	data = appendFloat(data, s.value)
+	if s.hasTs {
+		data = append(data, ' ')
+		data = strconv.AppendInt(data, s.timestampMs, 10)
+	}
+	return append(data, '\n')
+}
+
+// renderCache keeps series already encoded, it is reused as long as series did not change and none
+// of them expired, or regardless of changes while it is younger than the share window, which lets
+// scrapes close in time (e.g. from HA Prometheus replicas) share the same render.
+type renderCache struct {
+	version    uint64
+	help       string
+	unit       string
+	renderedAt int64
+	// unix time in nanoseconds of the first expiration of a rendered series, zero means never
+	validUntil int64
+	nbSeries   int
+	data       []byte
+}
+
+func (r *renderCache) isFresh(version uint64, help string, unit string, now int64, shareWindow int64) bool {
+	if r.renderedAt == 0 {
+		return false
+	}
+	if now-r.renderedAt < shareWindow {
+		return true
+	}
+	return r.version == version && r.help == help && r.unit == unit && (r.validUntil == 0 || now < r.validUntil)
+}
+
+func minExpireAt(validUntil int64, expireAt int64) int64 {
+	if expireAt != 0 && (validUntil == 0 || expireAt < validUntil) {
+		return expireAt
+	}
+	return validUntil
+}
+
+type metricFamily struct {
+	name       string
+	metricType dto.MetricType
+	help       atomic.Pointer[string]
+	// base unit of the family, only exposed in OpenMetrics format
+	unit   atomic.Pointer[string]
+	shards [storeShardCount]storeShard
+
+	cacheMu sync.Mutex
+	// encoded family by exposition format, for families which are not written from shards text cache
+	caches map[expfmt.Format]*renderCache
+}
+
+func newMetricFamily(point *metrics.RawMetric) *metricFamily {
+	fam := &metricFamily{
+		name:       point.MetricName(),
+		metricType: *point.MetricType(),
+	}
+	help := point.Help()
+	fam.help.Store(&help)
+	unit := point.Unit()
+	fam.unit.Store(&unit)
+	return fam
+}
+
+func (f *metricFamily) shard(id uint64) *storeShard {
+	return &f.shards[id%storeShardCount]
+}
+
+func (f *metricFamily) rawMetric(s series) *metrics.RawMetric {
+	rawMetric := metrics.NewRawMetric(f.name, s.origin, s.toMetric(f.metricType))
+	rawMetric.SetHelp(*f.help.Load())
+	rawMetric.SetUnit(*f.unit.Load())
+	if s.expireAt != 0 {
+		rawMetric.ExpireIn(time.Until(time.Unix(0, s.expireAt)))
+	}
+	return rawMetric
+}
+
+// version gives a number which changes whenever a series of the family is written or removed.
+func (f *metricFamily) version() uint64 {
+	version := uint64(0)
+	for i := range f.shards {
+		shard := &f.shards[i]
+		shard.mu.RLock()
+		version += shard.version
+		shard.mu.RUnlock()
+	}
+	return version
+}
+
+// toMetricFamily gives the dto form of the family and the first expiration of its series (zero for never),
+// nil is returned when there is no series to expose.
+func (f *metricFamily) toMetricFamily(now int64, help string, unit string, selector *SeriesSelector) (*dto.MetricFamily, int64) {
+	finalMetrics := make([]*dto.Metric, 0)
+	validUntil := int64(0)
+	for i := range f.shards {
+		shard := &f.shards[i]
+		shard.mu.RLock()
+		var current series
+		for _, current = range shard.series {
+			if current.isExpired(now) || !selector.matchLabels(current.labels) {
+				continue
+			}
+			validUntil = minExpireAt(validUntil, current.expireAt)
+			finalMetrics = append(finalMetrics, current.toMetric(f.metricType))
+		}
+		shard.mu.RUnlock()
+	}
+	if len(finalMetrics) == 0 {
+		return nil, validUntil
+	}
+	metricFamily := &dto.MetricFamily{
+		Name:   proto.String(f.name),
+		Help:   proto.String(help),
+		Type:   f.metricType.Enum(),
+		Metric: finalMetrics,
+	}
+	if unit != "" {
+		metricFamily.Unit = proto.String(unit)
+	}
+	return metricFamily, validUntil
+}
+
+// encode gives the family encoded in the given format, it is empty when there is no series to expose.
+// The returned slice is never modified afterward, a new render always gets its own buffer.
+func (f *metricFamily) encode(format expfmt.Format, now int64, shareWindow int64, selector *SeriesSelector) ([]byte, error) {
+	if selector.hasLabelMatchers() {
+		metricFamily, _ := f.toMetricFamily(now, *f.help.Load(), *f.unit.Load(), selector)
+		return encodeFamily(format, metricFamily)
+	}
+
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+
+	help := *f.help.Load()
+	unit := *f.unit.Load()
+	version := f.version()
+	cache, ok := f.caches[format]
+	if ok && cache.isFresh(version, help, unit, now, shareWindow) {
+		return cache.data, nil
+	}
+
+	metricFamily, validUntil := f.toMetricFamily(now, help, unit, selector)
+	data, err := encodeFamily(format, metricFamily)
+	if err != nil {
+		return nil, err
+	}
+	cache = &renderCache{
+		version:    version,
+		help:       help,
+		unit:       unit,
+		renderedAt: now,
+		validUntil: validUntil,
+		data:       data,
+	}
+	if f.caches == nil {
+		f.caches = make(map[expfmt.Format]*renderCache)
+	}
+	f.caches[format] = cache
+	return cache.data, nil
+}
+
+func encodeFamily(format expfmt.Format, metricFamily *dto.MetricFamily) ([]byte, error) {
+	if metricFamily == nil {
+		return nil, nil
+	}
+	buf := &bytes.Buffer{}
+	// units and created timestamps are only written in OpenMetrics format,
+	// names of families having a unit already end with it
+	if err := expfmt.NewEncoder(buf, format, expfmt.WithUnit(), expfmt.WithCreatedLines()).Encode(metricFamily); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// canWriteText tells if the family can be written directly in text format from pre-serialized series.
+func (f *metricFamily) canWriteText() bool {
+	return f.metricType == dto.MetricType_COUNTER ||
+		f.metricType == dto.MetricType_GAUGE ||
+		f.metricType == dto.MetricType_UNTYPED
+}
+
+// writeText writes the family in text exposition format (with underscores escaping),
+// it gives the number of series written.
+func (f *metricFamily) writeText(buf *bytes.Buffer, now int64, shareWindow int64, selector *SeriesSelector) int {
+	name := escapeName(f.name)
+	start := buf.Len()
+	buf.WriteString("# HELP ")
+	buf.WriteString(name)
+	buf.WriteByte(' ')
+	_, _ = helpEscaper.WriteString(buf, *f.help.Load())
+	buf.WriteString("\n# TYPE ")
+	buf.WriteString(name)
+	buf.WriteByte(' ')
+	buf.WriteString(strings.ToLower(f.metricType.String()))
+	buf.WriteByte('\n')
+
+	nbSeries := 0
+	for i := range f.shards {
+		nbSeries += f.shards[i].writeText(buf, name, now, shareWindow, selector)
+	}
+	if nbSeries == 0 {
+		buf.Truncate(start)
+	}
+	return nbSeries
+}
+
+type seriesRef struct {
+	family *metricFamily
+	id     uint64
+}
+
+// metricStore keeps series by metric family, each family being sharded by series id.
+// Series which can expire are referenced in expiration buckets: a series is only
+// looked at when the bucket of its last known expiration starts, it is then either
+// removed or moved to the bucket of its new expiration.
+type metricStore struct {
+	familiesMu sync.RWMutex
+	families   map[string]*metricFamily
+
+	expiryMu      sync.Mutex
+	expiryBuckets map[int64][]seriesRef
+}
+
+func newMetricStore() *metricStore {
+	return &metricStore{
+		families:      make(map[string]*metricFamily),
+		expiryBuckets: make(map[int64][]seriesRef),
+	}
+}
+
+func (s *metricStore) family(point *metrics.RawMetric) *metricFamily {
+	s.familiesMu.RLock()
+	metricFamily, ok := s.families[point.MetricName()]
+	s.familiesMu.RUnlock()
+	if !ok {
+		s.familiesMu.Lock()
+		metricFamily, ok = s.families[point.MetricName()]
+		if !ok {
+			metricFamily = newMetricFamily(point)
+			s.families[point.MetricName()] = metricFamily
+		}
+		s.familiesMu.Unlock()
+	}
+	if point.Help() != *metricFamily.help.Load() {
+		help := point.Help()
+		metricFamily.help.Store(&help)
+	}
+	if point.Unit() != *metricFamily.unit.Load() {
+		unit := point.Unit()
+		metricFamily.unit.Store(&unit)
+	}
+	return metricFamily
+}
+
+// Store saves point as the last value of its series, expireAt is a unix time in nanoseconds (zero for never).
+// Points from an envelope older than the one of the last point of the series are rejected, false is then returned,
+// until maxOutOfOrderRejections points in a row were rejected: the source clock is then taken as stepped backwards.
+func (s *metricStore) Store(point *metrics.RawMetric, expireAt int64) bool {
+	fam := s.family(point)
+	id := point.ID()
+	shard := fam.shard(id)
+
+	shard.mu.Lock()
+	if shard.series == nil {
+		shard.series = make(map[uint64]series)
+	}
+	current, found := shard.series[id]
+	if !found {
+		current = newSeries(point)
+	}
+	if current.isOutOfOrder(point) {
+		current.rejections++
+		shard.series[id] = current
+		shard.mu.Unlock()
+		return false
+	}
+	current.setPoint(point)
+	previousExpireAt := current.expireAt
+	current.expireAt = expireAt
+	shard.series[id] = current
+	shard.version++
+	shard.mu.Unlock()
+
+	if expireAt != 0 && (!found || previousExpireAt == 0) {
+		s.expiryMu.Lock()
+		bucket := expireAt / expiryBucketWidth
+		s.expiryBuckets[bucket] = append(s.expiryBuckets[bucket], seriesRef{family: fam, id: id})
+		s.expiryMu.Unlock()
+	}
+	return true
+}
+
+// Sweep removes series expired at the given unix time in nanoseconds and gives them back.
+func (s *metricStore) Sweep(now int64) []*metrics.RawMetric {
+	currentBucket := now / expiryBucketWidth
+	due := make([]seriesRef, 0)
+	s.expiryMu.Lock()
+	for bucket, refs := range s.expiryBuckets {
+		if bucket <= currentBucket {
+			due = append(due, refs...)
+			delete(s.expiryBuckets, bucket)
+		}
+	}
+	s.expiryMu.Unlock()
+
+	expired := make([]*metrics.RawMetric, 0)
+	refile := make(map[int64][]seriesRef)
+	for _, ref := range due {
+		shard := ref.family.shard(ref.id)
+		shard.mu.Lock()
+		current, found := shard.series[ref.id]
+		switch {
+		case !found || current.expireAt == 0:
+		case current.isExpired(now):
+			delete(shard.series, ref.id)
+			shard.version++
+			expired = append(expired, ref.family.rawMetric(current))
+		default:
+			bucket := current.expireAt / expiryBucketWidth
+			refile[bucket] = append(refile[bucket], ref)
+		}
+		shard.mu.Unlock()
+	}
+
+	if len(refile) > 0 {
+		s.expiryMu.Lock()
+		for bucket, refs := range refile {
+			s.expiryBuckets[bucket] = append(s.expiryBuckets[bucket], refs...)
+		}
+		s.expiryMu.Unlock()
+	}
+	return expired
+}
+
+func (s *metricStore) RangeFamilies(fn func(fam *metricFamily) bool) {
+	s.familiesMu.RLock()
+	families := make([]*metricFamily, 0, len(s.families))
+	for _, fam := range s.families {
+		families = append(families, fam)
+	}
+	s.familiesMu.RUnlock()
+
+	for _, fam := range families {
+		if !fn(fam) {
+			return
+		}
+	}
+}
+
+func labelsToText(labels []labelPair) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	separator := byte('{')
+	for _, label := range labels {
+		sb.WriteByte(separator)
+		sb.WriteString(escapeName(label.name))
+		sb.WriteString(`="`)
+		_, _ = labelValueEscaper.WriteString(&sb, label.value)
+		sb.WriteByte('"')
+		separator = ','
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func escapeName(name string) string {
+	if model.LegacyValidation.IsValidMetricName(name) {
+		return name
+	}
+	return model.EscapeName(name, model.UnderscoreEscaping)
+}
+
+func appendFloat(b []byte, f float64) []byte {
+	switch {
+	case f == 1:
+		return append(b, '1')
+	case f == 0:
+		return append(b, '0')
+	case f == -1:
+		return append(b, "-1"...)
+	case math.IsNaN(f):
+		return append(b, "NaN"...)
+	case math.IsInf(f, +1):
+		return append(b, "+Inf"...)
+	case math.IsInf(f, -1):
+		return append(b, "-Inf"...)
+	default:
+		return strconv.AppendFloat(b, f, 'g', -1, 64)
+	}
+}
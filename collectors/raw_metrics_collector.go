@@ -1,6 +1,7 @@
 package collectors
 
 import (
+	"bytes"
 	"compress/gzip"
 	"io"
 	"net/http"
@@ -8,11 +9,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/cloudfoundry/firehose_exporter/derived"
 	"github.com/cloudfoundry/firehose_exporter/metrics"
-	"github.com/gogo/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
-	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -24,33 +25,68 @@ var gzipPool = sync.Pool{
 
 type RawMetricsCollector struct {
 	pointBuffer           chan []*metrics.RawMetric
-	metricStore           *sync.Map
-	metricExpireIn        time.Duration
+	metricStore           *metricStore
+	expirationPolicy      *ExpirationPolicy
 	cleanPeriodicDuration time.Duration
+	internalMetrics       *metrics.InternalMetrics
+	renderShareWindow     time.Duration
+	exposeSeries          func() bool
+	derivedEngine         *derived.Engine
+	openMetrics           bool
 }
 
 func NewRawMetricsCollector(
 	pointBuffer chan []*metrics.RawMetric,
 	metricExpireIn time.Duration,
+	internalMetrics *metrics.InternalMetrics,
 ) *RawMetricsCollector {
 	return &RawMetricsCollector{
-		pointBuffer:           pointBuffer,
-		metricStore:           &sync.Map{},
-		metricExpireIn:        metricExpireIn,
+		pointBuffer: pointBuffer,
+		metricStore: newMetricStore(),
+		expirationPolicy: &ExpirationPolicy{
+			defaultExpiresIn: metricExpireIn,
+			ruleIndexCache:   &sync.Map{},
+		},
 		cleanPeriodicDuration: 30 * time.Second,
+		internalMetrics:       internalMetrics,
 	}
 }
 
 func (c *RawMetricsCollector) Collect() {
 	for points := range c.pointBuffer {
-		for _, point := range points {
-			smapMetric, _ := c.metricStore.LoadOrStore(point.MetricName(), &sync.Map{})
-			point.ExpireIn(c.metricExpireIn)
-			smapMetric.(*sync.Map).Store(point.ID(), point)
+		c.StorePoints(points)
+	}
+}
+
+// StorePoints saves points in metric store with their expiration.
+func (c *RawMetricsCollector) StorePoints(points []*metrics.RawMetric) {
+	now := time.Now()
+	lag := c.lagObserver()
+	for _, point := range points {
+		if point.EnvelopeTimestamp() != 0 {
+			lag.observe(point.Origin(), now.UnixNano()-point.EnvelopeTimestamp())
+		}
+		if !c.storePoint(point, now) {
+			c.internalMetrics.TotalOutOfOrderRejected.WithLabelValues(point.Origin()).Inc()
+			continue
+		}
+		if c.derivedEngine == nil {
+			continue
+		}
+		for _, derivedPoint := range c.derivedEngine.Observe(point, now) {
+			c.storePoint(derivedPoint, now)
 		}
 	}
 }
 
+func (c *RawMetricsCollector) storePoint(point *metrics.RawMetric, now time.Time) bool {
+	var expireAt int64
+	if expiresIn, ok := c.expirationPolicy.ExpiresIn(point); ok {
+		expireAt = now.Add(expiresIn).UnixNano()
+	}
+	return c.metricStore.Store(point, expireAt)
+}
+
 func (c *RawMetricsCollector) Start() {
 	for i := 0; i < 10; i++ {
 		go c.Collect()
@@ -62,104 +98,144 @@ func (c *RawMetricsCollector) SetCleanPeriodicDuration(cleanPeriodicDuration tim
 	c.cleanPeriodicDuration = cleanPeriodicDuration
 }
 
+// SetMetricExpireIn sets the default expiration of series, it must be called before collecting points.
 func (c *RawMetricsCollector) SetMetricExpireIn(metricExpireIn time.Duration) {
-	c.metricExpireIn = metricExpireIn
+	c.expirationPolicy.defaultExpiresIn = metricExpireIn
+}
+
+func (c *RawMetricsCollector) SetExpirationPolicy(expirationPolicy *ExpirationPolicy) {
+	c.expirationPolicy = expirationPolicy
+}
+
+// SetRenderShareWindow sets for how long a render of the metric store is reused by following scrapes
+// even if series changed meanwhile. It defaults to zero, which only reuses renders of series which did
+// not change: concurrent scrapes of a family wait for the render in progress and share it.
+func (c *RawMetricsCollector) SetRenderShareWindow(renderShareWindow time.Duration) {
+	c.renderShareWindow = renderShareWindow
+}
+
+// SetDerivedEngine makes stored points update derived metrics, which are stored alongside.
+func (c *RawMetricsCollector) SetDerivedEngine(derivedEngine *derived.Engine) {
+	c.derivedEngine = derivedEngine
+}
+
+// SetExposeSeries sets a function telling on each scrape if series of the metric store must be rendered,
+// e.g. passive replicas of an HA group only render internal metrics.
+func (c *RawMetricsCollector) SetExposeSeries(exposeSeries func() bool) {
+	c.exposeSeries = exposeSeries
+}
+
+// SetOpenMetrics lets scrapers accepting it get metrics in OpenMetrics format, which carries units of metrics,
+// other scrapers still get the text or protobuf format.
+func (c *RawMetricsCollector) SetOpenMetrics(openMetrics bool) {
+	c.openMetrics = openMetrics
 }
 
 func (c *RawMetricsCollector) CleanPeriodic() {
 	for {
 		time.Sleep(c.cleanPeriodicDuration)
-		nbJob := 0
-		c.metricStore.Range(func(_, _ interface{}) bool {
-			nbJob++
-			return true
-		})
-		nbWorker := 5
-		wg := &sync.WaitGroup{}
-		wg.Add(nbWorker)
-
-		chanSmap := make(chan *sync.Map, nbJob)
-		for w := 0; w < nbWorker; w++ {
-			go c.cleanWorker(wg, chanSmap)
-		}
-		c.metricStore.Range(func(_, value interface{}) bool {
-			chanSmap <- value.(*sync.Map)
-			return true
-		})
-		close(chanSmap)
-		wg.Wait()
-	}
-}
-
-func (c *RawMetricsCollector) cleanWorker(wg *sync.WaitGroup, chanSmap <-chan *sync.Map) {
-	defer wg.Done()
-	for smapMetric := range chanSmap {
-		toDelete := make([]uint64, 0)
-		smapMetric.Range(func(key, value interface{}) bool {
-			rawMetric := value.(*metrics.RawMetric)
-			if rawMetric.IsSwept() {
-				toDelete = append(toDelete, key.(uint64))
-			}
-			return true
-		})
-		for _, key := range toDelete {
-			smapMetric.Delete(key)
+		for _, rawMetric := range c.metricStore.Sweep(time.Now().UnixNano()) {
+			c.internalMetrics.TotalSeriesExpired.WithLabelValues(rawMetric.MetricName()).Inc()
 		}
 	}
 }
 
+// RenderExpFmt renders series of the metric store selected by the request query (see SeriesSelector),
+// internal metrics are only added when no selector is given. No series are rendered when exposing
+// series is disabled (see SetExposeSeries).
 func (c *RawMetricsCollector) RenderExpFmt(rsp http.ResponseWriter, req *http.Request) {
-	format := expfmt.Negotiate(req.Header)
-	header := rsp.Header()
-	header.Set("Content-Type", string(format))
-	w := io.Writer(rsp)
-
-	if gzipAccepted(req.Header) {
-		header.Set("Content-Encoding", "gzip")
-		gz := gzipPool.Get().(*gzip.Writer)
-		defer gzipPool.Put(gz)
-
-		gz.Reset(w)
-		defer func() {
-			if err := gz.Close(); err != nil && !strings.Contains(err.Error(), "broken pipe") {
-				log.Warningf("Error when closing gzip writer: %s", err.Error())
-			}
-		}()
-
-		w = gz
+	selector, err := NewSeriesSelector(req.URL.Query())
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusBadRequest)
+		return
 	}
 
+	w, format, closeWriter := newExpFmtWriter(rsp, req, c.openMetrics)
+	defer closeWriter()
 	enc := expfmt.NewEncoder(w, format)
 
-	c.metricStore.Range(func(_, value interface{}) bool {
-		smapMetric := value.(*sync.Map)
-		var oneRawMetric *metrics.RawMetric
-		finalMetrics := make([]*dto.Metric, 0)
+	start := time.Now()
+	defer func() {
+		c.internalMetrics.RenderDuration.WithLabelValues(formatLabel(format)).Observe(time.Since(start).Seconds())
+	}()
 
-		smapMetric.Range(func(_, value interface{}) bool {
-			rawMetric := value.(*metrics.RawMetric)
-			if rawMetric.IsSwept() {
+	// series of counters, gauges and untyped metrics hold labels already serialized for text format
+	// which let us skip the dto form for the most common case
+	textDirect := format.FormatType() == expfmt.TypeTextPlain && format.ToEscapingScheme() == model.UnderscoreEscaping
+	now := start.UnixNano()
+	shareWindow := c.renderShareWindow.Nanoseconds()
+	exposeSeries := c.exposeSeries == nil || c.exposeSeries()
+	buf := &bytes.Buffer{}
+	c.metricStore.RangeFamilies(func(fam *metricFamily) bool {
+		if !exposeSeries {
+			return false
+		}
+		if !selector.MatchName(fam.name) {
+			return true
+		}
+		var data []byte
+		if textDirect && fam.canWriteText() {
+			buf.Reset()
+			fam.writeText(buf, now, shareWindow, selector)
+			data = buf.Bytes()
+		} else {
+			var err error
+			data, err = fam.encode(format, now, shareWindow, selector)
+			if err != nil {
+				log.Warningf("Error when encoding exp fmt: %s", err.Error())
 				return true
 			}
-			oneRawMetric = rawMetric
-			finalMetrics = append(finalMetrics, rawMetric.Metric())
-			return true
-		})
-		if oneRawMetric == nil {
-			return true
 		}
-		metricFamily := &dto.MetricFamily{
-			Name:   proto.String(oneRawMetric.MetricName()),
-			Help:   proto.String(oneRawMetric.Help()),
-			Type:   oneRawMetric.MetricType(),
-			Metric: finalMetrics,
+		if len(data) == 0 {
+			return true
 		}
-		if err := enc.Encode(metricFamily); err != nil && !strings.Contains(err.Error(), "broken pipe") {
-			log.Warningf("Error when encoding exp fmt: %s", err.Error())
+		if _, err := w.Write(data); err != nil && !strings.Contains(err.Error(), "broken pipe") {
+			log.Warningf("Error when writing exp fmt: %s", err.Error())
 		}
 		return true
 	})
 
+	if selector.IsEmpty() {
+		encodeGathered(enc)
+	}
+	closeEncoder(enc)
+}
+
+// RenderInternalExpFmt renders only metrics registered in the default prometheus registry,
+// which are the exporter internal metrics.
+func (c *RawMetricsCollector) RenderInternalExpFmt(rsp http.ResponseWriter, req *http.Request) {
+	w, format, closeWriter := newExpFmtWriter(rsp, req, c.openMetrics)
+	defer closeWriter()
+	enc := expfmt.NewEncoder(w, format)
+	encodeGathered(enc)
+	closeEncoder(enc)
+}
+
+// newExpFmtWriter negotiates the exposition format and compression of the response, OpenMetrics is only
+// negotiated when enabled. The returned function must be called once everything was written.
+func newExpFmtWriter(rsp http.ResponseWriter, req *http.Request, openMetrics bool) (io.Writer, expfmt.Format, func()) {
+	format := expfmt.Negotiate(req.Header)
+	if openMetrics {
+		format = expfmt.NegotiateIncludingOpenMetrics(req.Header)
+	}
+	header := rsp.Header()
+	header.Set("Content-Type", string(format))
+
+	if !gzipAccepted(req.Header) {
+		return rsp, format, func() {}
+	}
+	header.Set("Content-Encoding", "gzip")
+	gz := gzipPool.Get().(*gzip.Writer)
+	gz.Reset(rsp)
+	return gz, format, func() {
+		if err := gz.Close(); err != nil && !strings.Contains(err.Error(), "broken pipe") {
+			log.Warningf("Error when closing gzip writer: %s", err.Error())
+		}
+		gzipPool.Put(gz)
+	}
+}
+
+func encodeGathered(enc expfmt.Encoder) {
 	reg := prometheus.DefaultGatherer
 	mfs, err := reg.Gather()
 	if err != nil {
@@ -171,6 +247,9 @@ func (c *RawMetricsCollector) RenderExpFmt(rsp http.ResponseWriter, req *http.Re
 			log.Warningf("Error when encoding exp fmt from gathered collectors: %s", err.Error())
 		}
 	}
+}
+
+func closeEncoder(enc expfmt.Encoder) {
 	if closer, ok := enc.(expfmt.Closer); ok {
 		// This in particular takes care of the final "# EOF\n" line for OpenMetrics.
 		if err := closer.Close(); err != nil && !strings.Contains(err.Error(), "broken pipe") {
@@ -181,20 +260,39 @@ func (c *RawMetricsCollector) RenderExpFmt(rsp http.ResponseWriter, req *http.Re
 
 func (c *RawMetricsCollector) MetricStore() map[string][]*metrics.RawMetric {
 	metricStoreMap := make(map[string][]*metrics.RawMetric)
-	c.metricStore.Range(func(metricName, value interface{}) bool {
-		smapMetric := value.(*sync.Map)
+	c.metricStore.RangeFamilies(func(fam *metricFamily) bool {
 		finalMetrics := make([]*metrics.RawMetric, 0)
-		smapMetric.Range(func(_, value interface{}) bool {
-			rawMetric := value.(*metrics.RawMetric)
-			finalMetrics = append(finalMetrics, rawMetric)
-			return true
-		})
-		metricStoreMap[metricName.(string)] = finalMetrics
+		for i := range fam.shards {
+			shard := &fam.shards[i]
+			shard.mu.RLock()
+			for _, s := range shard.series {
+				finalMetrics = append(finalMetrics, fam.rawMetric(s))
+			}
+			shard.mu.RUnlock()
+		}
+		metricStoreMap[fam.name] = finalMetrics
 		return true
 	})
 	return metricStoreMap
 }
 
+func formatLabel(format expfmt.Format) string {
+	switch format.FormatType() {
+	case expfmt.TypeTextPlain:
+		return "text"
+	case expfmt.TypeProtoDelim:
+		return "protobuf"
+	case expfmt.TypeProtoText:
+		return "prototext"
+	case expfmt.TypeProtoCompact:
+		return "protocompact"
+	case expfmt.TypeOpenMetrics:
+		return "openmetrics"
+	default:
+		return "unknown"
+	}
+}
+
 func gzipAccepted(header http.Header) bool {
 	a := header.Get("Accept-Encoding")
 	parts := strings.Split(a, ",")
@@ -206,3 +304,24 @@ func gzipAccepted(header http.Header) bool {
 	}
 	return false
 }
+
+// lagObserver observes ingestion lag of a batch of points, points of a batch mostly come from the same origin
+// so the observer of the last origin is kept.
+type lagObserver struct {
+	lag      *prometheus.HistogramVec
+	origin   string
+	observer prometheus.Observer
+}
+
+func (c *RawMetricsCollector) lagObserver() *lagObserver {
+	return &lagObserver{lag: c.internalMetrics.IngestionLag}
+}
+
+// observe records a lag in nanoseconds, lags from envelopes stamped in the future are recorded as zero.
+func (o *lagObserver) observe(origin string, lag int64) {
+	if o.observer == nil || origin != o.origin {
+		o.origin = origin
+		o.observer = o.lag.WithLabelValues(origin)
+	}
+	o.observer.Observe(time.Duration(max(lag, 0)).Seconds())
+}
@@ -0,0 +1,105 @@
+package collectors_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/firehose_exporter/collectors"
+	"github.com/cloudfoundry/firehose_exporter/metricmaker"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+)
+
+const benchSeriesCount = 1000000
+
+var (
+	benchCollectorOnce sync.Once
+	benchCollector     *collectors.RawMetricsCollector
+)
+
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardResponseWriter) Write(b []byte) (int, error) {
+	return io.Discard.Write(b)
+}
+
+func (d *discardResponseWriter) WriteHeader(int) {}
+
+// benchPoints gives count points spread over 10 metric names like container metrics of many app instances.
+func benchPoints(count int) [][]*metrics.RawMetric {
+	metricmaker.SetMetricConverters(make([]metricmaker.MetricConverter, 0))
+	batches := make([][]*metrics.RawMetric, 0, count/1000)
+	batch := make([]*metrics.RawMetric, 0, 1000)
+	for i := 0; i < count; i++ {
+		batch = append(batch, metricmaker.NewRawMetricGauge("container_metric_"+strconv.Itoa(i%10), map[string]string{
+			"origin":         "rep",
+			"source_id":      "app-" + strconv.Itoa(i/10/4),
+			"instance_id":    strconv.Itoa(i / 10 % 4),
+			"bosh_job_name":  "diego-cell",
+			"bosh_job_id":    "a3b4c5d6-0000-0000-0000-" + strconv.Itoa(i%100),
+			"environment":    "bench",
+			"application_id": "app-" + strconv.Itoa(i/10/4),
+		}, float64(i)))
+		if len(batch) == cap(batch) {
+			batches = append(batches, batch)
+			batch = make([]*metrics.RawMetric, 0, 1000)
+		}
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func storeAll(collector *collectors.RawMetricsCollector, batches [][]*metrics.RawMetric) {
+	for _, batch := range batches {
+		collector.StorePoints(batch)
+	}
+}
+
+func setupBenchCollector() *collectors.RawMetricsCollector {
+	benchCollectorOnce.Do(func() {
+		benchCollector = collectors.NewRawMetricsCollector(nil, 10*time.Minute, internalMetric)
+		storeAll(benchCollector, benchPoints(benchSeriesCount))
+	})
+	return benchCollector
+}
+
+func benchmarkRenderExpFmt(b *testing.B, accept string) {
+	collector := setupBenchCollector()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/metrics", nil)
+	req.Header.Set("Accept", accept)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		collector.RenderExpFmt(&discardResponseWriter{header: http.Header{}}, req)
+	}
+}
+
+func BenchmarkRenderExpFmtText1MSeries(b *testing.B) {
+	benchmarkRenderExpFmt(b, "text/plain")
+}
+
+func BenchmarkRenderExpFmtProtobuf1MSeries(b *testing.B) {
+	benchmarkRenderExpFmt(b, "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited")
+}
+
+func BenchmarkCollectUpdate1MSeries(b *testing.B) {
+	collector := setupBenchCollector()
+	batches := benchPoints(benchSeriesCount)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		storeAll(collector, batches)
+	}
+}
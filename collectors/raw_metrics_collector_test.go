@@ -3,31 +3,139 @@ package collectors_test
 import (
 	"bytes"
 	"compress/gzip"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"time"
 
+	"github.com/cloudfoundry/firehose_exporter/derived"
 	"github.com/cloudfoundry/firehose_exporter/metricmaker"
 	"github.com/cloudfoundry/firehose_exporter/metrics"
 	"github.com/cloudfoundry/firehose_exporter/testing"
+	"github.com/gogo/protobuf/proto"
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/cloudfoundry/firehose_exporter/collectors"
 )
 
+func counterValue(c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	_ = c.Write(m)
+	return m.GetCounter().GetValue()
+}
+
 var _ = ginkgo.Describe("RawMetricsCollector", func() {
 	var pointBuffer chan []*metrics.RawMetric
 	var collector *collectors.RawMetricsCollector
 	ginkgo.BeforeEach(func() {
 		pointBuffer = make(chan []*metrics.RawMetric)
-		collector = collectors.NewRawMetricsCollector(pointBuffer, 10*time.Minute)
+		collector = collectors.NewRawMetricsCollector(pointBuffer, 10*time.Minute, internalMetric)
 	})
 
 	ginkgo.AfterEach(func() {
 		close(pointBuffer)
 	})
 
+	ginkgo.Context("StorePoints", func() {
+		ginkgo.It("should observe ingestion lag of points from envelopes by origin", func() {
+			lag := &dto.Metric{}
+			_ = internalMetric.IngestionLag.WithLabelValues("lagging-origin").(prometheus.Metric).Write(lag)
+			before := lag.GetHistogram().GetSampleCount()
+
+			point := metricmaker.NewRawMetricGauge("my_lagging_metric", map[string]string{
+				"origin": "lagging-origin",
+			}, 1)
+			point.SetEnvelopeTimestamp(time.Now().Add(-2 * time.Second).UnixNano())
+			rollupPoint := metricmaker.NewRawMetricGauge("my_rollup_metric", map[string]string{
+				"origin": "lagging-origin",
+			}, 1)
+			collector.StorePoints([]*metrics.RawMetric{point, rollupPoint})
+
+			_ = internalMetric.IngestionLag.WithLabelValues("lagging-origin").(prometheus.Metric).Write(lag)
+			gomega.Expect(lag.GetHistogram().GetSampleCount()).To(gomega.Equal(before + 1))
+			gomega.Expect(lag.GetHistogram().GetSampleSum()).To(gomega.BeNumerically(">=", 2))
+		})
+
+		ginkgo.It("should store derived metrics of stored points", func() {
+			engine, err := derived.NewEngine(time.Minute, &derived.Rule{
+				Name:    "my_memory_utilization",
+				Op:      derived.OpRatio,
+				Metrics: []string{"my_memory", "my_memory_quota"},
+				By:      []string{"instance"},
+			})
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			collector.SetDerivedEngine(engine)
+
+			collector.StorePoints([]*metrics.RawMetric{
+				metricmaker.NewRawMetricGauge("my_memory", map[string]string{"instance": "0"}, 1),
+				metricmaker.NewRawMetricGauge("my_memory_quota", map[string]string{"instance": "0"}, 4),
+			})
+
+			ms := collector.MetricStore()
+			gomega.Expect(ms).To(gomega.HaveKey("my_memory_utilization"))
+			gomega.Expect(ms["my_memory_utilization"][0].Metric().GetGauge().GetValue()).To(gomega.Equal(0.25))
+		})
+
+		ginkgo.It("should keep the value of the newest envelope of a series", func() {
+			rejected := internalMetric.TotalOutOfOrderRejected.WithLabelValues("late-origin")
+			before := counterValue(rejected)
+			pointAt := func(value float64, envelopeTimestamp int64) *metrics.RawMetric {
+				point := metricmaker.NewRawMetricGauge("my_late_metric", map[string]string{
+					"origin": "late-origin",
+				}, value)
+				point.SetEnvelopeTimestamp(envelopeTimestamp)
+				return point
+			}
+
+			collector.StorePoints([]*metrics.RawMetric{pointAt(2, 200), pointAt(1, 100)})
+			gomega.Expect(collector.MetricStore()["my_late_metric"][0].Metric().GetGauge().GetValue()).To(gomega.Equal(2.0))
+			gomega.Expect(counterValue(rejected)).To(gomega.Equal(before + 1))
+
+			// points without envelope, e.g. rollups, are always kept
+			collector.StorePoints([]*metrics.RawMetric{pointAt(3, 200), pointAt(4, 0)})
+			gomega.Expect(collector.MetricStore()["my_late_metric"][0].Metric().GetGauge().GetValue()).To(gomega.Equal(4.0))
+			gomega.Expect(counterValue(rejected)).To(gomega.Equal(before + 1))
+
+			collector.StorePoints([]*metrics.RawMetric{pointAt(5, 150)})
+			gomega.Expect(collector.MetricStore()["my_late_metric"][0].Metric().GetGauge().GetValue()).To(gomega.Equal(4.0))
+			gomega.Expect(counterValue(rejected)).To(gomega.Equal(before + 2))
+		})
+
+		ginkgo.It("should take points of a series again after its source clock stepped backwards", func() {
+			rejected := internalMetric.TotalOutOfOrderRejected.WithLabelValues("stepped-origin")
+			before := counterValue(rejected)
+			pointAt := func(value float64, envelopeTimestamp int64) *metrics.RawMetric {
+				point := metricmaker.NewRawMetricGauge("my_stepped_metric", map[string]string{
+					"origin": "stepped-origin",
+				}, value)
+				point.SetEnvelopeTimestamp(envelopeTimestamp)
+				return point
+			}
+
+			collector.StorePoints([]*metrics.RawMetric{pointAt(1, 1000)})
+			for i := 0; i < 10; i++ {
+				collector.StorePoints([]*metrics.RawMetric{pointAt(2, int64(100+i))})
+			}
+			gomega.Expect(collector.MetricStore()["my_stepped_metric"][0].Metric().GetGauge().GetValue()).To(gomega.Equal(1.0))
+			gomega.Expect(counterValue(rejected)).To(gomega.Equal(before + 10))
+
+			collector.StorePoints([]*metrics.RawMetric{pointAt(3, 110)})
+			gomega.Expect(collector.MetricStore()["my_stepped_metric"][0].Metric().GetGauge().GetValue()).To(gomega.Equal(3.0))
+			gomega.Expect(counterValue(rejected)).To(gomega.Equal(before + 10))
+
+			// series keeps rejecting points older than the stepped back clock
+			collector.StorePoints([]*metrics.RawMetric{pointAt(4, 105)})
+			gomega.Expect(collector.MetricStore()["my_stepped_metric"][0].Metric().GetGauge().GetValue()).To(gomega.Equal(3.0))
+			gomega.Expect(counterValue(rejected)).To(gomega.Equal(before + 11))
+		})
+	})
+
 	ginkgo.Context("Collect", func() {
 		ginkgo.It("should save in metric store collected points", func() {
 			go collector.Collect()
@@ -73,8 +181,9 @@ var _ = ginkgo.Describe("RawMetricsCollector", func() {
 		})
 
 		ginkgo.Context("CleanPeriodic", func() {
-			ginkgo.It("should clean swept metrics", func() {
-				collector.SetCleanPeriodicDuration(70 * time.Millisecond)
+			ginkgo.It("should clean expired metrics", func() {
+				collector.SetCleanPeriodicDuration(20 * time.Millisecond)
+				collector.SetMetricExpireIn(60 * time.Millisecond)
 				go collector.Collect()
 				go collector.CleanPeriodic()
 				m := metricmaker.NewRawMetricCounter("my_metric", map[string]string{
@@ -83,17 +192,46 @@ var _ = ginkgo.Describe("RawMetricsCollector", func() {
 				}, 1)
 				pointBuffer <- []*metrics.RawMetric{m}
 
-				time.Sleep(50 * time.Millisecond)
-				m.SetSweep(true)
+				gomega.Eventually(collector.MetricStore).Should(gomega.HaveKeyWithValue("my_metric", gomega.HaveLen(1)))
+				gomega.Eventually(collector.MetricStore).Should(gomega.HaveKeyWithValue("my_metric", gomega.HaveLen(0)))
+			})
+
+			ginkgo.It("should keep metrics which were updated before expiring", func() {
+				collector.SetCleanPeriodicDuration(20 * time.Millisecond)
+				collector.SetMetricExpireIn(100 * time.Millisecond)
+				go collector.Collect()
+				go collector.CleanPeriodic()
+				for i := 0; i < 6; i++ {
+					pointBuffer <- []*metrics.RawMetric{
+						metricmaker.NewRawMetricCounter("my_metric", map[string]string{
+							"origin":   "my-origin",
+							"variadic": "1",
+						}, float64(i)),
+					}
+					time.Sleep(40 * time.Millisecond)
+				}
+
 				ms := collector.MetricStore()
-				gomega.Expect(ms).To(gomega.HaveKey("my_metric"))
 				gomega.Expect(ms["my_metric"]).To(gomega.HaveLen(1))
-				gomega.Expect(ms["my_metric"][0].IsSwept()).To(gomega.BeTrue())
+				gomega.Expect(ms["my_metric"][0].Metric().Counter.GetValue()).To(gomega.Equal(5.0))
+			})
 
-				time.Sleep(50 * time.Millisecond)
-				ms = collector.MetricStore()
-				gomega.Expect(ms).To(gomega.HaveKey("my_metric"))
-				gomega.Expect(ms["my_metric"]).To(gomega.HaveLen(0))
+			ginkgo.It("should count expired series by metric name", func() {
+				collector.SetCleanPeriodicDuration(20 * time.Millisecond)
+				collector.SetMetricExpireIn(10 * time.Millisecond)
+				go collector.Collect()
+				go collector.CleanPeriodic()
+				before := counterValue(internalMetric.TotalSeriesExpired.WithLabelValues("my_expired_metric"))
+				pointBuffer <- []*metrics.RawMetric{
+					metricmaker.NewRawMetricCounter("my_expired_metric", map[string]string{
+						"origin":   "my-origin",
+						"variadic": "1",
+					}, 1),
+				}
+
+				gomega.Eventually(func() float64 {
+					return counterValue(internalMetric.TotalSeriesExpired.WithLabelValues("my_expired_metric"))
+				}).Should(gomega.Equal(before + 1))
 			})
 		})
 
@@ -164,6 +302,239 @@ var _ = ginkgo.Describe("RawMetricsCollector", func() {
 					gomega.Expect(content).To(gomega.ContainSubstring(`my_second_metric{origin="my-origin",variadic="1"} 1`))
 				})
 			})
+			ginkgo.Context("OpenMetrics", func() {
+				openMetricsAccept := "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5"
+				render := func() *httptest.ResponseRecorder {
+					respRec := httptest.NewRecorder()
+					req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+					req.Header.Set("Accept", openMetricsAccept)
+					collector.RenderExpFmt(respRec, req)
+					return respRec
+				}
+				ginkgo.BeforeEach(func() {
+					m := metricmaker.NewRawMetricGauge("my_latency_seconds", map[string]string{
+						"origin": "my-origin",
+					}, 0.25)
+					m.SetHelp("my help")
+					m.SetUnit("seconds")
+					pointBuffer <- []*metrics.RawMetric{m}
+					time.Sleep(50 * time.Millisecond)
+				})
+
+				ginkgo.It("should render units of metrics when enabled", func() {
+					collector.SetOpenMetrics(true)
+					respRec := render()
+
+					gomega.Expect(respRec.Header().Get("Content-Type")).To(gomega.HavePrefix("application/openmetrics-text"))
+					content := respRec.Body.String()
+					gomega.Expect(content).To(gomega.ContainSubstring("# TYPE my_latency_seconds gauge\n# UNIT my_latency_seconds seconds\n"))
+					gomega.Expect(content).To(gomega.ContainSubstring(`my_latency_seconds{origin="my-origin"} 0.25`))
+					gomega.Expect(content).To(gomega.HaveSuffix("# EOF\n"))
+				})
+
+				ginkgo.It("should render exemplars and created timestamps of counters when enabled", func() {
+					m := metricmaker.NewRawMetricCounter("my_requests_total", map[string]string{
+						"origin": "my-origin",
+					}, 3)
+					m.Metric().Counter.CreatedTimestamp = timestamppb.New(time.Unix(10, 0))
+					m.Metric().Counter.Exemplar = &dto.Exemplar{
+						Label: []*dto.LabelPair{{Name: proto.String("request_id"), Value: proto.String("req-1")}},
+						Value: proto.Float64(1),
+					}
+					pointBuffer <- []*metrics.RawMetric{m}
+					time.Sleep(50 * time.Millisecond)
+
+					collector.SetOpenMetrics(true)
+					content := render().Body.String()
+					gomega.Expect(content).To(gomega.ContainSubstring(`my_requests_total{origin="my-origin"} 3.0 # {request_id="req-1"} 1.0` + "\n"))
+					gomega.Expect(content).To(gomega.ContainSubstring(`my_requests_created{origin="my-origin"} 10.0` + "\n"))
+
+					collector.SetOpenMetrics(false)
+					content = render().Body.String()
+					gomega.Expect(content).To(gomega.ContainSubstring(`my_requests_total{origin="my-origin"} 3` + "\n"))
+					gomega.Expect(content).ToNot(gomega.ContainSubstring("req-1"))
+				})
+
+				ginkgo.It("should render text format when disabled", func() {
+					respRec := render()
+
+					gomega.Expect(respRec.Header().Get("Content-Type")).To(gomega.HavePrefix("text/plain"))
+					gomega.Expect(respRec.Body.String()).ToNot(gomega.ContainSubstring("# UNIT"))
+				})
+			})
+			ginkgo.It("should only render internal metrics when series must not be exposed", func() {
+				leader := false
+				collector.SetExposeSeries(func() bool { return leader })
+
+				respRec := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+				collector.RenderExpFmt(respRec, req)
+				content := respRec.Body.String()
+				gomega.Expect(content).ToNot(gomega.ContainSubstring(`my_metric{`))
+				gomega.Expect(content).To(gomega.ContainSubstring(`go_gc_duration_seconds`))
+
+				leader = true
+				respRec = httptest.NewRecorder()
+				collector.RenderExpFmt(respRec, req)
+				gomega.Expect(respRec.Body.String()).To(gomega.ContainSubstring(`my_metric{origin="my-origin",variadic="1"} 1`))
+			})
+			ginkgo.Context("selectors", func() {
+				render := func(target string) *httptest.ResponseRecorder {
+					respRec := httptest.NewRecorder()
+					req := httptest.NewRequest(http.MethodGet, target, nil)
+					collector.RenderExpFmt(respRec, req)
+					return respRec
+				}
+				ginkgo.BeforeEach(func() {
+					pointBuffer <- []*metrics.RawMetric{
+						metricmaker.NewRawMetricCounter("my_metric", map[string]string{
+							"origin":   "other-origin",
+							"variadic": "1",
+						}, 1),
+					}
+					time.Sleep(50 * time.Millisecond)
+				})
+
+				ginkgo.It("should only render families matching name", func() {
+					content := render("http://localhost/metrics?name=my_sec*").Body.String()
+
+					gomega.Expect(content).To(gomega.ContainSubstring(`my_second_metric{origin="my-origin",variadic="1"} 1`))
+					gomega.Expect(content).ToNot(gomega.ContainSubstring(`my_metric`))
+					gomega.Expect(content).ToNot(gomega.ContainSubstring(`go_gc_duration_seconds`))
+				})
+
+				ginkgo.It("should only render series matching labels", func() {
+					content := render("http://localhost/metrics?label.origin=other-*").Body.String()
+
+					gomega.Expect(content).To(gomega.ContainSubstring(`my_metric{origin="other-origin",variadic="1"} 1`))
+					gomega.Expect(content).ToNot(gomega.ContainSubstring(`origin="my-origin"`))
+					gomega.Expect(content).ToNot(gomega.ContainSubstring(`my_second_metric`))
+				})
+
+				ginkgo.It("should combine name and labels selectors", func() {
+					content := render("http://localhost/metrics?name=my_metric&label.origin=my-origin&label.variadic=2&label.variadic=3&_=123").Body.String()
+
+					gomega.Expect(content).To(gomega.ContainSubstring(`my_metric{origin="my-origin",variadic="2"} 1`))
+					gomega.Expect(strings.Count(content, "\nmy_metric{")).To(gomega.Equal(1))
+				})
+
+				ginkgo.It("should refuse invalid selectors", func() {
+					gomega.Expect(render("http://localhost/metrics?label.bad-label=1").Code).To(gomega.Equal(http.StatusBadRequest))
+				})
+
+				ginkgo.It("should render internal metrics alone on their own", func() {
+					respRec := httptest.NewRecorder()
+					req := httptest.NewRequest(http.MethodGet, "http://localhost/internal/metrics", nil)
+					collector.RenderInternalExpFmt(respRec, req)
+					content := respRec.Body.String()
+
+					gomega.Expect(content).To(gomega.ContainSubstring(`go_gc_duration_seconds`))
+					gomega.Expect(content).ToNot(gomega.ContainSubstring(`my_metric{`))
+				})
+			})
+			ginkgo.Context("render cache", func() {
+				render := func(accept string) string {
+					respRec := httptest.NewRecorder()
+					req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+					if accept != "" {
+						req.Header.Set("Accept", accept)
+					}
+					collector.RenderExpFmt(respRec, req)
+					return respRec.Body.String()
+				}
+				protoAccept := "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited"
+				updateMetric := func(value float64) {
+					pointBuffer <- []*metrics.RawMetric{
+						metricmaker.NewRawMetricCounter("my_metric", map[string]string{
+							"origin":   "my-origin",
+							"variadic": "1",
+						}, value),
+					}
+					time.Sleep(50 * time.Millisecond)
+				}
+
+				ginkgo.It("should render again families which changed since last scrape", func() {
+					collector.SetRenderShareWindow(0)
+					gomega.Expect(render("")).To(gomega.ContainSubstring(`my_metric{origin="my-origin",variadic="1"} 1`))
+					protoContent := render(protoAccept)
+
+					updateMetric(5)
+
+					content := render("")
+					gomega.Expect(content).To(gomega.ContainSubstring(`my_metric{origin="my-origin",variadic="1"} 5`))
+					gomega.Expect(content).To(gomega.ContainSubstring(`my_metric{origin="my-origin",variadic="2"} 1`))
+					gomega.Expect(content).To(gomega.ContainSubstring(`my_second_metric{origin="my-origin",variadic="1"} 1`))
+					gomega.Expect(render(protoAccept)).ToNot(gomega.Equal(protoContent))
+				})
+
+				ginkgo.It("should share render between scrapes within the share window", func() {
+					collector.SetRenderShareWindow(time.Minute)
+					render("")
+
+					updateMetric(5)
+
+					gomega.Expect(render("")).To(gomega.ContainSubstring(`my_metric{origin="my-origin",variadic="1"} 1`))
+				})
+
+				ginkgo.It("should render again families when a rendered series expired", func() {
+					// expiration is set before storing, on a collector without collecting goroutines
+					collector = collectors.NewRawMetricsCollector(pointBuffer, 100*time.Millisecond, internalMetric)
+					collector.StorePoints([]*metrics.RawMetric{
+						metricmaker.NewRawMetricGauge("my_short_metric", map[string]string{
+							"origin": "my-origin",
+						}, 1),
+					})
+					time.Sleep(50 * time.Millisecond)
+					gomega.Expect(render("")).To(gomega.ContainSubstring(`my_short_metric{origin="my-origin"} 1`))
+
+					time.Sleep(100 * time.Millisecond)
+					gomega.Expect(render("")).ToNot(gomega.ContainSubstring(`my_short_metric`))
+				})
+
+				ginkgo.It("should report render duration by format", func() {
+					render("")
+					gomega.Expect(render("")).To(gomega.MatchRegexp(`firehose_render_duration_seconds_count{environment="test",format="text"} [1-9]`))
+				})
+			})
+			ginkgo.It("should render text directly as the expfmt encoder would", func() {
+				m := metricmaker.NewRawMetricGauge("my_gauge", map[string]string{
+					"origin":    "my-origin",
+					"variadic":  "with \"quotes\", \\ and \n",
+					"dot.label": "1",
+				}, math.NaN())
+				m.Metric().TimestampMs = proto.Int64(1000)
+				m.SetHelp("help with \\ and \n")
+				pointBuffer <- []*metrics.RawMetric{
+					m,
+					metricmaker.NewRawMetricGauge("my_gauge", map[string]string{
+						"origin": "my-origin",
+					}, 0.000012),
+					metricmaker.NewRawMetricCounter("my_unlabeled_metric", map[string]string{}, 1e21),
+				}
+				time.Sleep(50 * time.Millisecond)
+
+				respRec := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+				collector.RenderExpFmt(respRec, req)
+				content := respRec.Body.String()
+
+				expected := &bytes.Buffer{}
+				enc := expfmt.NewEncoder(expected, expfmt.Negotiate(req.Header))
+				for name, points := range collector.MetricStore() {
+					mf := &dto.MetricFamily{
+						Name: proto.String(name),
+						Help: proto.String(points[0].Help()),
+						Type: points[0].MetricType(),
+					}
+					for _, point := range points {
+						mf.Metric = append(mf.Metric, point.Metric())
+					}
+					gomega.Expect(enc.Encode(mf)).To(gomega.Succeed())
+				}
+				for _, line := range strings.Split(expected.String(), "\n") {
+					gomega.Expect(content).To(gomega.ContainSubstring(line + "\n"))
+				}
+			})
 		})
 	})
 })
@@ -0,0 +1,93 @@
+package collectors
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// labelParamPrefix prefixes query parameters selecting series by the value of a label.
+const labelParamPrefix = "label."
+
+// SeriesSelector restricts the series rendered on a scrape, it is built from request query parameters:
+// `name` gives patterns on metric name and `label.<name>` gives patterns on the value of the label
+// (a missing label has an empty value), other parameters (e.g. cache busters) are ignored. Patterns only
+// understand `*` as a wildcard. Values given for the same parameter are alternatives, all parameters must match.
+type SeriesSelector struct {
+	names  []*regexp.Regexp
+	labels map[string][]*regexp.Regexp
+}
+
+func NewSeriesSelector(query url.Values) (*SeriesSelector, error) {
+	selector := &SeriesSelector{
+		labels: make(map[string][]*regexp.Regexp),
+	}
+	for param, values := range query {
+		labelName, isLabel := strings.CutPrefix(param, labelParamPrefix)
+		if param != "name" && !isLabel {
+			continue
+		}
+		if isLabel && !model.LabelName(labelName).IsValidLegacy() {
+			return nil, fmt.Errorf("invalid label name '%s' in selector", labelName)
+		}
+		patterns := make([]*regexp.Regexp, 0, len(values))
+		for _, value := range values {
+			patterns = append(patterns, globToRegexp(value))
+		}
+		if param == "name" {
+			selector.names = patterns
+			continue
+		}
+		selector.labels[labelName] = patterns
+	}
+	return selector, nil
+}
+
+func globToRegexp(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+}
+
+// IsEmpty tells if the selector lets every series through.
+func (s *SeriesSelector) IsEmpty() bool {
+	return len(s.names) == 0 && len(s.labels) == 0
+}
+
+func (s *SeriesSelector) MatchName(name string) bool {
+	return matchAny(s.names, name)
+}
+
+func (s *SeriesSelector) hasLabelMatchers() bool {
+	return len(s.labels) > 0
+}
+
+func (s *SeriesSelector) matchLabels(labels []labelPair) bool {
+	for labelName, patterns := range s.labels {
+		value := ""
+		for _, label := range labels {
+			if label.name == labelName {
+				value = label.value
+				break
+			}
+		}
+		if !matchAny(patterns, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAny tells if value matches one of the patterns, no pattern matches everything.
+func matchAny(patterns []*regexp.Regexp, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
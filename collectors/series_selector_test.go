@@ -0,0 +1,52 @@
+package collectors_test
+
+import (
+	"net/url"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/firehose_exporter/collectors"
+)
+
+var _ = ginkgo.Describe("SeriesSelector", func() {
+	ginkgo.It("should be empty without query parameters", func() {
+		selector, err := collectors.NewSeriesSelector(url.Values{})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(selector.IsEmpty()).To(gomega.BeTrue())
+		gomega.Expect(selector.MatchName("any_metric")).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should match names on any of the given patterns", func() {
+		selector, err := collectors.NewSeriesSelector(url.Values{
+			"name": []string{"firehose_container_metric_*", "firehose_http_total"},
+		})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(selector.IsEmpty()).To(gomega.BeFalse())
+		gomega.Expect(selector.MatchName("firehose_container_metric_cpu_percentage")).To(gomega.BeTrue())
+		gomega.Expect(selector.MatchName("firehose_http_total")).To(gomega.BeTrue())
+		gomega.Expect(selector.MatchName("firehose_http_total_bytes")).To(gomega.BeFalse())
+		gomega.Expect(selector.MatchName("firehose_value_metric_rep_capacity")).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should not interpret regex characters in patterns", func() {
+		selector, err := collectors.NewSeriesSelector(url.Values{"name": []string{"my.metric"}})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(selector.MatchName("my.metric")).To(gomega.BeTrue())
+		gomega.Expect(selector.MatchName("myxmetric")).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should refuse invalid label names", func() {
+		_, err := collectors.NewSeriesSelector(url.Values{"label.not-a-label": []string{"value"}})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should ignore parameters which are not selectors", func() {
+		selector, err := collectors.NewSeriesSelector(url.Values{
+			"_":       []string{"123"},
+			"match[]": []string{`{job="firehose"}`},
+		})
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(selector.IsEmpty()).To(gomega.BeTrue())
+	})
+})
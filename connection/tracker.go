@@ -0,0 +1,161 @@
+package connection
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// StatusPath is the path giving the status of envelope streams of each logs provider address.
+const StatusPath = "/status"
+
+const (
+	// ReasonEOF is the reason of a stream ended by the logs provider.
+	ReasonEOF = "eof"
+	// ReasonCanceled is the reason of a stream ended by the exporter.
+	ReasonCanceled = "canceled"
+	// ReasonRequest is the reason of an attempt which didn't get any answer.
+	ReasonRequest = "request"
+)
+
+type Status struct {
+	Address        string     `json:"address"`
+	Connected      int        `json:"connected"`
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
+	Attempts       uint64     `json:"connect_attempts"`
+	Connects       uint64     `json:"connects"`
+	Disconnects    uint64     `json:"disconnects"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorAt    *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Tracker follows the lifecycle of envelope streams to a logs provider address,
+// it reports them as internal metrics and gives their status.
+type Tracker struct {
+	im *metrics.InternalMetrics
+
+	mu     sync.Mutex
+	status Status
+}
+
+func NewTracker(address string, im *metrics.InternalMetrics) *Tracker {
+	im.StreamConnected.WithLabelValues(address).Set(0)
+	return &Tracker{
+		im:     im,
+		status: Status{Address: address},
+	}
+}
+
+// Attempt records a try to open a stream.
+func (t *Tracker) Attempt() {
+	t.im.TotalStreamConnectAttempts.WithLabelValues(t.status.Address).Inc()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Attempts++
+}
+
+// Connected records a stream successfully opened.
+func (t *Tracker) Connected() {
+	t.im.TotalStreamConnects.WithLabelValues(t.status.Address).Inc()
+	t.im.StreamConnected.WithLabelValues(t.status.Address).Inc()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Connects++
+	t.status.Connected++
+	if t.status.ConnectedSince == nil {
+		now := time.Now()
+		t.status.ConnectedSince = &now
+	}
+}
+
+// Failed records an attempt which could not open a stream.
+func (t *Tracker) Failed(reason string, err error) {
+	t.setError(reason, err)
+}
+
+// Disconnected records the end of an opened stream.
+func (t *Tracker) Disconnected(reason string, err error) {
+	t.im.TotalStreamDisconnects.WithLabelValues(t.status.Address).Inc()
+	t.im.StreamConnected.WithLabelValues(t.status.Address).Dec()
+	t.mu.Lock()
+	t.status.Disconnects++
+	t.status.Connected--
+	if t.status.Connected == 0 {
+		t.status.ConnectedSince = nil
+	}
+	t.mu.Unlock()
+	t.setError(reason, err)
+}
+
+func (t *Tracker) setError(reason string, err error) {
+	t.im.TotalStreamErrors.WithLabelValues(t.status.Address, reason).Inc()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.status.LastError = err.Error()
+	t.status.LastErrorAt = &now
+}
+
+func (t *Tracker) Status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+// StreamClientInterceptor tracks gRPC streams, e.g. the ones of a loggregator.EnvelopeStreamConnector
+// given as dial option, reasons of errors are their gRPC codes.
+func (t *Tracker) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		t.Attempt()
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			t.Failed(grpcReason(err), err)
+			return nil, err
+		}
+		t.Connected()
+		return &trackedClientStream{ClientStream: stream, tracker: t}, nil
+	}
+}
+
+type trackedClientStream struct {
+	grpc.ClientStream
+	tracker *Tracker
+	once    sync.Once
+}
+
+func (s *trackedClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.once.Do(func() {
+			s.tracker.Disconnected(grpcReason(err), err)
+		})
+	}
+	return err
+}
+
+func grpcReason(err error) string {
+	if errors.Is(err, io.EOF) {
+		return ReasonEOF
+	}
+	return status.Code(err).String()
+}
+
+// NewStatusHandler gives the handler to serve on StatusPath.
+func NewStatusHandler(trackers ...*Tracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		statuses := make([]Status, len(trackers))
+		for i, tracker := range trackers {
+			statuses[i] = tracker.Status()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(statuses)
+	})
+}
@@ -0,0 +1,123 @@
+package connection_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cloudfoundry/firehose_exporter/connection"
+)
+
+func metricValue(c prometheus.Metric) float64 {
+	m := &dto.Metric{}
+	_ = c.Write(m)
+	if m.Gauge != nil {
+		return m.GetGauge().GetValue()
+	}
+	return m.GetCounter().GetValue()
+}
+
+// fakeClientStream gives its errors in order on each receive.
+type fakeClientStream struct {
+	grpc.ClientStream
+	errs []error
+}
+
+func (s *fakeClientStream) RecvMsg(_ interface{}) error {
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+var _ = ginkgo.Describe("Tracker", func() {
+	ginkgo.It("should report the lifecycle of streams", func() {
+		tracker := connection.NewTracker("rlp-lifecycle:8082", internalMetric)
+
+		tracker.Attempt()
+		tracker.Failed("Unavailable", errors.New("connection refused"))
+		tracker.Attempt()
+		tracker.Connected()
+		gomega.Expect(tracker.Status().ConnectedSince).ToNot(gomega.BeNil())
+		tracker.Disconnected(connection.ReasonEOF, io.EOF)
+
+		s := tracker.Status()
+		gomega.Expect(s.Address).To(gomega.Equal("rlp-lifecycle:8082"))
+		gomega.Expect(s.Attempts).To(gomega.Equal(uint64(2)))
+		gomega.Expect(s.Connects).To(gomega.Equal(uint64(1)))
+		gomega.Expect(s.Disconnects).To(gomega.Equal(uint64(1)))
+		gomega.Expect(s.Connected).To(gomega.Equal(0))
+		gomega.Expect(s.ConnectedSince).To(gomega.BeNil())
+		gomega.Expect(s.LastError).To(gomega.Equal("EOF"))
+		gomega.Expect(s.LastErrorAt).ToNot(gomega.BeNil())
+
+		gomega.Expect(metricValue(internalMetric.TotalStreamConnectAttempts.WithLabelValues("rlp-lifecycle:8082"))).To(gomega.Equal(float64(2)))
+		gomega.Expect(metricValue(internalMetric.TotalStreamConnects.WithLabelValues("rlp-lifecycle:8082"))).To(gomega.Equal(float64(1)))
+		gomega.Expect(metricValue(internalMetric.TotalStreamDisconnects.WithLabelValues("rlp-lifecycle:8082"))).To(gomega.Equal(float64(1)))
+		gomega.Expect(metricValue(internalMetric.TotalStreamErrors.WithLabelValues("rlp-lifecycle:8082", "Unavailable"))).To(gomega.Equal(float64(1)))
+		gomega.Expect(metricValue(internalMetric.TotalStreamErrors.WithLabelValues("rlp-lifecycle:8082", "eof"))).To(gomega.Equal(float64(1)))
+		gomega.Expect(metricValue(internalMetric.StreamConnected.WithLabelValues("rlp-lifecycle:8082"))).To(gomega.Equal(float64(0)))
+	})
+
+	ginkgo.It("should track gRPC streams with their codes as reasons", func() {
+		tracker := connection.NewTracker("rlp-grpc:8082", internalMetric)
+		interceptor := tracker.StreamClientInterceptor()
+		streams := []grpc.ClientStream{
+			nil,
+			&fakeClientStream{errs: []error{nil, status.Error(codes.Unavailable, "transport is closing"), io.EOF}},
+		}
+		errs := []error{status.Error(codes.PermissionDenied, "missing authority"), nil}
+		streamer := func(_ context.Context, _ *grpc.StreamDesc, _ *grpc.ClientConn, _ string, _ ...grpc.CallOption) (grpc.ClientStream, error) {
+			stream, err := streams[0], errs[0]
+			streams, errs = streams[1:], errs[1:]
+			return stream, err
+		}
+
+		_, err := interceptor(context.Background(), &grpc.StreamDesc{}, nil, "BatchedReceiver", streamer)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(tracker.Status().Connected).To(gomega.Equal(0))
+
+		stream, err := interceptor(context.Background(), &grpc.StreamDesc{}, nil, "BatchedReceiver", streamer)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(tracker.Status().Connected).To(gomega.Equal(1))
+		gomega.Expect(stream.RecvMsg(nil)).To(gomega.Succeed())
+		gomega.Expect(stream.RecvMsg(nil)).ToNot(gomega.Succeed())
+		gomega.Expect(stream.RecvMsg(nil)).ToNot(gomega.Succeed())
+
+		s := tracker.Status()
+		gomega.Expect(s.Attempts).To(gomega.Equal(uint64(2)))
+		gomega.Expect(s.Disconnects).To(gomega.Equal(uint64(1)))
+		gomega.Expect(s.LastError).To(gomega.ContainSubstring("transport is closing"))
+		gomega.Expect(metricValue(internalMetric.TotalStreamErrors.WithLabelValues("rlp-grpc:8082", "PermissionDenied"))).To(gomega.Equal(float64(1)))
+		gomega.Expect(metricValue(internalMetric.TotalStreamErrors.WithLabelValues("rlp-grpc:8082", "Unavailable"))).To(gomega.Equal(float64(1)))
+		gomega.Expect(metricValue(internalMetric.StreamConnected.WithLabelValues("rlp-grpc:8082"))).To(gomega.Equal(float64(0)))
+	})
+
+	ginkgo.It("should serve status of every tracker as json", func() {
+		first := connection.NewTracker("rlp-a:8082", internalMetric)
+		second := connection.NewTracker("rlp-b:8082", internalMetric)
+		second.Attempt()
+		second.Connected()
+
+		recorder := httptest.NewRecorder()
+		connection.NewStatusHandler(first, second).ServeHTTP(recorder, httptest.NewRequest("GET", connection.StatusPath, nil))
+
+		gomega.Expect(recorder.Header().Get("Content-Type")).To(gomega.Equal("application/json"))
+		statuses := make([]connection.Status, 0)
+		gomega.Expect(json.Unmarshal(recorder.Body.Bytes(), &statuses)).To(gomega.Succeed())
+		gomega.Expect(statuses).To(gomega.HaveLen(2))
+		gomega.Expect(statuses[0].Address).To(gomega.Equal("rlp-a:8082"))
+		gomega.Expect(statuses[0].Connected).To(gomega.Equal(0))
+		gomega.Expect(statuses[1].Address).To(gomega.Equal("rlp-b:8082"))
+		gomega.Expect(statuses[1].Connected).To(gomega.Equal(1))
+	})
+})
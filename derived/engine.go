@@ -0,0 +1,259 @@
+package derived
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"github.com/gogo/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const cleaningInterval = time.Minute
+
+// member is the last state of an input series of a group.
+type member struct {
+	value float64
+	// unix time in nanoseconds of the value
+	at int64
+	// per second increase from previous value, only known after the second value
+	rate      float64
+	hasRate   bool
+	updatedAt time.Time
+}
+
+// group holds input series having the same values for labels of a rule.
+type group struct {
+	labels []*dto.LabelPair
+	// series by metric index in rule and by id
+	members []map[uint64]*member
+}
+
+type compiledRule struct {
+	*Rule
+	groups map[string]*group
+}
+
+// Engine computes derived metrics at ingest time: each stored point of a metric used by a rule
+// updates its group and gives the new value of the derived series of this group.
+type Engine struct {
+	mu            sync.Mutex
+	expiration    time.Duration
+	rules         []*compiledRule
+	rulesByMetric map[string][]*compiledRule
+	lastCleaning  time.Time
+}
+
+// NewEngine validates rules, input series not updated since expiration are removed from their group.
+func NewEngine(expiration time.Duration, rules ...*Rule) (*Engine, error) {
+	e := &Engine{
+		expiration:    expiration,
+		rulesByMetric: make(map[string][]*compiledRule),
+		lastCleaning:  time.Now(),
+	}
+	for i, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("derived rule %d: %w", i, err)
+		}
+		compiled := &compiledRule{Rule: rule, groups: make(map[string]*group)}
+		e.rules = append(e.rules, compiled)
+		for _, metricName := range rule.Metrics {
+			e.rulesByMetric[metricName] = append(e.rulesByMetric[metricName], compiled)
+		}
+	}
+	return e, nil
+}
+
+// Observe takes a point going to the metric store and gives derived points it updates.
+func (e *Engine) Observe(point *metrics.RawMetric, now time.Time) []*metrics.RawMetric {
+	rules, ok := e.rulesByMetric[point.MetricName()]
+	if !ok {
+		return nil
+	}
+	value, ok := pointValue(point)
+	if !ok {
+		return nil
+	}
+	at := point.EnvelopeTimestamp()
+	if at == 0 {
+		at = now.UnixNano()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cleanup(now)
+
+	derivedPoints := make([]*metrics.RawMetric, 0, len(rules))
+	for _, rule := range rules {
+		g := rule.group(point)
+		for i, metricName := range rule.Metrics {
+			if metricName == point.MetricName() {
+				g.update(i, point.ID(), value, at, now)
+			}
+		}
+		if derivedValue, ok := rule.compute(g); ok {
+			derivedPoints = append(derivedPoints, rule.newPoint(g, derivedValue))
+		}
+	}
+	return derivedPoints
+}
+
+func (e *Engine) cleanup(now time.Time) {
+	if now.Sub(e.lastCleaning) < cleaningInterval {
+		return
+	}
+	e.lastCleaning = now
+	for _, rule := range e.rules {
+		for key, g := range rule.groups {
+			empty := true
+			for _, members := range g.members {
+				for id, m := range members {
+					if now.Sub(m.updatedAt) >= e.expiration {
+						delete(members, id)
+					}
+				}
+				empty = empty && len(members) == 0
+			}
+			if empty {
+				delete(rule.groups, key)
+			}
+		}
+	}
+}
+
+func pointValue(point *metrics.RawMetric) (float64, bool) {
+	metric := point.Metric()
+	switch {
+	case metric.Gauge != nil:
+		return metric.Gauge.GetValue(), true
+	case metric.Counter != nil:
+		return metric.Counter.GetValue(), true
+	case metric.Untyped != nil:
+		return metric.Untyped.GetValue(), true
+	}
+	return 0, false
+}
+
+// group gives the group of the point, labels missing on the point have an empty value.
+func (r *compiledRule) group(point *metrics.RawMetric) *group {
+	values := make([]string, len(r.By))
+	for _, label := range point.Metric().GetLabel() {
+		for i, name := range r.By {
+			if label.GetName() == name {
+				values[i] = label.GetValue()
+			}
+		}
+	}
+	key := strings.Join(values, "\xff")
+	g, ok := r.groups[key]
+	if ok {
+		return g
+	}
+
+	labels := make([]*dto.LabelPair, 0, len(r.By))
+	for i, name := range r.By {
+		if values[i] == "" {
+			continue
+		}
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(values[i])})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].GetName() < labels[j].GetName()
+	})
+	g = &group{
+		labels:  labels,
+		members: make([]map[uint64]*member, len(r.Metrics)),
+	}
+	for i := range g.members {
+		g.members[i] = make(map[uint64]*member)
+	}
+	r.groups[key] = g
+	return g
+}
+
+func (g *group) update(metricIndex int, id uint64, value float64, at int64, now time.Time) {
+	m, ok := g.members[metricIndex][id]
+	if !ok {
+		g.members[metricIndex][id] = &member{value: value, at: at, updatedAt: now}
+		return
+	}
+	if at > m.at {
+		// a decrease is a counter reset, the increase is then the new value
+		increase := value - m.value
+		if increase < 0 {
+			increase = value
+		}
+		m.rate = increase / time.Duration(at-m.at).Seconds()
+		m.hasRate = true
+	}
+	m.value = value
+	m.at = at
+	m.updatedAt = now
+}
+
+// compute gives the value of the derived series of the group, false when it can't be computed yet.
+func (r *compiledRule) compute(g *group) (float64, bool) {
+	var result float64
+	switch r.Op {
+	case OpRatio:
+		numerator, denominator := sumValues(g.members[0]), sumValues(g.members[1])
+		if len(g.members[0]) == 0 || denominator == 0 {
+			return 0, false
+		}
+		result = numerator / denominator
+	case OpSum:
+		for _, members := range g.members {
+			result += sumValues(members)
+		}
+	case OpMax:
+		result = math.Inf(-1)
+		for _, members := range g.members {
+			for _, m := range members {
+				result = math.Max(result, m.value)
+			}
+		}
+	case OpRate:
+		hasRate := false
+		for _, members := range g.members {
+			for _, m := range members {
+				if m.hasRate {
+					result += m.rate
+					hasRate = true
+				}
+			}
+		}
+		if !hasRate {
+			return 0, false
+		}
+	}
+	return result * r.Scale, true
+}
+
+func sumValues(members map[uint64]*member) float64 {
+	var sum float64
+	for _, m := range members {
+		sum += m.value
+	}
+	return sum
+}
+
+func (r *compiledRule) newPoint(g *group, value float64) *metrics.RawMetric {
+	labels := make([]*dto.LabelPair, len(g.labels))
+	copy(labels, g.labels)
+	origin := ""
+	for _, label := range labels {
+		if label.GetName() == "origin" {
+			origin = label.GetValue()
+		}
+	}
+	point := metrics.NewRawMetric(r.Name, origin, &dto.Metric{
+		Label: labels,
+		Gauge: &dto.Gauge{Value: proto.Float64(value)},
+	})
+	point.SetHelp(r.Help)
+	return point
+}
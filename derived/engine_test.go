@@ -0,0 +1,115 @@
+package derived_test
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/firehose_exporter/metricmaker"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"github.com/cloudfoundry/firehose_exporter/transform"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/firehose_exporter/derived"
+)
+
+func gauge(name, instance string, value float64) *metrics.RawMetric {
+	return metricmaker.NewRawMetricGauge(name, map[string]string{
+		"origin":         "rep",
+		"application_id": "app-1",
+		"instance_id":    instance,
+	}, value)
+}
+
+func values(points []*metrics.RawMetric) []float64 {
+	result := make([]float64, len(points))
+	for i, point := range points {
+		result[i] = point.Metric().GetGauge().GetValue()
+	}
+	return result
+}
+
+var _ = ginkgo.Describe("Engine", func() {
+	var now time.Time
+	ginkgo.BeforeEach(func() {
+		metricmaker.SetMetricConverters(make([]metricmaker.MetricConverter, 0))
+		now = time.Now()
+	})
+
+	newEngine := func(rule *derived.Rule) *derived.Engine {
+		engine, err := derived.NewEngine(time.Minute, rule)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		return engine
+	}
+
+	ginkgo.It("should ignore metrics used by no rule", func() {
+		engine := newEngine(&derived.Rule{Name: "app_memory", Op: derived.OpSum, Metrics: []string{"memory"}})
+
+		gomega.Expect(engine.Observe(gauge("cpu", "0", 1), now)).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should compute ratio of series with matching labels once both are known", func() {
+		engine := newEngine(&derived.Rule{
+			Name:    "memory_utilization",
+			Help:    "memory used",
+			Op:      derived.OpRatio,
+			Metrics: []string{"memory", "memory_quota"},
+			By:      []string{"application_id", "instance_id"},
+			Scale:   100,
+		})
+
+		gomega.Expect(engine.Observe(gauge("memory", "0", 25), now)).To(gomega.BeEmpty())
+		gomega.Expect(engine.Observe(gauge("memory_quota", "1", 100), now)).To(gomega.BeEmpty())
+
+		points := engine.Observe(gauge("memory_quota", "0", 100), now)
+		gomega.Expect(points).To(gomega.HaveLen(1))
+		gomega.Expect(points[0].MetricName()).To(gomega.Equal("memory_utilization"))
+		gomega.Expect(points[0].Help()).To(gomega.Equal("memory used"))
+		gomega.Expect(points[0].Metric().GetGauge().GetValue()).To(gomega.Equal(25.0))
+		gomega.Expect(transform.LabelPairsToLabelsMap(points[0].Metric().GetLabel())).To(gomega.Equal(map[string]string{
+			"application_id": "app-1",
+			"instance_id":    "0",
+		}))
+
+		gomega.Expect(values(engine.Observe(gauge("memory", "0", 50), now))).To(gomega.Equal([]float64{50}))
+	})
+
+	ginkgo.It("should sum and max series grouped by labels", func() {
+		sumEngine := newEngine(&derived.Rule{Name: "app_memory", Op: derived.OpSum, Metrics: []string{"memory"}, By: []string{"application_id"}})
+		maxEngine := newEngine(&derived.Rule{Name: "app_memory_max", Op: derived.OpMax, Metrics: []string{"memory"}, By: []string{"application_id"}})
+
+		for _, point := range []*metrics.RawMetric{gauge("memory", "0", 10), gauge("memory", "1", 30)} {
+			sumEngine.Observe(point, now)
+			maxEngine.Observe(point, now)
+		}
+
+		gomega.Expect(values(sumEngine.Observe(gauge("memory", "0", 20), now))).To(gomega.Equal([]float64{50}))
+		gomega.Expect(values(maxEngine.Observe(gauge("memory", "0", 20), now))).To(gomega.Equal([]float64{30}))
+	})
+
+	ginkgo.It("should give per second increase of counters", func() {
+		engine := newEngine(&derived.Rule{Name: "requests_rate", Op: derived.OpRate, Metrics: []string{"requests"}, By: []string{"application_id"}})
+		counter := func(instance string, value float64, at time.Time) *metrics.RawMetric {
+			point := metricmaker.NewRawMetricCounter("requests", map[string]string{
+				"application_id": "app-1",
+				"instance_id":    instance,
+			}, value)
+			point.SetEnvelopeTimestamp(at.UnixNano())
+			return point
+		}
+
+		gomega.Expect(engine.Observe(counter("0", 100, now), now)).To(gomega.BeEmpty())
+		gomega.Expect(values(engine.Observe(counter("0", 120, now.Add(10*time.Second)), now))).To(gomega.Equal([]float64{2}))
+		engine.Observe(counter("1", 0, now), now)
+		// counter reset, increase is the new value
+		gomega.Expect(values(engine.Observe(counter("1", 10, now.Add(2*time.Second)), now))).To(gomega.Equal([]float64{7}))
+	})
+
+	ginkgo.It("should forget series which were not updated since expiration", func() {
+		engine := newEngine(&derived.Rule{Name: "app_memory", Op: derived.OpSum, Metrics: []string{"memory"}, By: []string{"application_id"}})
+
+		engine.Observe(gauge("memory", "0", 10), now)
+		engine.Observe(gauge("memory", "1", 30), now.Add(90*time.Second))
+
+		gomega.Expect(values(engine.Observe(gauge("memory", "2", 5), now.Add(2*time.Minute)))).To(gomega.Equal([]float64{35}))
+	})
+})
@@ -0,0 +1,73 @@
+package derived
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/prometheus/common/model"
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	// OpRatio divides the sum of the first metric by the sum of the second one.
+	OpRatio = "ratio"
+	// OpSum adds values of all series of the metrics.
+	OpSum = "sum"
+	// OpMax gives the greatest value of all series of the metrics.
+	OpMax = "max"
+	// OpRate adds the per second increase of each series of the metrics between their last two values.
+	OpRate = "rate"
+)
+
+// Rule computes a gauge from the last values of series of one or more metrics, grouped by labels.
+type Rule struct {
+	// Name of the derived metric, used as is.
+	Name string `yaml:"name"`
+	Help string `yaml:"help"`
+	Op   string `yaml:"op"`
+	// Metrics are final metric names of inputs, e.g. firehose_container_metric_memory_bytes.
+	Metrics []string `yaml:"metrics"`
+	// By gives labels which must match between input series, they are the only labels of derived series.
+	By []string `yaml:"by"`
+	// Scale multiplies results, e.g. 100 to get a percentage from a ratio, defaults to 1.
+	Scale float64 `yaml:"scale"`
+}
+
+func (r *Rule) compile() error {
+	if !model.LegacyValidation.IsValidMetricName(r.Name) {
+		return fmt.Errorf("invalid name '%s'", r.Name)
+	}
+	switch r.Op {
+	case OpRatio:
+		if len(r.Metrics) != 2 {
+			return fmt.Errorf("op %s needs exactly 2 metrics, numerator then denominator", r.Op)
+		}
+	case OpSum, OpMax, OpRate:
+		if len(r.Metrics) == 0 {
+			return fmt.Errorf("op %s needs at least 1 metric", r.Op)
+		}
+	default:
+		return fmt.Errorf("unknown op '%s'", r.Op)
+	}
+	for _, label := range r.By {
+		if !model.LegacyValidation.IsValidLabelName(label) {
+			return fmt.Errorf("invalid label name '%s' in by", label)
+		}
+	}
+	if r.Scale == 0 {
+		r.Scale = 1
+	}
+	return nil
+}
+
+func LoadRules(path string) ([]*Rule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]*Rule, 0)
+	if err := yaml.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("could not parse derived rules file %s: %w", path, err)
+	}
+	return rules, nil
+}
@@ -0,0 +1,107 @@
+package derived_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cloudfoundry/firehose_exporter/metricmaker"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"github.com/cloudfoundry/firehose_exporter/transform"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/firehose_exporter/derived"
+)
+
+var _ = ginkgo.Describe("LoadRules", func() {
+	ginkgo.It("should load example rules", func() {
+		rules, err := derived.LoadRules("rules.yml")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(rules).To(gomega.HaveLen(4))
+		gomega.Expect(rules[0].Op).To(gomega.Equal(derived.OpRatio))
+		gomega.Expect(rules[0].Scale).To(gomega.Equal(100.0))
+
+		_, err = derived.NewEngine(time.Minute, rules...)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should group example rules by labels of points made from envelopes", func() {
+		metricmaker.SetMetricConverters([]metricmaker.MetricConverter{
+			metricmaker.RetroCompatMetricNames,
+			metricmaker.InjectMapLabel(map[string]string{"environment": "test"}),
+			metricmaker.AddNamespace("firehose"),
+			metricmaker.NormalizeName,
+			metricmaker.OrderAndSanitizeLabels,
+			metricmaker.PresetLabels,
+		})
+		defer metricmaker.SetMetricConverters([]metricmaker.MetricConverter{
+			metricmaker.NormalizeName,
+			metricmaker.OrderAndSanitizeLabels,
+			metricmaker.PresetLabels,
+		})
+		rules, err := derived.LoadRules("rules.yml")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		engine, err := derived.NewEngine(time.Minute, rules...)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		containerMetrics := func(instanceID string, memory float64) []*metrics.RawMetric {
+			return metricmaker.NewRawMetricsFromEnvelop(&loggregator_v2.Envelope{
+				SourceId:   "app-1",
+				InstanceId: instanceID,
+				Tags: map[string]string{
+					"origin":     "rep",
+					"deployment": "cf",
+					"app_id":     "app-1",
+				},
+				Message: &loggregator_v2.Envelope_Gauge{
+					Gauge: &loggregator_v2.Gauge{Metrics: map[string]*loggregator_v2.GaugeValue{
+						"memory":       {Unit: "bytes", Value: memory},
+						"memory_quota": {Unit: "bytes", Value: 100},
+					}},
+				},
+			})
+		}
+
+		utilizations := make(map[string]float64)
+		for _, point := range append(containerMetrics("0", 25), containerMetrics("1", 50)...) {
+			for _, derivedPoint := range engine.Observe(point, time.Now()) {
+				if derivedPoint.MetricName() != "firehose_container_metric_memory_utilization_percentage" {
+					continue
+				}
+				labels := transform.LabelPairsToLabelsMap(derivedPoint.Metric().GetLabel())
+				gomega.Expect(labels).To(gomega.HaveKeyWithValue("application_id", "app-1"))
+				utilizations[labels["instance_id"]] = derivedPoint.Metric().GetGauge().GetValue()
+			}
+		}
+		gomega.Expect(utilizations).To(gomega.Equal(map[string]float64{"0": 25, "1": 50}))
+	})
+
+	ginkgo.It("should fail on a file which is not yaml", func() {
+		dir, err := os.MkdirTemp("", "derived")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "rules.yml")
+		gomega.Expect(os.WriteFile(path, []byte("name: [a"), 0o600)).To(gomega.Succeed())
+
+		_, err = derived.LoadRules(path)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})
+
+var _ = ginkgo.Describe("NewEngine", func() {
+	invalidRules := map[string]*derived.Rule{
+		"invalid name":        {Name: "my-metric", Op: derived.OpSum, Metrics: []string{"a"}},
+		"unknown op":          {Name: "my_metric", Op: "avg", Metrics: []string{"a"}},
+		"ratio of one metric": {Name: "my_metric", Op: derived.OpRatio, Metrics: []string{"a"}},
+		"sum of no metric":    {Name: "my_metric", Op: derived.OpSum},
+		"invalid by label":    {Name: "my_metric", Op: derived.OpMax, Metrics: []string{"a"}, By: []string{"app-id"}},
+	}
+	for description, rule := range invalidRules {
+		ginkgo.It("should refuse rule with "+description, func() {
+			_, err := derived.NewEngine(time.Minute, rule)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+	}
+})
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/tls"
 	"expvar"
+	"fmt"
 	"net/http"
 	"net/http/pprof"
 	"strings"
@@ -10,14 +12,24 @@ import (
 	"code.cloudfoundry.org/go-loggregator/v8"
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/cloudfoundry/firehose_exporter/collectors"
+	"github.com/cloudfoundry/firehose_exporter/connection"
+	"github.com/cloudfoundry/firehose_exporter/derived"
+	"github.com/cloudfoundry/firehose_exporter/ha"
+	"github.com/cloudfoundry/firehose_exporter/metadata"
 	"github.com/cloudfoundry/firehose_exporter/metricmaker"
 	"github.com/cloudfoundry/firehose_exporter/metrics"
 	"github.com/cloudfoundry/firehose_exporter/nozzle"
+	"github.com/cloudfoundry/firehose_exporter/nozzle/rollup"
+	"github.com/cloudfoundry/firehose_exporter/rlpgateway"
+	"github.com/cloudfoundry/firehose_exporter/sharding"
 	"github.com/prometheus/common/version"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 )
 
 var (
+	_ = kingpin.Command("serve", "Expose metrics from Cloud Foundry envelopes, default command").Default()
+
 	retroCompatDisable = kingpin.Flag("retro_compat.disable", "Disable retro compatibility").Envar("FIREHOSE_EXPORTER_RETRO_COMPAT_DISABLE").Default("false").Bool()
 
 	enableRetroCompatDelta = kingpin.Flag("retro_compat.enable_delta", "Enable retro compatibility delta in counter").Envar("FIREHOSE_EXPORTER_RETRO_COMPAT_ENABLE_DELTA").Default("false").Bool()
@@ -38,6 +50,26 @@ var (
 		"logging.tls.key", "Path to key to connect to rlp in mtls",
 	).Envar("FIREHOSE_EXPORTER_LOGGING_TLS_KEY").Default("").String()
 
+	loggingMode = kingpin.Flag(
+		"logging.mode", "How to read envelopes: rlp (gRPC with mtls, logging.url is the rlp address) or gateway (HTTP with a UAA token, logging.url is the log stream url) ($FIREHOSE_EXPORTER_LOGGING_MODE)",
+	).Envar("FIREHOSE_EXPORTER_LOGGING_MODE").Default("rlp").Enum("rlp", "gateway")
+
+	loggingStreams = kingpin.Flag(
+		"logging.streams", "Number of streams read concurrently in the shard group, each one with its own connection to the logs provider ($FIREHOSE_EXPORTER_LOGGING_STREAMS)",
+	).Envar("FIREHOSE_EXPORTER_LOGGING_STREAMS").Default("1").Int()
+
+	uaaURL = kingpin.Flag(
+		"uaa.url", "Cloud Foundry UAA url to get tokens from in gateway logging mode ($FIREHOSE_EXPORTER_UAA_URL)",
+	).Envar("FIREHOSE_EXPORTER_UAA_URL").Default("").String()
+
+	uaaClientID = kingpin.Flag(
+		"uaa.client_id", "UAA client id having the doppler.firehose or logs.admin authority ($FIREHOSE_EXPORTER_UAA_CLIENT_ID)",
+	).Envar("FIREHOSE_EXPORTER_UAA_CLIENT_ID").Default("").String()
+
+	uaaClientSecret = kingpin.Flag(
+		"uaa.client_secret", "UAA client secret ($FIREHOSE_EXPORTER_UAA_CLIENT_SECRET)",
+	).Envar("FIREHOSE_EXPORTER_UAA_CLIENT_SECRET").Default("").String()
+
 	metricsNamespace = kingpin.Flag(
 		"metrics.namespace", "Metrics Namespace ($FIREHOSE_EXPORTER_METRICS_NAMESPACE)",
 	).Envar("FIREHOSE_EXPORTER_METRICS_NAMESPACE").Default("firehose").String()
@@ -54,6 +86,38 @@ var (
 		"metrics.node_index", "Node index to use ($FIREHOSE_EXPORTER_NODE_INDEX)",
 	).Envar("FIREHOSE_EXPORTER_NODE_INDEX").Default("0").Int()
 
+	peersAddresses = kingpin.Flag(
+		"peers.addresses", "Comma separated base urls of all exporter instances of the shard group, in the same order on every instance, this instance being at metrics.node_index. When set, each series is only exposed by the instance owning it and web.auth.username and web.auth.password are required ($FIREHOSE_EXPORTER_PEERS_ADDRESSES)",
+	).Envar("FIREHOSE_EXPORTER_PEERS_ADDRESSES").Default("").String()
+
+	haReplica = kingpin.Flag(
+		"ha.replica", "Name of this replica in its HA group, added as replica label on every metric, HA mode is disabled when empty ($FIREHOSE_EXPORTER_HA_REPLICA)",
+	).Envar("FIREHOSE_EXPORTER_HA_REPLICA").Default("").String()
+
+	haElection = kingpin.Flag(
+		"ha.election", "Leader election mechanism between replicas: none (every replica is leader), lease or gossip ($FIREHOSE_EXPORTER_HA_ELECTION)",
+	).Envar("FIREHOSE_EXPORTER_HA_ELECTION").Default("none").Enum("none", "lease", "gossip")
+
+	haLeaseFile = kingpin.Flag(
+		"ha.lease_file", "Path of the lease file shared by replicas for lease election ($FIREHOSE_EXPORTER_HA_LEASE_FILE)",
+	).Envar("FIREHOSE_EXPORTER_HA_LEASE_FILE").Default("").String()
+
+	haLeaseDuration = kingpin.Flag(
+		"ha.lease_duration", "How long a lease is held without being renewed, it is renewed every third of it ($FIREHOSE_EXPORTER_HA_LEASE_DURATION)",
+	).Envar("FIREHOSE_EXPORTER_HA_LEASE_DURATION").Default("15s").Duration()
+
+	haPeers = kingpin.Flag(
+		"ha.peers", "Comma separated base urls of the other replicas for gossip election, replicas which can't reach each other may both be leaders ($FIREHOSE_EXPORTER_HA_PEERS)",
+	).Envar("FIREHOSE_EXPORTER_HA_PEERS").Default("").String()
+
+	haGossipInterval = kingpin.Flag(
+		"ha.gossip_interval", "Interval between status requests to other replicas for gossip election ($FIREHOSE_EXPORTER_HA_GOSSIP_INTERVAL)",
+	).Envar("FIREHOSE_EXPORTER_HA_GOSSIP_INTERVAL").Default("5s").Duration()
+
+	haPassiveEmptyMetrics = kingpin.Flag(
+		"ha.passive_empty_metrics", "Only render internal metrics on metrics path while this replica is passive ($FIREHOSE_EXPORTER_HA_PASSIVE_EMPTY_METRICS)",
+	).Envar("FIREHOSE_EXPORTER_HA_PASSIVE_EMPTY_METRICS").Default("false").Bool()
+
 	metricsTimerRollup = kingpin.Flag(
 		"metrics.timer_rollup_buffer_size", "The number of envelopes that will be allowed to be buffered while timer metric aggregations are running ($FIREHOSE_EXPORTER_TIMER_ROLLUP_BUFFER_SIZE)",
 	).Envar("FIREHOSE_EXPORTER_TIMER_ROLLUP_BUFFER_SIZE").Default("16384").Uint()
@@ -66,6 +130,38 @@ var (
 		"metrics.expiration", "How long a Cloud Foundry metric is valid ($FIREHOSE_EXPORTER_METRICS_EXPIRATION)",
 	).Envar("FIREHOSE_EXPORTER_METRICS_EXPIRATION").Default("10m").Duration()
 
+	metricExpirationRules = kingpin.Flag(
+		"metrics.expiration_rules", "Path to a yaml file of expiration rules by metric name regex, origin or metric type, metrics matching no rule use metrics.expiration ($FIREHOSE_EXPORTER_METRICS_EXPIRATION_RULES)",
+	).Envar("FIREHOSE_EXPORTER_METRICS_EXPIRATION_RULES").Default("").String()
+
+	metricsDerivedRules = kingpin.Flag(
+		"metrics.derived_rules", "Path to a yaml file of rules computing derived metrics (ratio, sum, max or rate by labels) from stored series ($FIREHOSE_EXPORTER_METRICS_DERIVED_RULES)",
+	).Envar("FIREHOSE_EXPORTER_METRICS_DERIVED_RULES").Default("").String()
+
+	metricsMetadataCatalog = kingpin.Flag(
+		"metrics.metadata_catalog", "Path to a yaml file of help, unit and type of metrics by name in envelopes, values of metrics having a unit are converted to its base unit which suffixes their name ($FIREHOSE_EXPORTER_METRICS_METADATA_CATALOG)",
+	).Envar("FIREHOSE_EXPORTER_METRICS_METADATA_CATALOG").Default("").String()
+
+	metricsNormalizeUnits = kingpin.Flag(
+		"metrics.normalize_units", "Rescale values of gauges to the base unit of their envelope unit (e.g. ms to seconds, MiB to bytes, % to ratio), suffix their name with it and drop their unit label, container metrics are left as is ($FIREHOSE_EXPORTER_METRICS_NORMALIZE_UNITS)",
+	).Envar("FIREHOSE_EXPORTER_METRICS_NORMALIZE_UNITS").Default("false").Bool()
+
+	metricsExemplarLabels = kingpin.Flag(
+		"metrics.exemplar_labels", "Comma separated tags of gorouter timers (e.g. request_id) labelling exemplars of request counters and duration histograms, only exposed in OpenMetrics format ($FIREHOSE_EXPORTER_METRICS_EXEMPLAR_LABELS)",
+	).Envar("FIREHOSE_EXPORTER_METRICS_EXEMPLAR_LABELS").Default("").String()
+
+	metricsTraceTags = kingpin.Flag(
+		"metrics.trace_tags", "Comma separated trace context tags of gorouter timers (e.g. trace_id,span_id) labelling exemplars of duration histograms, they are kept out of rollup series ($FIREHOSE_EXPORTER_METRICS_TRACE_TAGS)",
+	).Envar("FIREHOSE_EXPORTER_METRICS_TRACE_TAGS").Default("").String()
+
+	metricsExemplarPolicy = kingpin.Flag(
+		"metrics.exemplar_policy", "Timer kept as exemplar by each bucket of duration histograms between rollups: slowest or latest ($FIREHOSE_EXPORTER_METRICS_EXEMPLAR_POLICY)",
+	).Envar("FIREHOSE_EXPORTER_METRICS_EXEMPLAR_POLICY").Default("slowest").Enum("slowest", "latest")
+
+	metricsExposeEnvelopeTimestamp = kingpin.Flag(
+		"metrics.expose_envelope_timestamp", "Expose metrics from envelopes with the timestamp of their envelope instead of letting Prometheus stamp them at scrape time ($FIREHOSE_EXPORTER_METRICS_EXPOSE_ENVELOPE_TIMESTAMP)",
+	).Envar("FIREHOSE_EXPORTER_METRICS_EXPOSE_ENVELOPE_TIMESTAMP").Default("false").Bool()
+
 	skipSSLValidation = kingpin.Flag(
 		"skip-ssl-verify", "Disable SSL Verify ($FIREHOSE_EXPORTER_SKIP_SSL_VERIFY)",
 	).Envar("FIREHOSE_EXPORTER_SKIP_SSL_VERIFY").Default("false").Bool()
@@ -78,6 +174,46 @@ var (
 		"filter.events", "Comma separated events to filter (ContainerMetric,CounterEvent,ValueMetric,Http) ($FIREHOSE_EXPORTER_FILTER_EVENTS)",
 	).Envar("FIREHOSE_EXPORTER_FILTER_EVENTS").Default("").String()
 
+	filterGaugeSourceIDs = kingpin.Flag(
+		"filter.source_ids.gauge", "Comma separated source ids to only receive gauges (ContainerMetric and ValueMetric) from ($FIREHOSE_EXPORTER_FILTER_SOURCE_IDS_GAUGE)",
+	).Envar("FIREHOSE_EXPORTER_FILTER_SOURCE_IDS_GAUGE").Default("").String()
+
+	filterCounterSourceIDs = kingpin.Flag(
+		"filter.source_ids.counter", "Comma separated source ids to only receive counters (CounterEvent) from ($FIREHOSE_EXPORTER_FILTER_SOURCE_IDS_COUNTER)",
+	).Envar("FIREHOSE_EXPORTER_FILTER_SOURCE_IDS_COUNTER").Default("").String()
+
+	filterTimerSourceIDs = kingpin.Flag(
+		"filter.source_ids.timer", "Comma separated source ids to only receive timers (HttpStartStop) from ($FIREHOSE_EXPORTER_FILTER_SOURCE_IDS_TIMER)",
+	).Envar("FIREHOSE_EXPORTER_FILTER_SOURCE_IDS_TIMER").Default("").String()
+
+	priorityLanesFile = kingpin.Flag(
+		"ingestion.priority_lanes", "Path to a yaml file of priority lanes matching envelopes by origin or deployment, each lane has its own ingress buffer and lanes are drained in order ($FIREHOSE_EXPORTER_INGESTION_PRIORITY_LANES)",
+	).Envar("FIREHOSE_EXPORTER_INGESTION_PRIORITY_LANES").Default("").String()
+
+	conversionWorkers = kingpin.Flag(
+		"ingestion.conversion_workers", "Number of goroutines converting envelopes to metrics, envelopes of a source id are always converted by the same one ($FIREHOSE_EXPORTER_INGESTION_CONVERSION_WORKERS)",
+	).Envar("FIREHOSE_EXPORTER_INGESTION_CONVERSION_WORKERS").Default("1").Int()
+
+	limitsSourceRate = kingpin.Flag(
+		"limits.source_rate", "Number of envelopes per second allowed for each source id, 0 disables rate limiting ($FIREHOSE_EXPORTER_LIMITS_SOURCE_RATE)",
+	).Envar("FIREHOSE_EXPORTER_LIMITS_SOURCE_RATE").Default("0").Float64()
+
+	limitsSourceBurst = kingpin.Flag(
+		"limits.source_burst", "Number of envelopes allowed at once above rate for each source id ($FIREHOSE_EXPORTER_LIMITS_SOURCE_BURST)",
+	).Envar("FIREHOSE_EXPORTER_LIMITS_SOURCE_BURST").Default("1000").Int()
+
+	limitsSampleRatio = kingpin.Flag(
+		"limits.sample_ratio", "Ratio of envelopes kept for each source id before rate limiting, above 0 and up to 1 ($FIREHOSE_EXPORTER_LIMITS_SAMPLE_RATIO)",
+	).Envar("FIREHOSE_EXPORTER_LIMITS_SAMPLE_RATIO").Default("1").Float64()
+
+	limitsSourceFile = kingpin.Flag(
+		"limits.source_file", "Path to a yaml file of rate, burst and sample ratio by source id overriding defaults ($FIREHOSE_EXPORTER_LIMITS_SOURCE_FILE)",
+	).Envar("FIREHOSE_EXPORTER_LIMITS_SOURCE_FILE").Default("").String()
+
+	limitsMaxSourceLabels = kingpin.Flag(
+		"limits.max_source_labels", "Number of source ids getting their own label on limited envelopes counter, the most limited ones since the last minute, further ones are counted as other ($FIREHOSE_EXPORTER_LIMITS_MAX_SOURCE_LABELS)",
+	).Envar("FIREHOSE_EXPORTER_LIMITS_MAX_SOURCE_LABELS").Default("50").Int()
+
 	listenAddress = kingpin.Flag(
 		"web.listen-address", "Address to listen on for web interface and telemetry ($FIREHOSE_EXPORTER_WEB_LISTEN_ADDRESS)",
 	).Envar("FIREHOSE_EXPORTER_WEB_LISTEN_ADDRESS").Default(":9186").String()
@@ -86,6 +222,18 @@ var (
 		"web.telemetry-path", "Path under which to expose Prometheus metrics ($FIREHOSE_EXPORTER_WEB_TELEMETRY_PATH)",
 	).Envar("FIREHOSE_EXPORTER_WEB_TELEMETRY_PATH").Default("/metrics").String()
 
+	internalMetricsPath = kingpin.Flag(
+		"web.internal-telemetry-path", "Path under which to expose only exporter internal metrics ($FIREHOSE_EXPORTER_WEB_INTERNAL_TELEMETRY_PATH)",
+	).Envar("FIREHOSE_EXPORTER_WEB_INTERNAL_TELEMETRY_PATH").Default("/internal/metrics").String()
+
+	renderShareWindow = kingpin.Flag(
+		"web.render-share-window", "How long a render of metrics is reused by following scrapes even if metrics changed meanwhile, 0 only shares renders between concurrent scrapes and reuses renders of unchanged metrics ($FIREHOSE_EXPORTER_WEB_RENDER_SHARE_WINDOW)",
+	).Envar("FIREHOSE_EXPORTER_WEB_RENDER_SHARE_WINDOW").Default("0").Duration()
+
+	webOpenMetrics = kingpin.Flag(
+		"web.openmetrics", "Serve metrics in OpenMetrics format to scrapers accepting it, which exposes units of metrics ($FIREHOSE_EXPORTER_WEB_OPENMETRICS)",
+	).Envar("FIREHOSE_EXPORTER_WEB_OPENMETRICS").Default("false").Bool()
+
 	authUsername = kingpin.Flag(
 		"web.auth.username", "Username for web interface basic auth ($FIREHOSE_EXPORTER_WEB_AUTH_USERNAME)",
 	).Envar("FIREHOSE_EXPORTER_WEB_AUTH_USERNAME").String()
@@ -137,20 +285,36 @@ func initLog() {
 	}
 }
 
-func initMetricMaker() {
+func initMetricMaker(catalog *metadata.Catalog) {
 	metricmaker.SetEnableEnvelopCounterDelta(*enableRetroCompatDelta)
+	metricmaker.SetExposeEnvelopTimestamp(*metricsExposeEnvelopeTimestamp)
 	metricmaker.PrependMetricConverter(metricmaker.AddNamespace(*metricsNamespace))
 	metricmaker.PrependMetricConverter(metricmaker.InjectMapLabel(map[string]string{
 		"environment": *metricsEnvironment,
 	}))
+	if *haReplica != "" {
+		metricmaker.PrependMetricConverter(metricmaker.InjectMapLabel(map[string]string{
+			"replica": *haReplica,
+		}))
+	}
 	if !*retroCompatDisable {
 		metricmaker.PrependMetricConverter(metricmaker.RetroCompatMetricNames)
 	} else {
 		metricmaker.PrependMetricConverter(metricmaker.SuffixCounterWithTotal)
 	}
+	if *metricsNormalizeUnits {
+		metricmaker.PrependMetricConverter(metricmaker.NormalizeUnit)
+	}
+	if catalog != nil {
+		metricmaker.PrependMetricConverter(catalog.Describe)
+	}
 }
 
-func MakeStreamer() (*loggregator.EnvelopeStreamConnector, error) {
+func MakeStreamer(im *metrics.InternalMetrics, tracker *connection.Tracker) (nozzle.StreamConnector, error) {
+	if *loggingMode == "gateway" {
+		return MakeGatewayStreamer(tracker)
+	}
+
 	loggregatorTLSConfig, err := loggregator.NewEgressTLSConfig(*loggingTLSCa, *loggingTLSCert, *loggingTLSKey)
 	if err != nil {
 		return nil, err
@@ -161,19 +325,216 @@ func MakeStreamer() (*loggregator.EnvelopeStreamConnector, error) {
 		*loggingURL,
 		loggregatorTLSConfig,
 		loggregator.WithEnvelopeStreamLogger(log.StandardLogger()),
+		loggregator.WithEnvelopeStreamConnectorDialOptions(grpc.WithStreamInterceptor(tracker.StreamClientInterceptor())),
 		loggregator.WithEnvelopeStreamBuffer(10000, func(missed int) {
+			im.TotalDropped.WithLabelValues(metrics.DropStageStream, metrics.DropReasonBufferFull).Add(float64(missed))
 			log.Infof("dropped %d envelope batches", missed)
 		}),
 	), nil
 }
 
+func MakeGatewayStreamer(tracker *connection.Tracker) (nozzle.StreamConnector, error) {
+	if *uaaURL == "" || *uaaClientID == "" {
+		return nil, fmt.Errorf("uaa.url and uaa.client_id are required for gateway logging mode")
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: *skipSSLValidation},
+	}
+	uaa := rlpgateway.NewUAAClient(
+		*uaaURL, *uaaClientID, *uaaClientSecret,
+		rlpgateway.WithUAAHTTPClient(&http.Client{Timeout: 30 * time.Second, Transport: transport}),
+	)
+	return rlpgateway.NewStreamConnector(
+		*loggingURL,
+		uaa,
+		rlpgateway.WithHTTPClient(&http.Client{Transport: transport}),
+		rlpgateway.WithTracker(tracker),
+	), nil
+}
+
+// MakeFilterSelector gives the selector of filter flags, types without their own source ids are scoped to defaultSourceIDs.
+func MakeFilterSelector(defaultSourceIDs []string) *nozzle.FilterSelector {
+	filterSelector := nozzle.NewFilterSelector(commaSeparated(*filterEvents)...)
+	filterSelector.GaugeSourceIDs(sourceIDsOrDefault(*filterGaugeSourceIDs, defaultSourceIDs)...)
+	filterSelector.CounterSourceIDs(sourceIDsOrDefault(*filterCounterSourceIDs, defaultSourceIDs)...)
+	filterSelector.TimerSourceIDs(sourceIDsOrDefault(*filterTimerSourceIDs, defaultSourceIDs)...)
+	return filterSelector
+}
+
+func sourceIDsOrDefault(sourceIDs string, defaultSourceIDs []string) []string {
+	if ids := commaSeparated(sourceIDs); len(ids) > 0 {
+		return ids
+	}
+	return defaultSourceIDs
+}
+
+func MakeFilterDeployment() *nozzle.FilterDeployment {
+	return nozzle.NewFilterDeployment(commaSeparated(*filterDeployments)...)
+}
+
+// commaSeparated splits a flag value, elements are trimmed and empty ones are dropped.
+func commaSeparated(value string) []string {
+	var elements []string
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+func MakePriorityLanes() ([]nozzle.PriorityLane, error) {
+	if *priorityLanesFile == "" {
+		return nil, nil
+	}
+	return nozzle.LoadPriorityLanes(*priorityLanesFile)
+}
+
+func MakeExpirationPolicy() (*collectors.ExpirationPolicy, error) {
+	if *metricExpirationRules == "" {
+		return nil, nil
+	}
+	rules, err := collectors.LoadExpirationRules(*metricExpirationRules)
+	if err != nil {
+		return nil, err
+	}
+	return collectors.NewExpirationPolicy(*metricExpiration, rules...)
+}
+
+func MakeMetadataCatalog() (*metadata.Catalog, error) {
+	if *metricsMetadataCatalog == "" {
+		return nil, nil
+	}
+	entries, err := metadata.LoadCatalog(*metricsMetadataCatalog)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.NewCatalog(entries...)
+}
+
+func MakeDerivedEngine() (*derived.Engine, error) {
+	if *metricsDerivedRules == "" {
+		return nil, nil
+	}
+	rules, err := derived.LoadRules(*metricsDerivedRules)
+	if err != nil {
+		return nil, err
+	}
+	return derived.NewEngine(*metricExpiration, rules...)
+}
+
+func MakeElector(im *metrics.InternalMetrics) (ha.Elector, error) {
+	if *haReplica == "" && *haElection != "none" {
+		return nil, fmt.Errorf("ha.replica is required for %s election", *haElection)
+	}
+	opts := []ha.ElectorOption{
+		ha.WithOnLeaderChange(func(leader bool) {
+			log.WithField("replica", *haReplica).Infof("Replica leadership changed, leader: %t", leader)
+			if leader {
+				im.Leader.Set(1)
+			} else {
+				im.Leader.Set(0)
+			}
+		}),
+	}
+	switch *haElection {
+	case "lease":
+		if *haLeaseFile == "" {
+			return nil, fmt.Errorf("ha.lease_file is required for lease election")
+		}
+		return ha.NewLeaseElector(*haLeaseFile, *haReplica, *haLeaseDuration, opts...), nil
+	case "gossip":
+		if *haPeers == "" {
+			return nil, fmt.Errorf("ha.peers is required for gossip election")
+		}
+		opts = append(opts,
+			ha.WithHTTPClient(&http.Client{
+				Timeout: *haGossipInterval,
+				Transport: &http.Transport{
+					Proxy:           http.ProxyFromEnvironment,
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: *skipSSLValidation},
+				},
+			}),
+			ha.WithBasicAuth(*authUsername, *authPassword),
+		)
+		return ha.NewGossipElector(*haReplica, strings.Split(*haPeers, ","), *haGossipInterval, opts...), nil
+	default:
+		return ha.NewStaticElector(true, opts...), nil
+	}
+}
+
+func MakeSourceLimiter(im *metrics.InternalMetrics) (*nozzle.SourceLimiter, error) {
+	if *limitsSourceRate == 0 && *limitsSampleRatio == 1 && *limitsSourceFile == "" {
+		return nil, nil
+	}
+	if *limitsSampleRatio == 0 {
+		return nil, fmt.Errorf("limits.sample_ratio must be above 0, use filters to drop all envelopes")
+	}
+	limits := make([]nozzle.SourceLimit, 0)
+	if *limitsSourceFile != "" {
+		var err error
+		limits, err = nozzle.LoadSourceLimits(*limitsSourceFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nozzle.NewSourceLimiter(
+		nozzle.SourceLimit{
+			Rate:        *limitsSourceRate,
+			Burst:       *limitsSourceBurst,
+			SampleRatio: *limitsSampleRatio,
+		},
+		im,
+		nozzle.WithSourceLimits(limits...),
+		nozzle.WithMaxSourceLabels(*limitsMaxSourceLabels),
+	)
+}
+
+func MakePeerRouter(im *metrics.InternalMetrics) (*sharding.Router, error) {
+	if *peersAddresses == "" {
+		return nil, nil
+	}
+	// batches of peers are injected as is, anyone reaching the peer path could forge series
+	if *authUsername == "" || *authPassword == "" {
+		return nil, fmt.Errorf("peers.addresses requires web.auth.username and web.auth.password")
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: *skipSSLValidation},
+		},
+	}
+	return sharding.NewRouter(
+		strings.Split(*peersAddresses, ","),
+		*metricsNodeIndex,
+		im,
+		sharding.WithRouterHTTPClient(client),
+		sharding.WithRouterBasicAuth(*authUsername, *authPassword),
+	)
+}
+
 func main() {
 	kingpin.Version(version.Print("firehose_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	initLog()
-	initMetricMaker()
+	catalog, err := MakeMetadataCatalog()
+	if err != nil && command != checkCmd.FullCommand() {
+		log.Panicf("Invalid metadata catalog: %s", err.Error())
+	}
+	initMetricMaker(catalog)
+
+	switch command {
+	case tapCmd.FullCommand():
+		runTap()
+		return
+	case checkCmd.FullCommand():
+		runCheck()
+		return
+	}
 
 	log.Info("Starting firehose_exporter", version.Info())
 	log.Info("Build context", version.BuildContext())
@@ -185,28 +546,18 @@ func main() {
 		pointBuffer = make(chan []*metrics.RawMetric, *metricsBatchSize)
 	}
 
-	streamer, err := MakeStreamer()
+	im := metrics.NewInternalMetrics(*metricsNamespace, *metricsEnvironment)
+	tracker := connection.NewTracker(*loggingURL, im)
+	streamer, err := MakeStreamer(im, tracker)
 	if err != nil {
 		log.Panicf("Could not create streamer: %s", err.Error())
 	}
 
-	var events []string
-	if *filterEvents != "" {
-		events = strings.Split(*filterEvents, ",")
-	}
-
-	var deployments []string
-	if *filterDeployments != "" {
-		deployments = strings.Split(*filterDeployments, ",")
+	peerRouter, err := MakePeerRouter(im)
+	if err != nil {
+		log.Panicf("Could not create peer router: %s", err.Error())
 	}
-
-	im := metrics.NewInternalMetrics(*metricsNamespace, *metricsEnvironment)
-	nozz := nozzle.NewNozzle(
-		streamer,
-		*metricsShardID,
-		*metricsNodeIndex,
-		pointBuffer,
-		im,
+	nozzleOpts := []nozzle.Option{
 		nozzle.WithNozzleTimerRollup(
 			10*time.Second,
 			[]string{
@@ -223,15 +574,82 @@ func main() {
 			},
 		),
 		nozzle.WithNozzleTimerRollupBufferSize(*metricsTimerRollup),
-		nozzle.WithFilterSelector(nozzle.NewFilterSelector(events...)),
-		nozzle.WithFilterDeployment(nozzle.NewFilterDeployment(deployments...)),
+		nozzle.WithTimerExemplarLabels(commaSeparated(*metricsExemplarLabels)...),
+		nozzle.WithTimerTraceTags(commaSeparated(*metricsTraceTags)...),
+		nozzle.WithTimerExemplarPolicy(rollup.ExemplarPolicy(*metricsExemplarPolicy)),
+		nozzle.WithFilterSelector(MakeFilterSelector(nil)),
+		nozzle.WithFilterDeployment(MakeFilterDeployment()),
+		nozzle.WithStreams(*loggingStreams),
+		nozzle.WithConversionWorkers(*conversionWorkers),
+		nozzle.WithCounterExpiration(*metricExpiration),
+	}
+	if peerRouter != nil {
+		nozzleOpts = append(nozzleOpts, nozzle.WithPeerRouter(peerRouter))
+	}
+	priorityLanes, err := MakePriorityLanes()
+	if err != nil {
+		log.Panicf("Could not load priority lanes: %s", err.Error())
+	}
+	if len(priorityLanes) > 0 {
+		nozzleOpts = append(nozzleOpts, nozzle.WithPriorityLanes(priorityLanes...))
+	}
+	sourceLimiter, err := MakeSourceLimiter(im)
+	if err != nil {
+		log.Panicf("Could not create source limiter: %s", err.Error())
+	}
+	if sourceLimiter != nil {
+		nozzleOpts = append(nozzleOpts, nozzle.WithSourceLimiter(sourceLimiter))
+	}
+	nozz := nozzle.NewNozzle(
+		streamer,
+		*metricsShardID,
+		*metricsNodeIndex,
+		pointBuffer,
+		im,
+		nozzleOpts...,
 	)
-	collector := collectors.NewRawMetricsCollector(pointBuffer, *metricExpiration)
+	collector := collectors.NewRawMetricsCollector(pointBuffer, *metricExpiration, im)
+	collector.SetRenderShareWindow(*renderShareWindow)
+	collector.SetOpenMetrics(*webOpenMetrics)
+	elector, err := MakeElector(im)
+	if err != nil {
+		log.Panicf("Could not create leader elector: %s", err.Error())
+	}
+	if *haPassiveEmptyMetrics {
+		collector.SetExposeSeries(elector.IsLeader)
+	}
+	expirationPolicy, err := MakeExpirationPolicy()
+	if err != nil {
+		log.Panicf("Invalid expiration rules: %s", err.Error())
+	}
+	if expirationPolicy != nil {
+		collector.SetExpirationPolicy(expirationPolicy)
+	}
+	derivedEngine, err := MakeDerivedEngine()
+	if err != nil {
+		log.Panicf("Invalid derived rules: %s", err.Error())
+	}
+	if derivedEngine != nil {
+		collector.SetDerivedEngine(derivedEngine)
+		if peerRouter != nil {
+			log.Warning("Derived rules only see series owned by this instance, derived series of peers are partial")
+		}
+	}
 	nozz.Start()
 	collector.Start()
+	elector.Start()
 
 	router := http.NewServeMux()
-	router.Handle(*metricsPath, prometheusHandler(collector))
+	router.Handle(*metricsPath, prometheusHandler(collector.RenderExpFmt))
+	router.Handle(*internalMetricsPath, prometheusHandler(collector.RenderInternalExpFmt))
+	router.Handle(connection.StatusPath, prometheusHandler(connection.NewStatusHandler(tracker).ServeHTTP))
+	if *haReplica != "" {
+		router.Handle(ha.StatusPath, prometheusHandler(ha.NewStatusHandler(*haReplica, elector).ServeHTTP))
+	}
+	if peerRouter != nil {
+		peerRouter.Start()
+		router.Handle(sharding.PeerPath, prometheusHandler(sharding.NewPeerHandler(nozz, im).ServeHTTP))
+	}
 
 	if *enableProfiler {
 		router.HandleFunc("/debug/pprof/", pprof.Index)
@@ -247,6 +665,8 @@ func main() {
 				             <body>
 				             <h1>Cloud Foundry Firehose Exporter</h1>
 				             <p><a href='` + *metricsPath + `'>Metrics</a></p>
+				             <p><a href='` + *internalMetricsPath + `'>Internal Metrics</a></p>
+				             <p><a href='` + connection.StatusPath + `'>Stream Status</a></p>
 				             </body>
 				             </html>`))
 	})
@@ -269,8 +689,8 @@ func main() {
 	log.Fatal(err)
 }
 
-func prometheusHandler(collector *collectors.RawMetricsCollector) http.Handler {
-	var handler http.Handler = http.HandlerFunc(collector.RenderExpFmt)
+func prometheusHandler(render http.HandlerFunc) http.Handler {
+	var handler http.Handler = render
 
 	if *authUsername != "" && *authPassword != "" {
 		handler = &basicAuthHandler{
@@ -0,0 +1,89 @@
+package ha
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Elector tells if this replica is the leader of its HA group, only the leader is expected
+// to expose series while passive replicas keep their state warm.
+type Elector interface {
+	Start()
+	IsLeader() bool
+}
+
+type electorConfig struct {
+	onChange func(leader bool)
+	client   *http.Client
+	username string
+	password string
+}
+
+type ElectorOption func(*electorConfig)
+
+// WithOnLeaderChange sets a function called each time leadership of this replica changes,
+// it is also called on first election.
+func WithOnLeaderChange(onChange func(leader bool)) ElectorOption {
+	return func(c *electorConfig) {
+		c.onChange = onChange
+	}
+}
+
+func WithHTTPClient(client *http.Client) ElectorOption {
+	return func(c *electorConfig) {
+		c.client = client
+	}
+}
+
+func WithBasicAuth(username, password string) ElectorOption {
+	return func(c *electorConfig) {
+		c.username = username
+		c.password = password
+	}
+}
+
+func newElectorConfig(opts []ElectorOption) electorConfig {
+	config := electorConfig{
+		onChange: func(bool) {},
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+	for _, o := range opts {
+		o(&config)
+	}
+	return config
+}
+
+// leadership holds the current election result and notifies changes.
+type leadership struct {
+	leader  atomic.Bool
+	elected atomic.Bool
+	config  electorConfig
+}
+
+func (l *leadership) IsLeader() bool {
+	return l.leader.Load()
+}
+
+func (l *leadership) set(leader bool) {
+	previous := l.leader.Swap(leader)
+	if !l.elected.Swap(true) || previous != leader {
+		l.config.onChange(leader)
+	}
+}
+
+// StaticElector always gives the same result, it is used when no election mechanism is configured.
+type StaticElector struct {
+	leadership
+}
+
+func NewStaticElector(leader bool, opts ...ElectorOption) *StaticElector {
+	e := &StaticElector{}
+	e.config = newElectorConfig(opts)
+	e.leader.Store(leader)
+	return e
+}
+
+func (e *StaticElector) Start() {
+	e.set(e.leader.Load())
+}
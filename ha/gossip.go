@@ -0,0 +1,100 @@
+package ha
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StatusPath is the path on which replicas give their status to each other.
+const StatusPath = "/ha/status"
+
+type Status struct {
+	Replica string `json:"replica"`
+	Leader  bool   `json:"leader"`
+}
+
+// GossipElector elects, among replicas which answer on StatusPath, the one with the lowest replica name.
+// It has no quorum: replicas which can't reach each other (e.g. during a network partition) each elect
+// their own leader, the group then has several leaders until they reach each other again.
+type GossipElector struct {
+	leadership
+	replica  string
+	peers    []string
+	interval time.Duration
+}
+
+// NewGossipElector creates an elector asking peers, given by their base url, for their status at each interval.
+func NewGossipElector(replica string, peers []string, interval time.Duration, opts ...ElectorOption) *GossipElector {
+	e := &GossipElector{
+		replica:  replica,
+		peers:    peers,
+		interval: interval,
+	}
+	e.config = newElectorConfig(opts)
+	return e
+}
+
+func (e *GossipElector) Start() {
+	e.Elect()
+	go func() {
+		ticker := time.NewTicker(e.interval)
+		for range ticker.C {
+			e.Elect()
+		}
+	}()
+}
+
+// Elect asks every peer for its status and takes leadership if no reachable replica has a lower name.
+func (e *GossipElector) Elect() {
+	leader := true
+	for _, peer := range e.peers {
+		status, err := e.peerStatus(peer)
+		if err != nil {
+			log.WithField("peer", peer).Debugf("Peer is considered down: %s", err.Error())
+			continue
+		}
+		if status.Replica == e.replica {
+			log.WithField("peer", peer).Warningf("Peer uses the same replica name '%s'", e.replica)
+		}
+		if status.Replica < e.replica {
+			leader = false
+		}
+	}
+	e.set(leader)
+}
+
+func (e *GossipElector) peerStatus(peer string) (Status, error) {
+	status := Status{}
+	req, err := http.NewRequest(http.MethodGet, peer+StatusPath, nil)
+	if err != nil {
+		return status, err
+	}
+	if e.config.username != "" && e.config.password != "" {
+		req.SetBasicAuth(e.config.username, e.config.password)
+	}
+	resp, err := e.config.client.Do(req)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
+
+// NewStatusHandler gives the handler to serve on StatusPath.
+func NewStatusHandler(replica string, elector Elector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(Status{
+			Replica: replica,
+			Leader:  elector.IsLeader(),
+		})
+	})
+}
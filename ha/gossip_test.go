@@ -0,0 +1,55 @@
+package ha_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/firehose_exporter/ha"
+)
+
+var _ = ginkgo.Describe("GossipElector", func() {
+	var peer *httptest.Server
+
+	ginkgo.BeforeEach(func() {
+		peer = httptest.NewServer(ha.NewStatusHandler("replica-b", ha.NewStaticElector(false)))
+	})
+
+	ginkgo.AfterEach(func() {
+		peer.Close()
+	})
+
+	ginkgo.It("should elect the reachable replica with the lowest name", func() {
+		lower := ha.NewGossipElector("replica-a", []string{peer.URL}, time.Second)
+		higher := ha.NewGossipElector("replica-c", []string{peer.URL}, time.Second)
+		lower.Elect()
+		higher.Elect()
+
+		gomega.Expect(lower.IsLeader()).To(gomega.BeTrue())
+		gomega.Expect(higher.IsLeader()).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should ignore unreachable replicas", func() {
+		elector := ha.NewGossipElector("replica-c", []string{peer.URL}, time.Second)
+		elector.Elect()
+		gomega.Expect(elector.IsLeader()).To(gomega.BeFalse())
+
+		peer.Close()
+		elector.Elect()
+		gomega.Expect(elector.IsLeader()).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should give replica status", func() {
+		resp, err := http.Get(peer.URL + ha.StatusPath)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		defer resp.Body.Close()
+
+		status := ha.Status{}
+		gomega.Expect(json.NewDecoder(resp.Body).Decode(&status)).To(gomega.Succeed())
+		gomega.Expect(status).To(gomega.Equal(ha.Status{Replica: "replica-b", Leader: false}))
+	})
+})
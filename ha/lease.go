@@ -0,0 +1,151 @@
+package ha
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errInvalidLease = errors.New("invalid lease")
+	errLeaseLocked  = errors.New("lease is locked by another replica")
+)
+
+const (
+	lockAttempts      = 5
+	lockRetryInterval = 20 * time.Millisecond
+)
+
+type lease struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LeaseElector elects the replica holding a lease written in a file shared by all replicas,
+// the holder renews it regularly and other replicas take it over once it expired.
+// The lease is read and written under an exclusive lock of a file next to it, which makes
+// taking the lease a compare-and-swap: two replicas never both see it free and take it.
+type LeaseElector struct {
+	leadership
+	path          string
+	replica       string
+	leaseDuration time.Duration
+}
+
+func NewLeaseElector(path string, replica string, leaseDuration time.Duration, opts ...ElectorOption) *LeaseElector {
+	e := &LeaseElector{
+		path:          path,
+		replica:       replica,
+		leaseDuration: leaseDuration,
+	}
+	e.config = newElectorConfig(opts)
+	return e
+}
+
+func (e *LeaseElector) Start() {
+	e.Elect(time.Now())
+	go func() {
+		ticker := time.NewTicker(e.leaseDuration / 3)
+		for t := range ticker.C {
+			e.Elect(t)
+		}
+	}()
+}
+
+// Elect takes or renews the lease if possible at the given time. Leadership is left unchanged while
+// another replica holds the lock, it is decided again on next election.
+func (e *LeaseElector) Elect(now time.Time) {
+	unlock, err := e.lock()
+	if errors.Is(err, errLeaseLocked) {
+		log.Debugf("Lease file %s is locked, keeping current leadership", e.path)
+		return
+	}
+	if err != nil {
+		log.Warningf("Could not lock lease file %s: %s", e.path, err.Error())
+		e.set(false)
+		return
+	}
+	defer unlock()
+
+	current, err := e.read()
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case errors.Is(err, errInvalidLease):
+		log.Warningf("Overwriting lease file %s: %s", e.path, err.Error())
+	case err != nil:
+		log.Warningf("Could not read lease file %s: %s", e.path, err.Error())
+		e.set(false)
+		return
+	case current.Holder != e.replica && now.Before(current.ExpiresAt):
+		e.set(false)
+		return
+	}
+
+	if err := e.write(lease{Holder: e.replica, ExpiresAt: now.Add(e.leaseDuration)}); err != nil {
+		log.Warningf("Could not write lease file %s: %s", e.path, err.Error())
+		e.set(false)
+		return
+	}
+	e.set(true)
+}
+
+// lock takes the lock of the lease file, it gives errLeaseLocked when another replica keeps it.
+// The lock file is never removed: the system releases its lock when a replica stops while holding it.
+func (e *LeaseElector) lock() (func(), error) {
+	lockFile, err := os.OpenFile(e.path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < lockAttempts; attempt++ {
+		err = tryLock(lockFile)
+		if err == nil {
+			return func() {
+				unlock(lockFile)
+				lockFile.Close()
+			}, nil
+		}
+		if !errors.Is(err, errLeaseLocked) {
+			break
+		}
+		time.Sleep(lockRetryInterval)
+	}
+	lockFile.Close()
+	return nil, err
+}
+
+func (e *LeaseElector) read() (lease, error) {
+	current := lease{}
+	content, err := os.ReadFile(e.path)
+	if err != nil {
+		return current, err
+	}
+	if err := json.Unmarshal(content, &current); err != nil {
+		return current, fmt.Errorf("%w: %s", errInvalidLease, err.Error())
+	}
+	return current, nil
+}
+
+func (e *LeaseElector) write(l lease) error {
+	content, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(e.path), filepath.Base(e.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), e.path)
+}
@@ -0,0 +1,113 @@
+package ha_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/firehose_exporter/ha"
+)
+
+var _ = ginkgo.Describe("LeaseElector", func() {
+	var dir, leasePath string
+	var first, second *ha.LeaseElector
+	var firstChanges []bool
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "lease")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		leasePath = filepath.Join(dir, "lease.json")
+		firstChanges = make([]bool, 0)
+		first = ha.NewLeaseElector(leasePath, "replica-a", 15*time.Second, ha.WithOnLeaderChange(func(leader bool) {
+			firstChanges = append(firstChanges, leader)
+		}))
+		second = ha.NewLeaseElector(leasePath, "replica-b", 15*time.Second)
+	})
+
+	ginkgo.AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	ginkgo.It("should elect the first replica taking the lease", func() {
+		now := time.Now()
+		first.Elect(now)
+		second.Elect(now)
+
+		gomega.Expect(first.IsLeader()).To(gomega.BeTrue())
+		gomega.Expect(second.IsLeader()).To(gomega.BeFalse())
+		gomega.Expect(firstChanges).To(gomega.Equal([]bool{true}))
+	})
+
+	ginkgo.It("should keep the lease while it is renewed", func() {
+		now := time.Now()
+		first.Elect(now)
+		first.Elect(now.Add(10 * time.Second))
+		second.Elect(now.Add(20 * time.Second))
+
+		gomega.Expect(first.IsLeader()).To(gomega.BeTrue())
+		gomega.Expect(second.IsLeader()).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should let another replica take over an expired lease", func() {
+		now := time.Now()
+		first.Elect(now)
+		second.Elect(now.Add(16 * time.Second))
+		first.Elect(now.Add(17 * time.Second))
+
+		gomega.Expect(second.IsLeader()).To(gomega.BeTrue())
+		gomega.Expect(first.IsLeader()).To(gomega.BeFalse())
+		gomega.Expect(firstChanges).To(gomega.Equal([]bool{true, false}))
+	})
+
+	ginkgo.It("should overwrite an invalid lease file", func() {
+		gomega.Expect(os.WriteFile(leasePath, []byte("not json"), 0o600)).To(gomega.Succeed())
+		first.Elect(time.Now())
+
+		gomega.Expect(first.IsLeader()).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should take a lease whose lock file was left by a stopped replica", func() {
+		gomega.Expect(os.WriteFile(leasePath+".lock", nil, 0o600)).To(gomega.Succeed())
+		first.Elect(time.Now())
+
+		gomega.Expect(first.IsLeader()).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should elect a single replica among concurrent elections", func() {
+		now := time.Now()
+		electors := make([]*ha.LeaseElector, 0)
+		for i := 0; i < 5; i++ {
+			electors = append(electors, ha.NewLeaseElector(leasePath, fmt.Sprintf("replica-%d", i), 15*time.Second))
+		}
+		wg := sync.WaitGroup{}
+		for _, elector := range electors {
+			wg.Add(1)
+			go func(elector *ha.LeaseElector) {
+				defer wg.Done()
+				elector.Elect(now)
+			}(elector)
+		}
+		wg.Wait()
+
+		leaders := 0
+		for _, elector := range electors {
+			if elector.IsLeader() {
+				leaders++
+			}
+		}
+		gomega.Expect(leaders).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should be passive when lease file can't be written", func() {
+		elector := ha.NewLeaseElector(filepath.Join(leasePath, "missing", "lease.json"), "replica-a", 15*time.Second)
+		elector.Elect(time.Now())
+
+		gomega.Expect(elector.IsLeader()).To(gomega.BeFalse())
+	})
+})
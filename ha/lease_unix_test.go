@@ -0,0 +1,43 @@
+//go:build !windows
+
+package ha_test
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/firehose_exporter/ha"
+)
+
+var _ = ginkgo.Describe("LeaseElector lock", func() {
+	ginkgo.It("should not take a lease locked by another replica", func() {
+		dir, err := os.MkdirTemp("", "lease")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		defer os.RemoveAll(dir)
+		leasePath := filepath.Join(dir, "lease.json")
+		lockFile, err := os.OpenFile(leasePath+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		defer lockFile.Close()
+		gomega.Expect(syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)).To(gomega.Succeed())
+
+		changes := make([]bool, 0)
+		elector := ha.NewLeaseElector(leasePath, "replica-a", 15*time.Second, ha.WithOnLeaderChange(func(leader bool) {
+			changes = append(changes, leader)
+		}))
+		elector.Elect(time.Now())
+
+		gomega.Expect(elector.IsLeader()).To(gomega.BeFalse())
+		gomega.Expect(changes).To(gomega.BeEmpty())
+		_, err = os.Stat(leasePath)
+		gomega.Expect(os.IsNotExist(err)).To(gomega.BeTrue())
+
+		gomega.Expect(syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)).To(gomega.Succeed())
+		elector.Elect(time.Now())
+		gomega.Expect(elector.IsLeader()).To(gomega.BeTrue())
+	})
+})
@@ -0,0 +1,139 @@
+package metadata
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	dto "github.com/prometheus/client_model/go"
+	"go.yaml.in/yaml/v3"
+)
+
+// Entry describes a metric of Cloud Foundry components as named in envelopes.
+type Entry struct {
+	// Name of the metric in envelopes, e.g. latency for the gorouter.
+	Name string `yaml:"name"`
+	// Origin restricts the entry to metrics of this origin, entries without origin are used
+	// for origins having no entry of their own.
+	Origin string `yaml:"origin"`
+	Help   string `yaml:"help"`
+	// Unit of values in envelopes, e.g. ms, KiB or %, values are converted to its base unit.
+	Unit string `yaml:"unit"`
+	// Type overrides the type of the metric: counter, gauge or untyped.
+	Type string `yaml:"type"`
+
+	baseUnit   string
+	scale      float64
+	metricType *dto.MetricType
+}
+
+func (e *Entry) compile() error {
+	if e.Name == "" {
+		return fmt.Errorf("name is missing")
+	}
+	if e.Unit != "" {
+		baseUnit, scale, ok := ToBaseUnit(e.Unit)
+		if !ok {
+			return fmt.Errorf("unknown unit '%s'", e.Unit)
+		}
+		e.baseUnit = baseUnit
+		e.scale = scale
+	}
+	switch strings.ToLower(e.Type) {
+	case "":
+	case "counter":
+		e.metricType = dto.MetricType_COUNTER.Enum()
+	case "gauge":
+		e.metricType = dto.MetricType_GAUGE.Enum()
+	case "untyped":
+		e.metricType = dto.MetricType_UNTYPED.Enum()
+	default:
+		return fmt.Errorf("unknown type '%s'", e.Type)
+	}
+	return nil
+}
+
+type entryKey struct {
+	origin string
+	name   string
+}
+
+// Catalog gives help, unit and type to metrics made from envelopes.
+type Catalog struct {
+	entries map[entryKey]*Entry
+}
+
+// NewCatalog validates entries, there must be only one entry by name and origin.
+func NewCatalog(entries ...*Entry) (*Catalog, error) {
+	c := &Catalog{
+		entries: make(map[entryKey]*Entry, len(entries)),
+	}
+	for i, entry := range entries {
+		if err := entry.compile(); err != nil {
+			return nil, fmt.Errorf("metadata entry %d: %w", i, err)
+		}
+		key := entryKey{origin: entry.Origin, name: entry.Name}
+		if _, ok := c.entries[key]; ok {
+			return nil, fmt.Errorf("metadata entry %d: duplicated entry for name '%s' and origin '%s'", i, entry.Name, entry.Origin)
+		}
+		c.entries[key] = entry
+	}
+	return c, nil
+}
+
+func (c *Catalog) lookup(name, origin string) (*Entry, bool) {
+	if entry, ok := c.entries[entryKey{origin: origin, name: name}]; ok {
+		return entry, true
+	}
+	entry, ok := c.entries[entryKey{name: name}]
+	return entry, ok
+}
+
+// Describe is a metric converter setting help, unit and type of the metric from its entry, metrics of entries
+// having a unit are converted to its base unit (see ConvertToBaseUnit), or to the one of their envelope unit
+// when it has a base unit. It must run before other converters
+// as entries match names of metrics in envelopes.
+func (c *Catalog) Describe(metric *metrics.RawMetric) {
+	entry, ok := c.lookup(metric.MetricName(), metric.Origin())
+	if !ok {
+		return
+	}
+	if entry.metricType != nil {
+		metric.SetMetricType(*entry.metricType)
+	}
+	if entry.Help != "" {
+		metric.SetHelp(entry.Help)
+	}
+	if entry.baseUnit == "" {
+		return
+	}
+	baseUnit, scale := entry.baseUnit, entry.scale
+	// the unit of the envelope wins when it differs, e.g. an emitter changed the unit of a metric
+	if envelopeBaseUnit, envelopeScale, ok := ToBaseUnit(unitLabel(metric)); ok {
+		baseUnit, scale = envelopeBaseUnit, envelopeScale
+	}
+	ConvertToBaseUnit(metric, baseUnit, scale)
+}
+
+// unitLabel gives the unit of the metric from its envelope, empty when it has none.
+func unitLabel(metric *metrics.RawMetric) string {
+	for _, label := range metric.Metric().GetLabel() {
+		if label.GetName() == UnitLabel {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+func LoadCatalog(path string) ([]*Entry, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*Entry, 0)
+	if err := yaml.Unmarshal(content, &entries); err != nil {
+		return nil, fmt.Errorf("could not parse metadata catalog file %s: %w", path, err)
+	}
+	return entries, nil
+}
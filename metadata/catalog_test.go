@@ -0,0 +1,141 @@
+package metadata_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/cloudfoundry/firehose_exporter/metadata"
+	"github.com/cloudfoundry/firehose_exporter/metricmaker"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+)
+
+var _ = ginkgo.Describe("LoadCatalog", func() {
+	ginkgo.It("should load example catalog", func() {
+		entries, err := metadata.LoadCatalog("catalog.yml")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(entries).ToNot(gomega.BeEmpty())
+		gomega.Expect(entries[0].Name).To(gomega.Equal("latency"))
+		gomega.Expect(entries[0].Origin).To(gomega.Equal("gorouter"))
+		gomega.Expect(entries[0].Unit).To(gomega.Equal("ms"))
+
+		_, err = metadata.NewCatalog(entries...)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should fail on a file which is not yaml", func() {
+		dir, err := os.MkdirTemp("", "metadata")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "catalog.yml")
+		gomega.Expect(os.WriteFile(path, []byte("name: [a"), 0o600)).To(gomega.Succeed())
+
+		_, err = metadata.LoadCatalog(path)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})
+
+var _ = ginkgo.Describe("Catalog", func() {
+	invalidEntries := map[string][]*metadata.Entry{
+		"no name":      {{Unit: "ms"}},
+		"unknown unit": {{Name: "latency", Unit: "furlongs"}},
+		"unknown type": {{Name: "latency", Type: "histogram"}},
+		"duplicates":   {{Name: "latency", Origin: "gorouter"}, {Name: "latency", Origin: "gorouter"}},
+	}
+	for description, entries := range invalidEntries {
+		entries := entries
+		ginkgo.It("should refuse entries with "+description, func() {
+			_, err := metadata.NewCatalog(entries...)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+	}
+
+	ginkgo.Describe("Describe", func() {
+		var catalog *metadata.Catalog
+
+		ginkgo.BeforeEach(func() {
+			metricmaker.SetMetricConverters(make([]metricmaker.MetricConverter, 0))
+			var err error
+			catalog, err = metadata.NewCatalog(
+				&metadata.Entry{Name: "latency", Origin: "gorouter", Help: "Time the Gorouter took.", Unit: "ms"},
+				&metadata.Entry{Name: "latency", Help: "Time taken.", Unit: "seconds"},
+				&metadata.Entry{Name: "requests", Help: "Requests received.", Type: "counter"},
+				&metadata.Entry{Name: "memory_bytes", Unit: "MiB"},
+			)
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		})
+
+		newGauge := func(name, origin, unit string, value float64) *metrics.RawMetric {
+			return metricmaker.NewRawMetricGauge(name, map[string]string{
+				"origin": origin,
+				"unit":   unit,
+			}, value)
+		}
+
+		ginkgo.It("should convert values of the entry of the origin to the base unit", func() {
+			m := newGauge("latency", "gorouter", "ms", 250)
+			catalog.Describe(m)
+
+			gomega.Expect(m.MetricName()).To(gomega.Equal("latency_seconds"))
+			gomega.Expect(m.Help()).To(gomega.Equal("Time the Gorouter took."))
+			gomega.Expect(m.Unit()).To(gomega.Equal(metadata.UnitSeconds))
+			gomega.Expect(m.Metric().GetGauge().GetValue()).To(gomega.Equal(0.25))
+			gomega.Expect(m.Metric().GetLabel()).To(gomega.HaveLen(1))
+			gomega.Expect(m.Metric().GetLabel()[0].GetName()).To(gomega.Equal("origin"))
+		})
+
+		ginkgo.It("should use the entry without origin for other origins", func() {
+			m := newGauge("latency", "bbs", "s", 2)
+			catalog.Describe(m)
+
+			gomega.Expect(m.MetricName()).To(gomega.Equal("latency_seconds"))
+			gomega.Expect(m.Help()).To(gomega.Equal("Time taken."))
+			gomega.Expect(m.Metric().GetGauge().GetValue()).To(gomega.Equal(2.0))
+		})
+
+		ginkgo.It("should prefer the envelope unit when it differs from the entry unit", func() {
+			m := newGauge("latency", "gorouter", "ns", 250000000)
+			catalog.Describe(m)
+
+			gomega.Expect(m.MetricName()).To(gomega.Equal("latency_seconds"))
+			gomega.Expect(m.Metric().GetGauge().GetValue()).To(gomega.Equal(0.25))
+
+			m = newGauge("latency", "gorouter", "", 250)
+			catalog.Describe(m)
+
+			gomega.Expect(m.Metric().GetGauge().GetValue()).To(gomega.Equal(0.25))
+		})
+
+		ginkgo.It("should not suffix names already ending with the base unit", func() {
+			m := newGauge("memory_bytes", "rep", "MiB", 2)
+			catalog.Describe(m)
+
+			gomega.Expect(m.MetricName()).To(gomega.Equal("memory_bytes"))
+			gomega.Expect(m.Metric().GetGauge().GetValue()).To(gomega.Equal(2.0 * 1024 * 1024))
+		})
+
+		ginkgo.It("should override type and keep entries without unit as is", func() {
+			m := newGauge("requests", "cc", "count", 3)
+			catalog.Describe(m)
+
+			gomega.Expect(m.MetricName()).To(gomega.Equal("requests"))
+			gomega.Expect(m.Help()).To(gomega.Equal("Requests received."))
+			gomega.Expect(m.Unit()).To(gomega.BeEmpty())
+			gomega.Expect(*m.MetricType()).To(gomega.Equal(dto.MetricType_COUNTER))
+			gomega.Expect(m.Metric().GetCounter().GetValue()).To(gomega.Equal(3.0))
+			gomega.Expect(m.Metric().GetLabel()).To(gomega.HaveLen(2))
+		})
+
+		ginkgo.It("should leave metrics without entry as is", func() {
+			m := newGauge("cpu", "rep", "percentage", 50)
+			catalog.Describe(m)
+
+			gomega.Expect(m.MetricName()).To(gomega.Equal("cpu"))
+			gomega.Expect(m.Help()).To(gomega.BeEmpty())
+			gomega.Expect(m.Metric().GetGauge().GetValue()).To(gomega.Equal(50.0))
+		})
+	})
+})
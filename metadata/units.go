@@ -0,0 +1,92 @@
+package metadata
+
+import (
+	"strings"
+
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+)
+
+// UnitLabel is the label holding the unit of gauges from their envelope.
+const UnitLabel = "unit"
+
+// Base units of Prometheus naming conventions, metrics having one end with it.
+const (
+	UnitSeconds = "seconds"
+	UnitBytes   = "bytes"
+	UnitRatio   = "ratio"
+)
+
+type conversion struct {
+	baseUnit string
+	scale    float64
+}
+
+// conversions of units found in envelopes by lower cased unit
+var conversions = map[string]conversion{
+	"ns":           {UnitSeconds, 1e-9},
+	"nanosecond":   {UnitSeconds, 1e-9},
+	"nanoseconds":  {UnitSeconds, 1e-9},
+	"us":           {UnitSeconds, 1e-6},
+	"µs":           {UnitSeconds, 1e-6},
+	"microsecond":  {UnitSeconds, 1e-6},
+	"microseconds": {UnitSeconds, 1e-6},
+	"ms":           {UnitSeconds, 1e-3},
+	"millisecond":  {UnitSeconds, 1e-3},
+	"milliseconds": {UnitSeconds, 1e-3},
+	"s":            {UnitSeconds, 1},
+	"sec":          {UnitSeconds, 1},
+	"second":       {UnitSeconds, 1},
+	"seconds":      {UnitSeconds, 1},
+	"min":          {UnitSeconds, 60},
+	"minute":       {UnitSeconds, 60},
+	"minutes":      {UnitSeconds, 60},
+	"h":            {UnitSeconds, 3600},
+	"hour":         {UnitSeconds, 3600},
+	"hours":        {UnitSeconds, 3600},
+	"b":            {UnitBytes, 1},
+	"byte":         {UnitBytes, 1},
+	"bytes":        {UnitBytes, 1},
+	"kb":           {UnitBytes, 1e3},
+	"kilobytes":    {UnitBytes, 1e3},
+	"kib":          {UnitBytes, 1 << 10},
+	"mb":           {UnitBytes, 1e6},
+	"megabytes":    {UnitBytes, 1e6},
+	"mib":          {UnitBytes, 1 << 20},
+	"gb":           {UnitBytes, 1e9},
+	"gigabytes":    {UnitBytes, 1e9},
+	"gib":          {UnitBytes, 1 << 30},
+	"tb":           {UnitBytes, 1e12},
+	"tib":          {UnitBytes, 1 << 40},
+	"%":            {UnitRatio, 0.01},
+	"percent":      {UnitRatio, 0.01},
+	"percentage":   {UnitRatio, 0.01},
+	"ratio":        {UnitRatio, 1},
+}
+
+// ToBaseUnit gives the base unit of a unit as reported in envelopes (e.g. ms, MiB or %) and the scale converting
+// values to it, false is returned for units without base unit like count or an empty unit.
+func ToBaseUnit(unit string) (string, float64, bool) {
+	c, ok := conversions[strings.ToLower(strings.TrimSpace(unit))]
+	return c.baseUnit, c.scale, ok
+}
+
+// ConvertToBaseUnit scales the value of the metric to the base unit, appends the base unit to its name
+// if it doesn't end with it yet and removes its unit label.
+func ConvertToBaseUnit(metric *metrics.RawMetric, baseUnit string, scale float64) {
+	if value, ok := metric.Value(); ok {
+		metric.SetValue(value * scale)
+	}
+	if !strings.HasSuffix(metric.MetricName(), "_"+baseUnit) {
+		metric.SetMetricName(metric.MetricName() + "_" + baseUnit)
+	}
+	metric.SetUnit(baseUnit)
+
+	metricDto := metric.Metric()
+	labels := metricDto.Label[:0]
+	for _, label := range metricDto.Label {
+		if label.GetName() != UnitLabel {
+			labels = append(labels, label)
+		}
+	}
+	metricDto.Label = labels
+}
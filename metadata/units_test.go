@@ -0,0 +1,40 @@
+package metadata_test
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/firehose_exporter/metadata"
+)
+
+var _ = ginkgo.Describe("ToBaseUnit", func() {
+	conversions := map[string]struct {
+		baseUnit string
+		scale    float64
+	}{
+		"ms":      {metadata.UnitSeconds, 1e-3},
+		"ns":      {metadata.UnitSeconds, 1e-9},
+		"seconds": {metadata.UnitSeconds, 1},
+		"KiB":     {metadata.UnitBytes, 1024},
+		"MiB":     {metadata.UnitBytes, 1024 * 1024},
+		"MB":      {metadata.UnitBytes, 1e6},
+		"bytes":   {metadata.UnitBytes, 1},
+		"%":       {metadata.UnitRatio, 0.01},
+	}
+	for unit, expected := range conversions {
+		unit, expected := unit, expected
+		ginkgo.It("should convert "+unit, func() {
+			baseUnit, scale, ok := metadata.ToBaseUnit(unit)
+			gomega.Expect(ok).To(gomega.BeTrue())
+			gomega.Expect(baseUnit).To(gomega.Equal(expected.baseUnit))
+			gomega.Expect(scale).To(gomega.Equal(expected.scale))
+		})
+	}
+
+	ginkgo.It("should not convert units without base unit", func() {
+		for _, unit := range []string{"", "count", "Metric", "req/s"} {
+			_, _, ok := metadata.ToBaseUnit(unit)
+			gomega.Expect(ok).To(gomega.BeFalse(), unit)
+		}
+	})
+})
@@ -13,15 +13,15 @@ func RetroCompatMetricNames(metric *metrics.RawMetric) {
 
 	switch metric.MetricName() {
 	case "cpu":
-		metric.SetHelp("Cloud Foundry Firehose container metric: CPU used, on a scale of 0 to 100.")
+		setDefaultHelp(metric, "Cloud Foundry Firehose container metric: CPU used, on a scale of 0 to 100.")
 	case "memory":
-		metric.SetHelp("Cloud Foundry Firehose container metric: bytes of memory used.")
+		setDefaultHelp(metric, "Cloud Foundry Firehose container metric: bytes of memory used.")
 	case "disk":
-		metric.SetHelp("Cloud Foundry Firehose container metric: bytes of disk used.")
+		setDefaultHelp(metric, "Cloud Foundry Firehose container metric: bytes of disk used.")
 	case "memory_quota":
-		metric.SetHelp("Cloud Foundry Firehose container metric: maximum bytes of memory allocated to container.")
+		setDefaultHelp(metric, "Cloud Foundry Firehose container metric: maximum bytes of memory allocated to container.")
 	case "disk_quota":
-		metric.SetHelp("Cloud Foundry Firehose container metric: maximum bytes of disk allocated to container.")
+		setDefaultHelp(metric, "Cloud Foundry Firehose container metric: maximum bytes of disk allocated to container.")
 	}
 	FindAndReplaceByName("cpu", "container_metric_cpu_percentage")(metric)
 	FindAndReplaceByName("memory", "container_metric_memory_bytes")(metric)
@@ -37,10 +37,17 @@ func RetroCompatMetricNames(metric *metrics.RawMetric) {
 		!strings.HasSuffix(metric.MetricName(), "_delta") &&
 		metric.MetricName() != "http_total" {
 		metric.SetMetricName("counter_event_" + metric.Origin() + "_" + metric.MetricName() + "_total")
-		metric.SetHelp("Cloud Foundry Firehose counter metrics.")
+		setDefaultHelp(metric, "Cloud Foundry Firehose counter metrics.")
 	}
 	if *metric.MetricType() == dto.MetricType_GAUGE {
 		metric.SetMetricName("value_metric_" + metric.Origin() + "_" + metric.MetricName())
-		metric.SetHelp("Cloud Foundry Firehose value metrics.")
+		setDefaultHelp(metric, "Cloud Foundry Firehose value metrics.")
+	}
+}
+
+// setDefaultHelp sets help of metrics which don't have one yet, e.g. from a metadata catalog.
+func setDefaultHelp(metric *metrics.RawMetric, help string) {
+	if metric.Help() == "" {
+		metric.SetHelp(help)
 	}
 }
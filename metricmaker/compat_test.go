@@ -48,6 +48,14 @@ var _ = ginkgo.Describe("Compat", func() {
 				m.SetOrigin("origin")
 				metricmaker.RetroCompatMetricNames(m)
 				gomega.Expect(m.MetricName()).To(gomega.Equal("value_metric_origin_my_metric"))
+				gomega.Expect(m.Help()).To(gomega.Equal("Cloud Foundry Firehose value metrics."))
+			})
+
+			ginkgo.It("should keep help already set", func() {
+				m := metricmaker.NewRawMetricGauge("my_metric", make(map[string]string), 0)
+				m.SetHelp("my help")
+				metricmaker.RetroCompatMetricNames(m)
+				gomega.Expect(m.Help()).To(gomega.Equal("my help"))
 			})
 		})
 	})
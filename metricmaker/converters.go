@@ -4,6 +4,7 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/cloudfoundry/firehose_exporter/metadata"
 	"github.com/cloudfoundry/firehose_exporter/metrics"
 	"github.com/cloudfoundry/firehose_exporter/transform"
 	"github.com/cloudfoundry/firehose_exporter/utils"
@@ -25,6 +26,24 @@ func SuffixCounterWithTotal(metric *metrics.RawMetric) {
 	metric.SetMetricName(metric.MetricName() + "_total")
 }
 
+// NormalizeUnit rescales values of gauges to the base unit of the unit label from their envelope (e.g. ms to seconds,
+// MiB to bytes or % to ratio), appends the base unit to their name and removes the unit label.
+// Container metrics and gauges of units without base unit are left as is.
+func NormalizeUnit(metric *metrics.RawMetric) {
+	if utils.MetricIsContainerMetric(metric) {
+		return
+	}
+	for _, label := range metric.Metric().GetLabel() {
+		if label.GetName() != metadata.UnitLabel {
+			continue
+		}
+		if baseUnit, scale, ok := metadata.ToBaseUnit(label.GetValue()); ok {
+			metadata.ConvertToBaseUnit(metric, baseUnit, scale)
+		}
+		return
+	}
+}
+
 func OrderAndSanitizeLabels(metric *metrics.RawMetric) {
 	metricDto := metric.Metric()
 	labels := make([]*dto.LabelPair, 0)
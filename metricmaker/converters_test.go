@@ -21,6 +21,49 @@ var _ = ginkgo.Describe("Converters", func() {
 		})
 	})
 
+	ginkgo.Describe("NormalizeUnit", func() {
+		ginkgo.It("should rescale gauges to base unit and drop unit label", func() {
+			m := metricmaker.NewRawMetricGauge("latency", map[string]string{"origin": "gorouter", "unit": "ms"}, 250)
+			metricmaker.NormalizeUnit(m)
+			gomega.Expect(m.MetricName()).To(gomega.Equal("latency_seconds"))
+			gomega.Expect(m.Unit()).To(gomega.Equal("seconds"))
+			gomega.Expect(m.Metric().GetGauge().GetValue()).To(gomega.Equal(0.25))
+			gomega.Expect(m.Metric().Label).To(gomega.HaveLen(1))
+			gomega.Expect(m.Metric().Label[0].GetName()).To(gomega.Equal("origin"))
+
+			m = metricmaker.NewRawMetricGauge("CapacityTotalMemory", map[string]string{"unit": "MiB"}, 2)
+			metricmaker.NormalizeUnit(m)
+			gomega.Expect(m.MetricName()).To(gomega.Equal("CapacityTotalMemory_bytes"))
+			gomega.Expect(m.Metric().GetGauge().GetValue()).To(gomega.Equal(2.0 * 1024 * 1024))
+
+			m = metricmaker.NewRawMetricGauge("utilization", map[string]string{"unit": "%"}, 50)
+			metricmaker.NormalizeUnit(m)
+			gomega.Expect(m.MetricName()).To(gomega.Equal("utilization_ratio"))
+			gomega.Expect(m.Metric().GetGauge().GetValue()).To(gomega.Equal(0.5))
+		})
+
+		ginkgo.It("should not suffix names already ending with base unit", func() {
+			m := metricmaker.NewRawMetricGauge("heap_bytes", map[string]string{"unit": "bytes"}, 3)
+			metricmaker.NormalizeUnit(m)
+			gomega.Expect(m.MetricName()).To(gomega.Equal("heap_bytes"))
+			gomega.Expect(m.Metric().Label).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should leave container metrics and units without base unit as is", func() {
+			m := metricmaker.NewRawMetricGauge("memory", map[string]string{"unit": "bytes"}, 3)
+			metricmaker.NormalizeUnit(m)
+			gomega.Expect(m.MetricName()).To(gomega.Equal("memory"))
+			gomega.Expect(m.Metric().Label).To(gomega.HaveLen(1))
+
+			m = metricmaker.NewRawMetricGauge("requests", map[string]string{"unit": "count"}, 3)
+			metricmaker.NormalizeUnit(m)
+			gomega.Expect(m.MetricName()).To(gomega.Equal("requests"))
+			gomega.Expect(m.Unit()).To(gomega.BeEmpty())
+			gomega.Expect(m.Metric().Label).To(gomega.HaveLen(1))
+			gomega.Expect(m.Metric().GetGauge().GetValue()).To(gomega.Equal(3.0))
+		})
+	})
+
 	ginkgo.Describe("AddNamespace", func() {
 		ginkgo.It("should prefix with namespace given", func() {
 			m := metricmaker.NewRawMetricGauge("my_metric", make(map[string]string), 0)
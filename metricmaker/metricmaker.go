@@ -3,8 +3,10 @@ package metricmaker
 import (
 	"sort"
 	"strings"
+	"time"
 
 	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cloudfoundry/firehose_exporter/metadata"
 	"github.com/cloudfoundry/firehose_exporter/metrics"
 	"github.com/cloudfoundry/firehose_exporter/transform"
 	"github.com/gogo/protobuf/proto"
@@ -21,10 +23,18 @@ var metricConverters = []MetricConverter{
 
 var enableEnvelopCounterDelta = false
 
+var exposeEnvelopTimestamp = false
+
 func SetEnableEnvelopCounterDelta(enable bool) {
 	enableEnvelopCounterDelta = enable
 }
 
+// SetExposeEnvelopTimestamp makes metrics from envelopes carry the envelope timestamp,
+// they are exposed with it instead of being stamped by the scraper.
+func SetExposeEnvelopTimestamp(enable bool) {
+	exposeEnvelopTimestamp = enable
+}
+
 func PrependMetricConverter(metricConverter MetricConverter) {
 	metricConverters = append([]MetricConverter{metricConverter}, metricConverters...)
 }
@@ -100,6 +110,7 @@ func newRawMetricFromEnvelopCounter(envelope *loggregator_v2.Envelope) []*metric
 		Value: proto.Float64(float64(counter.GetTotal())),
 	}
 	m := metrics.NewRawMetric(metricName, getOriginFromMetric(metric), metric)
+	m.SetEnvelopeTimestamp(envelope.GetTimestamp())
 	applyConverters(m)
 
 	finalMetrics := []*metrics.RawMetric{m}
@@ -110,6 +121,7 @@ func newRawMetricFromEnvelopCounter(envelope *loggregator_v2.Envelope) []*metric
 			Value: proto.Float64(float64(counter.GetDelta())),
 		}
 		mDelta := metrics.NewRawMetric(metricName+"_delta", getOriginFromMetric(deltaMetric), deltaMetric)
+		mDelta.SetEnvelopeTimestamp(envelope.GetTimestamp())
 		applyConverters(mDelta)
 		finalMetrics = append(finalMetrics, mDelta)
 	}
@@ -123,7 +135,7 @@ func newRawMetricsFromEnvelopGauge(envelope *loggregator_v2.Envelope) []*metrics
 		point := prepareMetricFromEnvelop(envelope)
 		metricName := name
 		point.Label = append(point.Label, &dto.LabelPair{
-			Name:  proto.String("unit"),
+			Name:  proto.String(metadata.UnitLabel),
 			Value: proto.String(metric.GetUnit()),
 		})
 		point.Gauge = &dto.Gauge{
@@ -131,6 +143,7 @@ func newRawMetricsFromEnvelopGauge(envelope *loggregator_v2.Envelope) []*metrics
 		}
 
 		m := metrics.NewRawMetric(metricName, getOriginFromMetric(point), point)
+		m.SetEnvelopeTimestamp(envelope.GetTimestamp())
 		applyConverters(m)
 		points = append(points, m)
 	}
@@ -181,7 +194,11 @@ func prepareMetricFromEnvelop(envelope *loggregator_v2.Envelope) *dto.Metric {
 			Value: proto.String(labelValues[k]),
 		}
 	}
-	return &dto.Metric{
+	metric := &dto.Metric{
 		Label: labels,
 	}
+	if exposeEnvelopTimestamp && envelope.GetTimestamp() != 0 {
+		metric.TimestampMs = proto.Int64(envelope.GetTimestamp() / int64(time.Millisecond))
+	}
+	return metric
 }
@@ -146,6 +146,38 @@ var _ = ginkgo.Describe("MetricMaker", func() {
 			})
 		})
 
+		ginkgo.Context("envelop timestamp", func() {
+			envelope := func() *loggregator_v2.Envelope {
+				return &loggregator_v2.Envelope{
+					Timestamp: 1700000000123456789,
+					SourceId:  "source-id",
+					Message: &loggregator_v2.Envelope_Counter{
+						Counter: &loggregator_v2.Counter{Name: "my_metric", Total: 1},
+					},
+				}
+			}
+
+			ginkgo.AfterEach(func() {
+				metricmaker.SetExposeEnvelopTimestamp(false)
+			})
+
+			ginkgo.It("should keep envelope timestamp without exposing it", func() {
+				ms := metricmaker.NewRawMetricsFromEnvelop(envelope())
+
+				gomega.Expect(ms).To(gomega.HaveLen(1))
+				gomega.Expect(ms[0].EnvelopeTimestamp()).To(gomega.Equal(int64(1700000000123456789)))
+				gomega.Expect(ms[0].Metric().TimestampMs).To(gomega.BeNil())
+			})
+
+			ginkgo.It("should expose envelope timestamp in milliseconds when enabled", func() {
+				metricmaker.SetExposeEnvelopTimestamp(true)
+				ms := metricmaker.NewRawMetricsFromEnvelop(envelope())
+
+				gomega.Expect(ms).To(gomega.HaveLen(1))
+				gomega.Expect(ms[0].Metric().GetTimestampMs()).To(gomega.Equal(int64(1700000000123)))
+			})
+		})
+
 	})
 
 })
@@ -6,3 +6,22 @@ const (
 	GorouterHTTPHistogramMetricName = GorouterHTTPMetricName + "_duration_seconds"
 	GorouterHTTPSummaryMetricName   = GorouterHTTPMetricName + "_response_size_bytes"
 )
+
+// stages and reasons of TotalDropped
+const (
+	DropStageStream  = "stream"
+	DropStageLimit   = "limit"
+	DropStageIngress = "ingress"
+	DropStageFilter  = "filter"
+	DropStageTimer   = "timer"
+	DropStagePeer    = "peer"
+	DropStageOutput  = "output"
+
+	DropReasonBufferFull         = "buffer_full"
+	DropReasonDeploymentFiltered = "deployment_filtered"
+	DropReasonMetricDisabled     = "metric_disabled"
+	DropReasonNotSelected        = "not_selected"
+	DropReasonGUIDSource         = "guid_source"
+	DropReasonGorouterClient     = "gorouter_client"
+	DropReasonSendFailed         = "send_failed"
+)
@@ -22,6 +22,25 @@ type InternalMetrics struct {
 	LastValueMetricReceivedTimestamp     prometheus.Gauge
 	TotalHTTPMetricsReceived             prometheus.Counter
 	LastHTTPMetricReceivedTimestamp      prometheus.Gauge
+	TotalSeriesExpired                   *prometheus.CounterVec
+	RenderDuration                       *prometheus.HistogramVec
+	TotalPeerForwarded                   *prometheus.CounterVec
+	TotalPeerForwardDropped              *prometheus.CounterVec
+	TotalPeerReceived                    *prometheus.CounterVec
+	Leader                               prometheus.Gauge
+	TotalEnvelopesLimited                *prometheus.CounterVec
+	TotalLaneEnvelopesDropped            *prometheus.CounterVec
+	TotalLaneMetricsDropped              *prometheus.CounterVec
+	TotalDropped                         *prometheus.CounterVec
+	BufferFillRatio                      *prometheus.GaugeVec
+	IngestionLag                         *prometheus.HistogramVec
+	TotalOutOfOrderRejected              *prometheus.CounterVec
+	TotalStreamConnectAttempts           *prometheus.CounterVec
+	TotalStreamConnects                  *prometheus.CounterVec
+	TotalStreamDisconnects               *prometheus.CounterVec
+	TotalStreamErrors                    *prometheus.CounterVec
+	StreamConnected                      *prometheus.GaugeVec
+	TotalStreamEnvelopesReceived         *prometheus.CounterVec
 }
 
 func NewInternalMetrics(namespace string, environment string) *InternalMetrics {
@@ -167,5 +186,215 @@ func NewInternalMetrics(namespace string, environment string) *InternalMetrics {
 			ConstLabels: prometheus.Labels{"environment": environment},
 		},
 	)
+
+	im.TotalSeriesExpired = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "series_expired_total",
+			Help:        "Total number of series removed from the metric store after expiration, by metric name.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"metric_name"},
+	)
+
+	im.RenderDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "render_duration_seconds",
+			Help:        "Duration of metrics exposition rendering for a scrape, by exposition format.",
+			Buckets:     []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"format"},
+	)
+
+	im.TotalPeerForwarded = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "peer_forwarded_total",
+			Help:        "Total number of points and envelopes sent to the peer owning them.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"peer", "kind"},
+	)
+
+	im.TotalPeerForwardDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "peer_forward_dropped_total",
+			Help:        "Total number of points and envelopes which could not be sent to the peer owning them.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"peer", "kind"},
+	)
+
+	im.TotalPeerReceived = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "peer_received_total",
+			Help:        "Total number of points and envelopes received from peers.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"kind"},
+	)
+
+	im.Leader = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "exporter_leader",
+			Help:        "Whether this replica is the leader of its HA group (1) or passive (0).",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+	)
+
+	im.TotalEnvelopesLimited = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "envelopes_limited_total",
+			Help:        "Total number of envelopes dropped by sampling or rate limiting, by source id (capped, further sources are counted as other).",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"source_id", "reason"},
+	)
+
+	im.TotalLaneEnvelopesDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "lane_envelopes_dropped_total",
+			Help:        "Total number of envelopes dropped by the ingress buffer of a priority lane.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"lane"},
+	)
+
+	im.TotalLaneMetricsDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "lane_metrics_dropped_total",
+			Help:        "Total number of metrics of a priority lane dropped because the point buffer was full.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"lane"},
+	)
+
+	im.TotalDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "dropped_total",
+			Help:        "Total number of items discarded, by stage of the pipeline and reason.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"stage", "reason"},
+	)
+
+	im.BufferFillRatio = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "buffer_fill_ratio",
+			Help:        "Ratio of the capacity of an internal buffer currently in use.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"buffer", "lane"},
+	)
+
+	im.IngestionLag = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "ingestion_lag_seconds",
+			Help:        "Time between the timestamp of an envelope and the storage of its metrics, by origin.",
+			Buckets:     []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"origin"},
+	)
+
+	im.TotalOutOfOrderRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "out_of_order_samples_rejected_total",
+			Help:        "Total number of metrics rejected because their envelope is older than the one of the last value of their series, by origin.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"origin"},
+	)
+
+	im.TotalStreamConnectAttempts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "stream_connect_attempts_total",
+			Help:        "Total number of attempts to open an envelope stream, by logs provider address.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"address"},
+	)
+
+	im.TotalStreamConnects = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "stream_connects_total",
+			Help:        "Total number of envelope streams opened, by logs provider address.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"address"},
+	)
+
+	im.TotalStreamDisconnects = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "stream_disconnects_total",
+			Help:        "Total number of opened envelope streams which ended, by logs provider address.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"address"},
+	)
+
+	im.TotalStreamErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "stream_errors_total",
+			Help:        "Total number of failed attempts and disconnections of envelope streams, by logs provider address and reason.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"address", "reason"},
+	)
+
+	im.StreamConnected = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "stream_connected",
+			Help:        "Number of envelope streams currently opened, by logs provider address.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"address"},
+	)
+
+	im.TotalStreamEnvelopesReceived = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "stream_envelopes_received_total",
+			Help:        "Total number of envelopes received by each concurrent stream of the shard group.",
+			ConstLabels: prometheus.Labels{"environment": environment},
+		},
+		[]string{"stream"},
+	)
 	return im
 }
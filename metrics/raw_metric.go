@@ -18,8 +18,12 @@ type RawMetric struct {
 	metricType *dto.MetricType
 	id         uint64
 	help       string
-	expireAt   time.Time
-	swept      bool
+	// base unit of values, e.g. seconds, exposed in OpenMetrics format, empty when unknown
+	unit     string
+	expireAt time.Time
+	swept    bool
+	// unix time in nanoseconds of the envelope the metric comes from, zero when unknown
+	envelopeTimestamp int64
 }
 
 func NewRawMetric(metricName string, origin string, metric *dto.Metric) *RawMetric {
@@ -66,6 +70,19 @@ func (r *RawMetric) Help() string {
 	return r.help
 }
 
+func (r *RawMetric) Unit() string {
+	return r.unit
+}
+
+// EnvelopeTimestamp gives the unix time in nanoseconds of the envelope the metric comes from, zero when unknown.
+func (r *RawMetric) EnvelopeTimestamp() int64 {
+	return r.envelopeTimestamp
+}
+
+func (r *RawMetric) SetEnvelopeTimestamp(envelopeTimestamp int64) {
+	r.envelopeTimestamp = envelopeTimestamp
+}
+
 func (r *RawMetric) SetMetricName(metricName string) {
 	r.metricName = metricName
 }
@@ -74,6 +91,57 @@ func (r *RawMetric) SetHelp(help string) {
 	r.help = help
 }
 
+func (r *RawMetric) SetUnit(unit string) {
+	r.unit = unit
+}
+
+// SetMetricType changes the type of a counter, gauge or untyped metric, its value is kept.
+// Histograms and summaries can't be changed.
+func (r *RawMetric) SetMetricType(metricType dto.MetricType) {
+	value, ok := r.Value()
+	if !ok {
+		return
+	}
+	r.metric.Counter = nil
+	r.metric.Gauge = nil
+	r.metric.Untyped = nil
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		r.metric.Counter = &dto.Counter{Value: proto.Float64(value)}
+	case dto.MetricType_GAUGE:
+		r.metric.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+	default:
+		metricType = dto.MetricType_UNTYPED
+		r.metric.Untyped = &dto.Untyped{Value: proto.Float64(value)}
+	}
+	r.metricType = &metricType
+}
+
+// Value gives the value of a counter, gauge or untyped metric, false for histograms and summaries.
+func (r *RawMetric) Value() (float64, bool) {
+	switch {
+	case r.metric.Counter != nil:
+		return r.metric.Counter.GetValue(), true
+	case r.metric.Gauge != nil:
+		return r.metric.Gauge.GetValue(), true
+	case r.metric.Untyped != nil:
+		return r.metric.Untyped.GetValue(), true
+	}
+	return 0, false
+}
+
+// SetValue changes the value of a counter, gauge or untyped metric, histograms and summaries are left as is.
+func (r *RawMetric) SetValue(value float64) {
+	switch {
+	case r.metric.Counter != nil:
+		r.metric.Counter.Value = proto.Float64(value)
+	case r.metric.Gauge != nil:
+		r.metric.Gauge.Value = proto.Float64(value)
+	case r.metric.Untyped != nil:
+		r.metric.Untyped.Value = proto.Float64(value)
+	}
+}
+
 func (r *RawMetric) SetOrigin(origin string) {
 	r.origin = origin
 
@@ -131,7 +199,10 @@ func (r *RawMetric) ID() uint64 {
 		if label.GetName() == model.MetricNameLabel {
 			continue
 		}
-		_, _ = xxh.WriteString("$" + label.GetName() + "$" + label.GetValue())
+		_, _ = xxh.WriteString("$")
+		_, _ = xxh.WriteString(label.GetName())
+		_, _ = xxh.WriteString("$")
+		_, _ = xxh.WriteString(label.GetValue())
 		_, _ = xxh.Write(separatorByteSlice)
 	}
 	r.id = xxh.Sum64()
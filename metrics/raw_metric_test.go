@@ -73,4 +73,27 @@ var _ = ginkgo.Describe("RawMetric", func() {
 			gomega.Expect(m1.ID()).ToNot(gomega.Equal(m3.ID()))
 		})
 	})
+
+	ginkgo.Context("SetMetricType", func() {
+		ginkgo.It("should move the value to the new type", func() {
+			m := metrics.NewRawMetric("my_metric", "my-origin", &dto.Metric{
+				Gauge: &dto.Gauge{Value: proto.Float64(3)},
+			})
+
+			m.SetMetricType(dto.MetricType_COUNTER)
+			gomega.Expect(*m.MetricType()).To(gomega.Equal(dto.MetricType_COUNTER))
+			gomega.Expect(m.Metric().Gauge).To(gomega.BeNil())
+			gomega.Expect(m.Metric().GetCounter().GetValue()).To(gomega.Equal(3.0))
+		})
+
+		ginkgo.It("should leave histograms as is", func() {
+			m := metrics.NewRawMetric("my_metric", "my-origin", &dto.Metric{
+				Histogram: &dto.Histogram{SampleCount: proto.Uint64(1)},
+			})
+
+			m.SetMetricType(dto.MetricType_GAUGE)
+			gomega.Expect(*m.MetricType()).To(gomega.Equal(dto.MetricType_HISTOGRAM))
+			gomega.Expect(m.Metric().Gauge).To(gomega.BeNil())
+		})
+	})
 })
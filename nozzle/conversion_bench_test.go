@@ -0,0 +1,135 @@
+package nozzle_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/cloudfoundry/firehose_exporter/nozzle"
+)
+
+const (
+	benchSources           = 256
+	benchBatchSize         = 500
+	benchMaxEnvelopesQueue = 50000
+)
+
+var benchGaugeNames = []string{"cpu", "memory", "disk", "memory_quota", "disk_quota", "cpu_entitlement"}
+
+// blockingStreamConnector gives batches as a real stream would, blocking until one is available.
+type blockingStreamConnector struct {
+	batches chan []*loggregator_v2.Envelope
+}
+
+func (s *blockingStreamConnector) Stream(_ context.Context, _ *loggregator_v2.EgressBatchRequest) loggregator.EnvelopeStream {
+	return func() []*loggregator_v2.Envelope {
+		return <-s.batches
+	}
+}
+
+func benchEnvelopeBatch(offset int) []*loggregator_v2.Envelope {
+	batch := make([]*loggregator_v2.Envelope, benchBatchSize)
+	for i := range batch {
+		source := (offset + i) % benchSources
+		gauges := make(map[string]*loggregator_v2.GaugeValue, len(benchGaugeNames))
+		for _, name := range benchGaugeNames {
+			gauges[name] = &loggregator_v2.GaugeValue{Unit: "bytes", Value: float64(offset + i)}
+		}
+		batch[i] = &loggregator_v2.Envelope{
+			Timestamp:  time.Now().UnixNano(),
+			SourceId:   fmt.Sprintf("6f5a3b7e-0d1c-4b8a-9e2f-%012d", source),
+			InstanceId: "0",
+			Tags: map[string]string{
+				"origin":     "rep",
+				"deployment": "cf",
+				"job":        "diego-cell",
+				"index":      "4e1a5c8f-3d2b-4a6e-8f7c-9b0d1e2f3a4b",
+				"ip":         "10.0.1.4",
+			},
+			Message: &loggregator_v2.Envelope_Gauge{
+				Gauge: &loggregator_v2.Gauge{Metrics: gauges},
+			},
+		}
+	}
+	return batch
+}
+
+func counterTotal(c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	_ = c.Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func benchmarkConversion(b *testing.B, workers int) {
+	pointBuffer := make(chan []*metrics.RawMetric, 4096)
+	var converted atomic.Int64
+	go func() {
+		for points := range pointBuffer {
+			converted.Add(int64(len(points)))
+		}
+	}()
+
+	connector := &blockingStreamConnector{batches: make(chan []*loggregator_v2.Envelope)}
+	n := nozzle.NewNozzle(connector, "firehose_exporter", 0,
+		pointBuffer,
+		internalMetric,
+		nozzle.WithNozzleTimerRollup(time.Second, []string{}, []string{}),
+		nozzle.WithConversionWorkers(workers),
+	)
+	n.Start()
+
+	batches := make([][]*loggregator_v2.Envelope, 16)
+	for i := range batches {
+		batches[i] = benchEnvelopeBatch(i * benchBatchSize)
+	}
+	pointsPerEnvelope := int64(len(benchGaugeNames))
+	droppedEnvelopesBefore := counterTotal(internalMetric.TotalEnvelopesDropped)
+	droppedMetricsBefore := counterTotal(internalMetric.TotalMetricsDropped)
+	done := func() int64 {
+		dropped := (counterTotal(internalMetric.TotalEnvelopesDropped)-droppedEnvelopesBefore)*float64(pointsPerEnvelope) +
+			counterTotal(internalMetric.TotalMetricsDropped) - droppedMetricsBefore
+		return converted.Load() + int64(dropped)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	sent := 0
+	for i := 0; sent < b.N; i++ {
+		// keep ingress buffer from overflowing, conversion throughput is what is measured
+		for int64(sent)*pointsPerEnvelope-done() > benchMaxEnvelopesQueue*pointsPerEnvelope {
+			time.Sleep(100 * time.Microsecond)
+		}
+		batch := batches[i%len(batches)]
+		if remaining := b.N - sent; remaining < len(batch) {
+			batch = batch[:remaining]
+		}
+		connector.batches <- batch
+		sent += len(batch)
+	}
+	for done() < int64(b.N)*pointsPerEnvelope {
+		time.Sleep(100 * time.Microsecond)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "envelopes/s")
+}
+
+func BenchmarkConversion1Worker(b *testing.B) {
+	benchmarkConversion(b, 1)
+}
+
+func BenchmarkConversion4Workers(b *testing.B) {
+	benchmarkConversion(b, 4)
+}
+
+func BenchmarkConversion8Workers(b *testing.B) {
+	benchmarkConversion(b, 8)
+}
@@ -0,0 +1,162 @@
+package nozzle
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cespare/xxhash/v2"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+)
+
+// conversionWorkerQueueSize is the size of the queue of each lane of a worker.
+const conversionWorkerQueueSize = 1024
+
+type laneEnvelope struct {
+	lane     *lane
+	envelope *loggregator_v2.Envelope
+}
+
+type pointBatch struct {
+	points []*metrics.RawMetric
+	size   int
+}
+
+// conversionWorker converts envelopes to points and batches them by lane, envelopes of a source id
+// are always given to the same worker so their points keep the order of envelopes.
+// Each lane has its own queue in the worker, queues are read by priority like lanes.
+type conversionWorker struct {
+	n *Nozzle
+	// queues by lane index
+	queues []chan *loggregator_v2.Envelope
+	// wakes up the worker waiting for envelopes
+	ready chan struct{}
+	// batches by lane index
+	batches     []pointBatch
+	accumulator *counterAccumulator
+}
+
+func newConversionWorker(n *Nozzle) *conversionWorker {
+	queues := make([]chan *loggregator_v2.Envelope, len(n.lanes))
+	for i := range queues {
+		queues[i] = make(chan *loggregator_v2.Envelope, conversionWorkerQueueSize)
+	}
+	return &conversionWorker{
+		n:           n,
+		queues:      queues,
+		ready:       make(chan struct{}, 1),
+		batches:     make([]pointBatch, len(n.lanes)),
+		accumulator: newCounterAccumulator(n.counterExpiration),
+	}
+}
+
+// queue gives the envelope to the worker, it waits while the queue of the lane is full.
+func (w *conversionWorker) queue(le laneEnvelope) {
+	w.queues[le.lane.index] <- le.envelope
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next gives the next queued envelope of the lane with the highest priority.
+func (w *conversionWorker) next() (laneEnvelope, bool) {
+	for _, l := range w.n.lanes {
+		select {
+		case envelope := <-w.queues[l.index]:
+			return laneEnvelope{lane: l, envelope: envelope}, true
+		default:
+		}
+	}
+	return laneEnvelope{}, false
+}
+
+// queued gives the number of envelopes waiting in queues of the worker.
+func (w *conversionWorker) queued() int {
+	queued := 0
+	for _, queue := range w.queues {
+		queued += len(queue)
+	}
+	return queued
+}
+
+func (w *conversionWorker) run() {
+	t := time.NewTicker(BatchFlushInterval)
+	for {
+		select {
+		case now := <-t.C:
+			w.tick(now)
+		default:
+		}
+		le, found := w.next()
+		if !found {
+			select {
+			case <-w.ready:
+			case now := <-t.C:
+				w.tick(now)
+			}
+			continue
+		}
+		batch := &w.batches[le.lane.index]
+		for _, point := range w.n.convertEnvelopeToPoints(le.envelope, w.accumulator) {
+			if w.n.router != nil && !w.n.router.RoutePoint(point) {
+				continue
+			}
+			batch.size += point.EstimateMetricSize()
+			batch.points = append(batch.points, point)
+		}
+		// Do we care if one envelope produces multiple points, in which a
+		// subset crosses the threshold?
+		if batch.size >= MaxBatchSizeInBytes {
+			w.flush(le.lane)
+		}
+	}
+}
+
+func (w *conversionWorker) tick(now time.Time) {
+	w.accumulator.cleanup(now)
+	// lanes are flushed by priority so points of high priority lanes get in first
+	for _, l := range w.n.lanes {
+		if len(w.batches[l.index].points) > 0 {
+			w.flush(l)
+		}
+	}
+}
+
+// flush writes points batched for the lane, they are dropped if points can't be written.
+func (w *conversionWorker) flush(l *lane) {
+	batch := &w.batches[l.index]
+	if w.n.writePoints(batch.points) {
+		batch.points = make([]*metrics.RawMetric, 0, len(batch.points))
+	} else {
+		w.n.internalMetrics.TotalLaneMetricsDropped.WithLabelValues(l.config.Name).Add(float64(len(batch.points)))
+		batch.points = batch.points[:0]
+	}
+	batch.size = 0
+}
+
+// envelopeDispatcher gives buffered envelopes, highest priority lanes first, to conversion workers
+// chosen by source id. It waits for the envelope reader when all lanes are empty, and for a worker
+// when the queue of the lane in the worker is full: envelopes then wait in lane buffers, which are
+// the ones sized for bursts and dropping envelopes when full.
+func (n *Nozzle) envelopeDispatcher() {
+	for {
+		l, envelope, found := n.nextEnvelope()
+		if !found {
+			<-n.ingressReady
+			continue
+		}
+		worker := n.workers[0]
+		if len(n.workers) > 1 {
+			worker = n.workers[xxhash.Sum64String(envelope.GetSourceId())%uint64(len(n.workers))]
+		}
+		worker.queue(laneEnvelope{lane: l, envelope: envelope})
+	}
+}
+
+// notifyIngress wakes up the dispatcher if it waits for envelopes.
+func (n *Nozzle) notifyIngress() {
+	select {
+	case n.ingressReady <- struct{}{}:
+	default:
+	}
+}
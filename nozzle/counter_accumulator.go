@@ -0,0 +1,96 @@
+package nozzle
+
+import (
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cespare/xxhash/v2"
+)
+
+const defaultCounterExpiration = 10 * time.Minute
+
+type accumulatedCounter struct {
+	total     uint64
+	updatedAt time.Time
+}
+
+// counterAccumulator keeps the total of counter series to give one to envelopes only carrying a delta.
+// Envelopes of a source id are always converted by the same worker, each worker has its own accumulator.
+type counterAccumulator struct {
+	expiration   time.Duration
+	counters     map[uint64]*accumulatedCounter
+	lastCleaning time.Time
+}
+
+func newCounterAccumulator(expiration time.Duration) *counterAccumulator {
+	if expiration <= 0 {
+		expiration = defaultCounterExpiration
+	}
+	return &counterAccumulator{
+		expiration:   expiration,
+		counters:     make(map[uint64]*accumulatedCounter),
+		lastCleaning: time.Now(),
+	}
+}
+
+// accumulate sets the total of a counter envelope emitted with only a delta to the sum of deltas of its series.
+// When a series reports a total, it is kept as is and following deltas are added to it.
+func (a *counterAccumulator) accumulate(envelope *loggregator_v2.Envelope, now time.Time) {
+	counter := envelope.GetCounter()
+	key := counterKey(envelope)
+	accumulated, found := a.counters[key]
+	if !found {
+		accumulated = &accumulatedCounter{}
+		a.counters[key] = accumulated
+	}
+	accumulated.updatedAt = now
+
+	switch {
+	case counter.GetTotal() != 0:
+		accumulated.total = counter.GetTotal()
+	case counter.GetDelta() != 0:
+		accumulated.total += counter.GetDelta()
+		counter.Total = accumulated.total
+	case found:
+		// nothing happened since last envelope, series keeps its total
+		counter.Total = accumulated.total
+	}
+}
+
+// cleanup forgets series which were not updated since expiration, it only visits series once per cleaning interval.
+func (a *counterAccumulator) cleanup(now time.Time) {
+	if now.Sub(a.lastCleaning) < min(a.expiration, time.Minute) {
+		return
+	}
+	a.lastCleaning = now
+	for key, accumulated := range a.counters {
+		if now.Sub(accumulated.updatedAt) >= a.expiration {
+			delete(a.counters, key)
+		}
+	}
+}
+
+// counterKey identifies the series of a counter envelope by its source, name and tags.
+func counterKey(envelope *loggregator_v2.Envelope) uint64 {
+	tags := envelope.GetTags()
+	tagNames := make([]string, 0, len(tags))
+	for name := range tags {
+		tagNames = append(tagNames, name)
+	}
+	sort.Strings(tagNames)
+
+	xxh := xxhash.New()
+	_, _ = xxh.WriteString(envelope.GetSourceId())
+	_, _ = xxh.WriteString("%%")
+	_, _ = xxh.WriteString(envelope.GetInstanceId())
+	_, _ = xxh.WriteString("%%")
+	_, _ = xxh.WriteString(envelope.GetCounter().GetName())
+	for _, name := range tagNames {
+		_, _ = xxh.WriteString("%%")
+		_, _ = xxh.WriteString(name)
+		_, _ = xxh.WriteString("=")
+		_, _ = xxh.WriteString(tags[name])
+	}
+	return xxh.Sum64()
+}
@@ -4,6 +4,7 @@ import (
 	"strings"
 
 	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cloudfoundry/firehose_exporter/utils"
 )
 
 type FilterSelectorType int32
@@ -28,6 +29,11 @@ type FilterSelector struct {
 	counterEventDisabled    bool
 	httpStartStopDisabled   bool
 	valueMetricDisabled     bool
+
+	// source ids selectors of a type are scoped to, all sources are selected when empty
+	gaugeSourceIDs   []string
+	counterSourceIDs []string
+	timerSourceIDs   []string
 }
 
 func NewFilterSelector(filterSelectorNames ...string) *FilterSelector {
@@ -101,28 +107,107 @@ func (f *FilterSelector) FiltersByNames(filterSelectorNames ...string) {
 	f.Filters(filterSelectorTypes...)
 }
 
+// FilterGaugeMetrics removes metrics of disabled types from a gauge envelope, it gives the number of removed metrics.
+func (f FilterSelector) FilterGaugeMetrics(envelope *loggregator_v2.Envelope) int {
+	if envelope.GetGauge() == nil || (!f.valueMetricDisabled && !f.containerMetricDisabled) {
+		return 0
+	}
+	metricsGauge := make(map[string]*loggregator_v2.GaugeValue)
+	for name, m := range envelope.GetGauge().Metrics {
+		if f.valueMetricDisabled && !utils.MetricNameIsContainerMetric(name) {
+			continue
+		}
+		if f.containerMetricDisabled && utils.MetricNameIsContainerMetric(name) {
+			continue
+		}
+		metricsGauge[name] = m
+	}
+	disabled := len(envelope.GetGauge().Metrics) - len(metricsGauge)
+	envelope.GetGauge().Metrics = metricsGauge
+	return disabled
+}
+
+// Selects tells if selectors would give the envelope, metrics of gauges may still be filtered by FilterGaugeMetrics.
+func (f FilterSelector) Selects(envelope *loggregator_v2.Envelope) bool {
+	switch envelope.Message.(type) {
+	case *loggregator_v2.Envelope_Gauge:
+		return !f.AllGaugeDisabled() && scopedTo(f.gaugeSourceIDs, envelope.GetSourceId())
+	case *loggregator_v2.Envelope_Counter:
+		return !f.counterEventDisabled && scopedTo(f.counterSourceIDs, envelope.GetSourceId())
+	case *loggregator_v2.Envelope_Timer:
+		return !f.httpStartStopDisabled && scopedTo(f.timerSourceIDs, envelope.GetSourceId())
+	}
+	return false
+}
+
+func scopedTo(sourceIDs []string, sourceID string) bool {
+	if len(sourceIDs) == 0 {
+		return true
+	}
+	for _, scopedSourceID := range sourceIDs {
+		if scopedSourceID == sourceID {
+			return true
+		}
+	}
+	return false
+}
+
+// GaugeSourceIDs only selects gauges (container and value metrics) of the given source ids.
+func (f *FilterSelector) GaugeSourceIDs(sourceIDs ...string) {
+	f.gaugeSourceIDs = sourceIDs
+}
+
+// CounterSourceIDs only selects counter events of the given source ids.
+func (f *FilterSelector) CounterSourceIDs(sourceIDs ...string) {
+	f.counterSourceIDs = sourceIDs
+}
+
+// TimerSourceIDs only selects http start stop of the given source ids.
+func (f *FilterSelector) TimerSourceIDs(sourceIDs ...string) {
+	f.timerSourceIDs = sourceIDs
+}
+
+// ToSelectorTypes gives a selector by enabled type, or one by source id when the type is scoped to source ids.
 func (f *FilterSelector) ToSelectorTypes() []*loggregator_v2.Selector {
 	selectors := make([]*loggregator_v2.Selector, 0)
 	if !f.AllGaugeDisabled() {
-		selectors = append(selectors, &loggregator_v2.Selector{
-			Message: &loggregator_v2.Selector_Gauge{
-				Gauge: &loggregator_v2.GaugeSelector{},
-			},
+		selectors = appendScopedSelectors(selectors, f.gaugeSourceIDs, func() *loggregator_v2.Selector {
+			return &loggregator_v2.Selector{
+				Message: &loggregator_v2.Selector_Gauge{
+					Gauge: &loggregator_v2.GaugeSelector{},
+				},
+			}
 		})
 	}
 	if !f.CounterEventDisabled() {
-		selectors = append(selectors, &loggregator_v2.Selector{
-			Message: &loggregator_v2.Selector_Counter{
-				Counter: &loggregator_v2.CounterSelector{},
-			},
+		selectors = appendScopedSelectors(selectors, f.counterSourceIDs, func() *loggregator_v2.Selector {
+			return &loggregator_v2.Selector{
+				Message: &loggregator_v2.Selector_Counter{
+					Counter: &loggregator_v2.CounterSelector{},
+				},
+			}
 		})
 	}
 	if !f.HTTPStartStopDisabled() {
-		selectors = append(selectors, &loggregator_v2.Selector{
-			Message: &loggregator_v2.Selector_Timer{
-				Timer: &loggregator_v2.TimerSelector{},
-			},
+		selectors = appendScopedSelectors(selectors, f.timerSourceIDs, func() *loggregator_v2.Selector {
+			return &loggregator_v2.Selector{
+				Message: &loggregator_v2.Selector_Timer{
+					Timer: &loggregator_v2.TimerSelector{},
+				},
+			}
 		})
 	}
 	return selectors
 }
+
+func appendScopedSelectors(selectors []*loggregator_v2.Selector, sourceIDs []string, newSelector func() *loggregator_v2.Selector) []*loggregator_v2.Selector {
+	if len(sourceIDs) == 0 {
+		return append(selectors, newSelector())
+	}
+	for _, sourceID := range sourceIDs {
+		selector := newSelector()
+		selector.SourceId = sourceID
+		selectors = append(selectors, selector)
+	}
+	return selectors
+}
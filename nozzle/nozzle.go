@@ -6,22 +6,27 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"code.cloudfoundry.org/go-diodes"
 	"code.cloudfoundry.org/go-loggregator/v8"
 	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cespare/xxhash/v2"
 	"github.com/cloudfoundry/firehose_exporter/metricmaker"
 	"github.com/cloudfoundry/firehose_exporter/metrics"
 	"github.com/cloudfoundry/firehose_exporter/nozzle/rollup"
+	"github.com/cloudfoundry/firehose_exporter/sharding"
 	"github.com/cloudfoundry/firehose_exporter/utils"
+	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	MaxBatchSizeInBytes = 32 * 1024
-	lenGUID             = 36
+	MaxBatchSizeInBytes  = 32 * 1024
+	lenGUID              = 36
+	bufferReportInterval = time.Second
 )
 
 var regexGUID = regexp.MustCompile(`(\{){0,1}[0-9a-fA-F]{8}\-[0-9a-fA-F]{4}\-[0-9a-fA-F]{4}\-[0-9a-fA-F]{4}\-[0-9a-fA-F]{12}(\}){0,1}`)
@@ -33,18 +38,43 @@ type Nozzle struct {
 	s              StreamConnector
 	shardIdshardID string
 	nodeIndex      int
-	ingressBuffer  *diodes.OneToOne
-
-	timerBuffer           *diodes.OneToOne
-	timerRollupBufferSize uint
-	rollupInterval        time.Duration
-	totalRollup           rollup.Rollup
-	durationRollup        rollup.Rollup
-	responseSizeRollup    rollup.Rollup
+	// concurrent streams of the shard group, the logs provider splits envelopes between them
+	streams int
+	// ingress buffers by priority, the last one being the default lane
+	lanes         []*lane
+	priorityLanes []PriorityLane
+	// signaled by envelope reader when envelopes were buffered
+	ingressReady      chan struct{}
+	conversionWorkers int
+	workers           []*conversionWorker
+	// how long totals of delta only counters are kept without envelopes
+	counterExpiration time.Duration
+
+	// timers are written by the envelope batcher and by peers sending timers they don't own
+	timerBuffer                 *diodes.ManyToOne
+	timerPending                atomic.Int64
+	timerRollupBufferSize       uint
+	rollupInterval              time.Duration
+	totalResponseSizeRollupTags []string
+	durationRollupTags          []string
+	// tags common to all rollups, timers with same source id and values for these tags
+	// land in same rollup series
+	timerRoutingTags   []string
+	totalRollup        rollup.Rollup
+	durationRollup     rollup.Rollup
+	responseSizeRollup rollup.Rollup
+	// tags of timers labelling exemplars of rollups
+	timerExemplarLabels []string
+	// trace context tags of timers labelling exemplars of the duration rollup, never in rollup keys
+	timerTraceTags      []string
+	timerExemplarPolicy rollup.ExemplarPolicy
 
 	filterSelector   *FilterSelector
 	filterDeployment *FilterDeployment
 
+	router        *sharding.Router
+	sourceLimiter *SourceLimiter
+
 	pointBuffer chan []*metrics.RawMetric
 }
 
@@ -76,21 +106,54 @@ func NewNozzle(c StreamConnector,
 		pointBuffer:           pointBuffer,
 		filterSelector:        NewFilterSelector(),
 		filterDeployment:      NewFilterDeployment(),
+		ingressReady:          make(chan struct{}, 1),
+		streams:               1,
+		conversionWorkers:     1,
+		counterExpiration:     defaultCounterExpiration,
+		timerExemplarPolicy:   rollup.ExemplarSlowest,
 	}
 
 	for _, o := range opts {
 		o(n)
 	}
 
-	n.timerBuffer = diodes.NewOneToOne(int(n.timerRollupBufferSize), diodes.AlertFunc(func(missed int) {
+	if n.rollupInterval > 0 {
+		// when series are routed to their owner, rollup series are only computed by one instance
+		nodeIndex := strconv.Itoa(n.nodeIndex)
+		if n.router != nil {
+			nodeIndex = ""
+		}
+		// a trace is a single request, a trace tag in rollup keys would give a series to each request
+		n.totalResponseSizeRollupTags = withoutTags(n.totalResponseSizeRollupTags, n.timerTraceTags)
+		n.durationRollupTags = withoutTags(n.durationRollupTags, n.timerTraceTags)
+		durationExemplarLabels := append(withoutTags(n.timerExemplarLabels, n.timerTraceTags), n.timerTraceTags...)
+
+		n.totalRollup = rollup.NewCounterRollup(nodeIndex, n.totalResponseSizeRollupTags,
+			rollup.SetCounterExemplarLabels(n.timerExemplarLabels))
+		n.responseSizeRollup = rollup.NewSummaryRollup(nodeIndex, n.totalResponseSizeRollupTags)
+		n.durationRollup = rollup.NewHistogramRollup(nodeIndex, n.durationRollupTags,
+			rollup.SetHistogramExemplarLabels(durationExemplarLabels),
+			rollup.SetHistogramExemplarPolicy(n.timerExemplarPolicy))
+		n.timerRoutingTags = commonTags(n.totalResponseSizeRollupTags, n.durationRollupTags)
+	}
+
+	n.timerBuffer = diodes.NewManyToOne(int(n.timerRollupBufferSize), diodes.AlertFunc(func(missed int) {
+		n.timerPending.Add(-int64(missed))
 		n.internalMetrics.TotalEnvelopesDropped.Add(float64(missed))
+		n.internalMetrics.TotalDropped.WithLabelValues(metrics.DropStageTimer, metrics.DropReasonBufferFull).Add(float64(missed))
 		log.WithField("count", missed).Info("timer buffer dropped points")
 	}))
 
-	n.ingressBuffer = diodes.NewOneToOne(100000, diodes.AlertFunc(func(missed int) {
-		n.internalMetrics.TotalEnvelopesDropped.Add(float64(missed))
-		log.WithField("count", missed).Info("ingress buffer dropped envelopes")
-	}))
+	n.lanes = make([]*lane, 0, len(n.priorityLanes)+1)
+	for i, priorityLane := range n.priorityLanes {
+		n.lanes = append(n.lanes, newLane(i, priorityLane, internalMetrics))
+	}
+	n.lanes = append(n.lanes, newLane(len(n.priorityLanes), PriorityLane{Name: defaultLaneName}, internalMetrics))
+
+	n.workers = make([]*conversionWorker, max(n.conversionWorkers, 1))
+	for i := range n.workers {
+		n.workers[i] = newConversionWorker(n)
+	}
 
 	return n
 }
@@ -118,71 +181,141 @@ func WithFilterDeployment(filterDeployment *FilterDeployment) Option {
 func WithNozzleTimerRollup(interval time.Duration, totalResponseSizeRollupTags, durationRollupTags []string) Option {
 	return func(n *Nozzle) {
 		n.rollupInterval = interval
+		n.totalResponseSizeRollupTags = totalResponseSizeRollupTags
+		n.durationRollupTags = durationRollupTags
+	}
+}
 
-		nodeIndex := strconv.Itoa(n.nodeIndex)
-		n.totalRollup = rollup.NewCounterRollup(nodeIndex, totalResponseSizeRollupTags)
-		n.responseSizeRollup = rollup.NewSummaryRollup(nodeIndex, totalResponseSizeRollupTags)
-		n.durationRollup = rollup.NewHistogramRollup(nodeIndex, durationRollupTags)
+// WithTimerExemplarLabels gives exemplars to rollups of timers, labelled with these tags of timers
+// (e.g. request_id): the request counter keeps the last request of each series and the duration
+// histogram the slowest request of each bucket since last rollup.
+func WithTimerExemplarLabels(exemplarLabels ...string) Option {
+	return func(n *Nozzle) {
+		n.timerExemplarLabels = exemplarLabels
 	}
 }
 
-// Start() starts reading envelopes from the logs provider and writes them to
-// firehose_exporter.
-func (n *Nozzle) Start() {
-	rx := n.s.Stream(context.Background(), n.buildBatchReq())
+// WithTimerTraceTags labels exemplars of the duration histogram with these trace context tags of timers
+// (e.g. trace_id and span_id which gorouter sets from B3 or W3C headers), to link buckets to traces.
+// Trace tags are removed from rollup tags, they then never split rollup series.
+func WithTimerTraceTags(traceTags ...string) Option {
+	return func(n *Nozzle) {
+		n.timerTraceTags = traceTags
+	}
+}
 
-	go n.timerProcessor()
-	go n.timerEmitter()
-	go n.envelopeReader(rx)
-	go n.pointBatcher()
+// WithTimerExemplarPolicy selects the timer kept as exemplar by each bucket of the duration histogram,
+// it defaults to the slowest one.
+func WithTimerExemplarPolicy(exemplarPolicy rollup.ExemplarPolicy) Option {
+	return func(n *Nozzle) {
+		n.timerExemplarPolicy = exemplarPolicy
+	}
+}
+
+// WithPeerRouter makes each series owned by only one instance of a group of peers, points and
+// timers owned by other peers are sent to them and rollup series don't get the node_index label.
+func WithPeerRouter(router *sharding.Router) Option {
+	return func(n *Nozzle) {
+		n.router = router
+	}
 }
 
-func (n *Nozzle) pointBatcher() {
-	var size int
+// WithPriorityLanes gives their own ingress buffer to envelopes matching lanes, lanes are drained
+// in the given order before envelopes matching no lane.
+func WithPriorityLanes(priorityLanes ...PriorityLane) Option {
+	return func(n *Nozzle) {
+		n.priorityLanes = priorityLanes
+	}
+}
 
-	poller := diodes.NewPoller(n.ingressBuffer)
-	points := make([]*metrics.RawMetric, 0)
+// WithStreams sets the number of streams read concurrently in the shard group, each one has
+// its own connection to the logs provider.
+func WithStreams(streams int) Option {
+	return func(n *Nozzle) {
+		n.streams = streams
+	}
+}
 
-	t := time.NewTimer(BatchFlushInterval)
-	for {
-		data, found := poller.TryNext()
+// WithConversionWorkers sets the number of goroutines converting envelopes to points,
+// envelopes of a source id are always converted by the same worker.
+func WithConversionWorkers(conversionWorkers int) Option {
+	return func(n *Nozzle) {
+		n.conversionWorkers = conversionWorkers
+	}
+}
 
-		if found {
-			for _, point := range n.convertEnvelopeToPoints((*loggregator_v2.Envelope)(data)) {
-				size += point.EstimateMetricSize()
-				points = append(points, point)
-			}
-		}
+// WithCounterExpiration sets how long the total of a counter emitted with only deltas is kept
+// without envelopes, the counter then starts again from zero.
+func WithCounterExpiration(counterExpiration time.Duration) Option {
+	return func(n *Nozzle) {
+		n.counterExpiration = counterExpiration
+	}
+}
 
-		select {
-		case <-t.C:
-			if len(points) > 0 {
-				points = n.writeToChannelOrDiscard(points)
-			}
-			t.Reset(BatchFlushInterval)
-			size = 0
-		default:
-			// Do we care if one envelope produces multiple points, in which a
-			// subset crosses the threshold?
+// WithSourceLimiter samples and rate limits envelopes by source id before they are buffered.
+func WithSourceLimiter(sourceLimiter *SourceLimiter) Option {
+	return func(n *Nozzle) {
+		n.sourceLimiter = sourceLimiter
+	}
+}
 
-			// if len(points) >= BATCH_CHANNEL_SIZE {
-			if size >= MaxBatchSizeInBytes {
-				points = n.writeToChannelOrDiscard(points)
-				t.Reset(BatchFlushInterval)
-				size = 0
+func commonTags(tags, otherTags []string) []string {
+	common := make([]string, 0)
+	for _, tag := range tags {
+		for _, otherTag := range otherTags {
+			if tag == otherTag {
+				common = append(common, tag)
+				break
 			}
+		}
+	}
+	return common
+}
 
-			// this sleep keeps us from hammering an empty channel, which
-			// would otherwise cause us to peg the cpu when there's no work
-			// to be done.
-			if !found {
-				time.Sleep(time.Millisecond)
+// withoutTags gives tags which are not in excludedTags.
+func withoutTags(tags, excludedTags []string) []string {
+	kept := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		excluded := false
+		for _, excludedTag := range excludedTags {
+			if tag == excludedTag {
+				excluded = true
+				break
 			}
 		}
+		if !excluded {
+			kept = append(kept, tag)
+		}
 	}
+	return kept
+}
+
+// Start() starts reading envelopes from the logs provider and writes them to
+// firehose_exporter.
+func (n *Nozzle) Start() {
+	for i := 0; i < max(n.streams, 1); i++ {
+		rx := n.s.Stream(context.Background(), n.buildBatchReq())
+		go n.envelopeReader(rx, n.internalMetrics.TotalStreamEnvelopesReceived.WithLabelValues(strconv.Itoa(i)))
+	}
+
+	go n.timerProcessor()
+	go n.timerEmitter()
+	go n.envelopeDispatcher()
+	for _, worker := range n.workers {
+		go worker.run()
+	}
+	go n.bufferReporter()
 }
 
 func (n *Nozzle) writeToChannelOrDiscard(points []*metrics.RawMetric) []*metrics.RawMetric {
+	if n.writePoints(points) {
+		return make([]*metrics.RawMetric, 0)
+	}
+	return points[:0]
+}
+
+// writePoints tells if points could be written to point buffer, they are counted as dropped otherwise.
+func (n *Nozzle) writePoints(points []*metrics.RawMetric) bool {
 	select {
 	case n.pointBuffer <- points:
 		n.internalMetrics.TotalMetricsReceived.Add(float64(len(points)))
@@ -209,22 +342,35 @@ func (n *Nozzle) writeToChannelOrDiscard(points []*metrics.RawMetric) []*metrics
 				continue
 			}
 		}
-		return make([]*metrics.RawMetric, 0)
+		return true
 	default:
 		// if we can't write into the channel, it must be full, so
 		// we probably need to drop these envelopes on the floor
 		n.internalMetrics.TotalMetricsDropped.Add(float64(len(points)))
-		return points[:0]
+		n.internalMetrics.TotalDropped.WithLabelValues(metrics.DropStageOutput, metrics.DropReasonBufferFull).Add(float64(len(points)))
+		return false
 	}
 }
 
-func (n *Nozzle) envelopeReader(rx loggregator.EnvelopeStream) {
+func (n *Nozzle) envelopeReader(rx loggregator.EnvelopeStream, received prometheus.Counter) {
 	for {
 		envelopeBatch := rx()
+		received.Add(float64(len(envelopeBatch)))
 		for _, envelope := range envelopeBatch {
-			n.ingressBuffer.Set(diodes.GenericDataType(envelope))
 			n.internalMetrics.TotalEnvelopesReceived.Inc()
 			n.internalMetrics.LastEnvelopeReceivedTimestamp.Set(float64(time.Now().Unix()))
+			// stream may not honor selectors scoped to source ids, e.g. the gateway flattens them
+			if !n.filterSelector.Selects(envelope) {
+				n.internalMetrics.TotalDropped.WithLabelValues(metrics.DropStageFilter, metrics.DropReasonNotSelected).Inc()
+				continue
+			}
+			if n.sourceLimiter != nil && !n.sourceLimiter.Allow(envelope.GetSourceId()) {
+				continue
+			}
+			n.laneFor(envelope).set(envelope)
+		}
+		if len(envelopeBatch) > 0 {
+			n.notifyIngress()
 		}
 	}
 }
@@ -234,30 +380,24 @@ func (n *Nozzle) timerProcessor() {
 
 	for {
 		data := poller.Next()
+		n.timerPending.Add(-1)
 		envelope := *(*loggregator_v2.Envelope)(data)
 
 		if envelope.GetSourceId() == "gorouter" && strings.ToLower(envelope.Tags["peer_type"]) == "client" {
 			// gorouter reports both client and server timers for each request,
 			// only record server types
+			n.internalMetrics.TotalDropped.WithLabelValues(metrics.DropStageTimer, metrics.DropReasonGorouterClient).Inc()
 			continue
 		}
 
 		// we skip metric with source_id with a guid (guid means an app) to avoid duplicate with metric from cf_app
 		if envelope.Tags["app_id"] == "" && len(envelope.GetSourceId()) == lenGUID && regexGUID.MatchString(envelope.GetSourceId()) {
+			n.internalMetrics.TotalDropped.WithLabelValues(metrics.DropStageTimer, metrics.DropReasonGUIDSource).Inc()
 			continue
 		}
 
 		timer := envelope.GetTimer()
-		tags := envelope.Tags
-		tags["scheme"] = ""
-		tags["host"] = ""
-		if uri, ok := envelope.GetTags()["uri"]; ok && uri != "" {
-			uri, err := url.Parse(uri)
-			if err == nil {
-				tags["scheme"] = uri.Scheme
-				tags["host"] = uri.Host
-			}
-		}
+		tags := timerTags(&envelope)
 		n.totalRollup.Record(envelope.SourceId, tags, 1)
 		if contentLength, ok := envelope.GetTags()["content_length"]; ok && contentLength != "" {
 			responseSize, err := strconv.Atoi(contentLength)
@@ -313,36 +453,78 @@ func (n *Nozzle) timerEmitter() {
 	}
 }
 
+// timerTags gives tags of the timer envelope completed with scheme and host from uri.
+func timerTags(envelope *loggregator_v2.Envelope) map[string]string {
+	tags := envelope.Tags
+	tags["scheme"] = ""
+	tags["host"] = ""
+	if uri, ok := envelope.GetTags()["uri"]; ok && uri != "" {
+		uri, err := url.Parse(uri)
+		if err == nil {
+			tags["scheme"] = uri.Scheme
+			tags["host"] = uri.Host
+		}
+	}
+	return tags
+}
+
+func (n *Nozzle) timerRoutingKey(envelope *loggregator_v2.Envelope) uint64 {
+	tags := timerTags(envelope)
+	xxh := xxhash.New()
+	_, _ = xxh.WriteString(envelope.GetSourceId())
+	for _, tag := range n.timerRoutingTags {
+		_, _ = xxh.WriteString("%%")
+		_, _ = xxh.WriteString(tags[tag])
+	}
+	return xxh.Sum64()
+}
+
 func (n *Nozzle) captureGorouterHTTPTimerMetricsForRollup(envelope *loggregator_v2.Envelope) {
 	timer := envelope.GetTimer()
 
 	if timer.GetName() != metrics.GorouterHTTPMetricName {
 		return
 	}
+	if n.router != nil && !n.router.RouteEnvelope(n.timerRoutingKey(envelope), envelope) {
+		return
+	}
+
+	n.setTimer(envelope)
+}
 
+func (n *Nozzle) setTimer(envelope *loggregator_v2.Envelope) {
+	n.timerPending.Add(1)
 	n.timerBuffer.Set(diodes.GenericDataType(envelope))
 }
 
-func (n *Nozzle) convertEnvelopeToPoints(envelope *loggregator_v2.Envelope) []*metrics.RawMetric {
+// ReceivePoints takes points owned by this instance sent by a peer.
+func (n *Nozzle) ReceivePoints(points []*metrics.RawMetric) {
+	n.writeToChannelOrDiscard(points)
+}
+
+// ReceiveEnvelopes takes timer envelopes owned by this instance sent by a peer.
+func (n *Nozzle) ReceiveEnvelopes(envelopes []*loggregator_v2.Envelope) {
+	for _, envelope := range envelopes {
+		if envelope.GetTimer().GetName() != metrics.GorouterHTTPMetricName {
+			continue
+		}
+		n.setTimer(envelope)
+	}
+}
+
+func (n *Nozzle) convertEnvelopeToPoints(envelope *loggregator_v2.Envelope, accumulator *counterAccumulator) []*metrics.RawMetric {
 	if n.filterDeployment.IsFiltered(envelope) {
+		n.internalMetrics.TotalDropped.WithLabelValues(metrics.DropStageFilter, metrics.DropReasonDeploymentFiltered).Inc()
 		return []*metrics.RawMetric{}
 	}
 	switch envelope.Message.(type) {
 	case *loggregator_v2.Envelope_Gauge:
-		if !n.filterSelector.ValueMetricDisabled() && !n.filterSelector.ContainerMetricDisabled() {
-			break
-		}
-		metricsGauge := make(map[string]*loggregator_v2.GaugeValue)
-		for name, m := range envelope.GetGauge().Metrics {
-			if n.filterSelector.ValueMetricDisabled() && !utils.MetricNameIsContainerMetric(name) {
-				continue
-			}
-			if n.filterSelector.ContainerMetricDisabled() && utils.MetricNameIsContainerMetric(name) {
-				continue
-			}
-			metricsGauge[name] = m
+		if disabled := n.filterSelector.FilterGaugeMetrics(envelope); disabled > 0 {
+			n.internalMetrics.TotalDropped.WithLabelValues(metrics.DropStageFilter, metrics.DropReasonMetricDisabled).Add(float64(disabled))
 		}
-		envelope.GetGauge().Metrics = metricsGauge
+
+	case *loggregator_v2.Envelope_Counter:
+		accumulator.accumulate(envelope, time.Now())
 
 	case *loggregator_v2.Envelope_Timer:
 		n.captureGorouterHTTPTimerMetricsForRollup(envelope)
@@ -351,6 +533,45 @@ func (n *Nozzle) convertEnvelopeToPoints(envelope *loggregator_v2.Envelope) []*m
 	return metricmaker.NewRawMetricsFromEnvelop(envelope)
 }
 
+// bufferReporter periodically reports how much of each internal buffer is in use.
+func (n *Nozzle) bufferReporter() {
+	ticker := time.NewTicker(bufferReportInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n.reportBufferFill()
+	}
+}
+
+func (n *Nozzle) reportBufferFill() {
+	for _, l := range n.lanes {
+		n.internalMetrics.BufferFillRatio.WithLabelValues("ingress", l.config.Name).Set(l.fillRatio())
+	}
+	n.internalMetrics.BufferFillRatio.WithLabelValues("timer", "").Set(
+		clampedRatio(n.timerPending.Load(), int(n.timerRollupBufferSize)),
+	)
+	var queued int
+	for _, worker := range n.workers {
+		queued += worker.queued()
+	}
+	n.internalMetrics.BufferFillRatio.WithLabelValues("conversion", "").Set(
+		clampedRatio(int64(queued), len(n.workers)*len(n.lanes)*conversionWorkerQueueSize),
+	)
+	if cap(n.pointBuffer) > 0 {
+		n.internalMetrics.BufferFillRatio.WithLabelValues("point", "").Set(
+			clampedRatio(int64(len(n.pointBuffer)), cap(n.pointBuffer)),
+		)
+	}
+}
+
+// clampedRatio gives used/size within [0, 1], counts of items in diodes are approximate.
+func clampedRatio(used int64, size int) float64 {
+	if size <= 0 || used <= 0 {
+		return 0
+	}
+	return min(float64(used)/float64(size), 1)
+}
+
 func (n *Nozzle) buildBatchReq() *loggregator_v2.EgressBatchRequest {
 	return &loggregator_v2.EgressBatchRequest{
 		ShardId:          n.shardIdshardID,
@@ -53,29 +53,27 @@ func (s *spyStreamConnector) Stream(_ context.Context, req *loggregator_v2.Egres
 	defer s.mu.Unlock()
 	s.internalRequests = append(s.internalRequests, req)
 
+	// blocks until envelopes are given like a real stream, spinning nozzles of previous specs
+	// would starve the running one
 	return func() []*loggregator_v2.Envelope {
-		select {
-		case ee := <-s.envelopes:
-			finalEnvelopes := make([]*loggregator_v2.Envelope, 0)
-			for _, e := range ee {
-				wantedType := reflect.TypeOf(&loggregator_v2.Selector_Counter{})
-				switch e.Message.(type) {
-				case *loggregator_v2.Envelope_Gauge:
-					wantedType = reflect.TypeOf(&loggregator_v2.Selector_Gauge{})
-				case *loggregator_v2.Envelope_Timer:
-					wantedType = reflect.TypeOf(&loggregator_v2.Selector_Timer{})
-				}
-				for _, selector := range req.Selectors {
-					if reflect.TypeOf(selector.Message).String() == wantedType.String() {
-						finalEnvelopes = append(finalEnvelopes, e)
-						break
-					}
+		ee := <-s.envelopes
+		finalEnvelopes := make([]*loggregator_v2.Envelope, 0)
+		for _, e := range ee {
+			wantedType := reflect.TypeOf(&loggregator_v2.Selector_Counter{})
+			switch e.Message.(type) {
+			case *loggregator_v2.Envelope_Gauge:
+				wantedType = reflect.TypeOf(&loggregator_v2.Selector_Gauge{})
+			case *loggregator_v2.Envelope_Timer:
+				wantedType = reflect.TypeOf(&loggregator_v2.Selector_Timer{})
+			}
+			for _, selector := range req.Selectors {
+				if reflect.TypeOf(selector.Message).String() == wantedType.String() {
+					finalEnvelopes = append(finalEnvelopes, e)
+					break
 				}
 			}
-			return finalEnvelopes
-		default:
-			return nil
 		}
+		return finalEnvelopes
 	}
 }
 
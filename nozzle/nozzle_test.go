@@ -11,6 +11,7 @@ import (
 	"github.com/gogo/protobuf/proto"
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 
 	"github.com/cloudfoundry/firehose_exporter/nozzle"
@@ -118,6 +119,149 @@ var _ = ginkgo.Describe("Nozzle", func() {
 		}))
 	})
 
+	ginkgo.It("reads concurrent streams of the shard group", func() {
+		streamsPointBuffer := make(chan []*metrics.RawMetric)
+		streamsMetricStore := NewMetricStoreTesting(streamsPointBuffer)
+		streamsConnector := newSpyStreamConnector()
+		streamsNozzle := nozzle.NewNozzle(streamsConnector, "firehose_exporter", 0,
+			streamsPointBuffer,
+			internalMetric,
+			nozzle.WithNozzleTimerRollup(100*time.Millisecond, []string{}, []string{}),
+			nozzle.WithStreams(3),
+		)
+		receivedBefore := 0.0
+		for _, stream := range []string{"0", "1", "2"} {
+			receivedBefore += counterTotal(internalMetric.TotalStreamEnvelopesReceived.WithLabelValues(stream))
+		}
+		streamsNozzle.Start()
+
+		addEnvelope(1, "memory", "some-source-id", streamsConnector)
+		addEnvelope(2, "memory", "other-source-id", streamsConnector)
+		addEnvelope(3, "memory", "another-source-id", streamsConnector)
+
+		gomega.Eventually(streamsMetricStore.GetPoints).Should(gomega.HaveLen(3))
+		requests := streamsConnector.requests()
+		gomega.Expect(requests).To(gomega.HaveLen(3))
+		for _, request := range requests {
+			gomega.Expect(request.ShardId).To(gomega.Equal("firehose_exporter"))
+		}
+		receivedAfter := 0.0
+		for _, stream := range []string{"0", "1", "2"} {
+			receivedAfter += counterTotal(internalMetric.TotalStreamEnvelopesReceived.WithLabelValues(stream))
+		}
+		gomega.Expect(receivedAfter - receivedBefore).To(gomega.Equal(float64(3)))
+	})
+
+	ginkgo.It("keeps envelopes in lanes while a worker is slower than the stream", func() {
+		release := make(chan struct{})
+		metricmaker.PrependMetricConverter(func(*metrics.RawMetric) {
+			<-release
+		})
+		defer metricmaker.SetMetricConverters([]metricmaker.MetricConverter{
+			metricmaker.NormalizeName,
+			metricmaker.OrderAndSanitizeLabels,
+			metricmaker.PresetLabels,
+		})
+		slowPointBuffer := make(chan []*metrics.RawMetric, 1000)
+		slowMetricStore := NewMetricStoreTesting(slowPointBuffer)
+		slowConnector := newSpyStreamConnector()
+		slowNozzle := nozzle.NewNozzle(slowConnector, "firehose_exporter", 0,
+			slowPointBuffer,
+			internalMetric,
+			nozzle.WithNozzleTimerRollup(100*time.Millisecond, []string{}, []string{}),
+		)
+		receivedBefore := counterTotal(internalMetric.TotalEnvelopesReceived)
+		droppedBefore := counterTotal(internalMetric.TotalEnvelopesDropped)
+		slowNozzle.Start()
+
+		envelopes := make([]*loggregator_v2.Envelope, 3000)
+		for i := range envelopes {
+			envelopes[i] = &loggregator_v2.Envelope{
+				SourceId: "slow-source-id",
+				Tags:     map[string]string{},
+				Message: &loggregator_v2.Envelope_Counter{
+					Counter: &loggregator_v2.Counter{Name: "requests", Total: uint64(i + 1)},
+				},
+			}
+		}
+		slowConnector.envelopes <- envelopes
+		gomega.Eventually(func() float64 {
+			return counterTotal(internalMetric.TotalEnvelopesReceived) - receivedBefore
+		}).Should(gomega.Equal(float64(len(envelopes))))
+		// let the dispatcher fill the queue of the worker
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+
+		gomega.Eventually(slowMetricStore.GetPoints, 5*time.Second).Should(gomega.HaveLen(len(envelopes)))
+		gomega.Expect(counterTotal(internalMetric.TotalEnvelopesDropped)).To(gomega.Equal(droppedBefore))
+	})
+
+	ginkgo.Describe("when types are scoped to source ids", func() {
+		ginkgo.BeforeEach(func() {
+			filterSelector.GaugeSourceIDs("rep", "bbs")
+			filterSelector.TimerSourceIDs("gorouter")
+		})
+
+		ginkgo.It("sends a selector by source id for scoped types", func() {
+			gomega.Eventually(streamConnector.requests).Should(gomega.HaveLen(1))
+			gomega.Expect(streamConnector.requests()[0].Selectors).To(gomega.ConsistOf(
+				[]*loggregator_v2.Selector{
+					{
+						SourceId: "rep",
+						Message: &loggregator_v2.Selector_Gauge{
+							Gauge: &loggregator_v2.GaugeSelector{},
+						},
+					},
+					{
+						SourceId: "bbs",
+						Message: &loggregator_v2.Selector_Gauge{
+							Gauge: &loggregator_v2.GaugeSelector{},
+						},
+					},
+					{
+						Message: &loggregator_v2.Selector_Counter{
+							Counter: &loggregator_v2.CounterSelector{},
+						},
+					},
+					{
+						SourceId: "gorouter",
+						Message: &loggregator_v2.Selector_Timer{
+							Timer: &loggregator_v2.TimerSelector{},
+						},
+					},
+				},
+			))
+		})
+
+		ginkgo.It("drops envelopes of scoped types from other source ids", func() {
+			notSelected := internalMetric.TotalDropped.WithLabelValues(metrics.DropStageFilter, metrics.DropReasonNotSelected)
+			before := counterTotal(notSelected)
+			gauge := func(sourceID string) *loggregator_v2.Envelope {
+				return &loggregator_v2.Envelope{
+					SourceId: sourceID,
+					Tags:     map[string]string{},
+					Message: &loggregator_v2.Envelope_Gauge{
+						Gauge: &loggregator_v2.Gauge{Metrics: map[string]*loggregator_v2.GaugeValue{
+							"latency": {Unit: "ms", Value: 1},
+						}},
+					},
+				}
+			}
+			// e.g. the gateway sends gauges of gorouter as it is selected for timers
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{gauge("gorouter"), gauge("rep")}
+			addEnvelope(1, "requests", "gorouter", streamConnector)
+
+			gomega.Eventually(metricStore.GetPoints).Should(gomega.HaveLen(2))
+			gomega.Consistently(metricStore.GetPoints, 200*time.Millisecond).Should(gomega.HaveLen(2))
+			sourceIDs := make(map[string]string)
+			for _, point := range metricStore.GetPoints() {
+				sourceIDs[point.MetricName()] = transform.LabelPairsToLabelsMap(point.Metric().GetLabel())["source_id"]
+			}
+			gomega.Expect(sourceIDs).To(gomega.Equal(map[string]string{"latency": "rep", "requests": "gorouter"}))
+			gomega.Expect(counterTotal(notSelected)).To(gomega.Equal(before + 1))
+		})
+	})
+
 	ginkgo.Describe("when the envelope is a Counter", func() {
 		ginkgo.It("converts the envelope to a Point", func() {
 			streamConnector.envelopes <- []*loggregator_v2.Envelope{
@@ -140,6 +284,59 @@ var _ = ginkgo.Describe("Nozzle", func() {
 			gomega.Expect(point.Metric().Counter.GetValue()).To(gomega.Equal(float64(8)))
 			gomega.Expect(transform.LabelPairsToLabelsMap(point.Metric().Label)).To(gomega.HaveKeyWithValue("source_id", "source-id"))
 		})
+
+		ginkgo.It("accumulates deltas of counters emitted without total", func() {
+			counter := func(instanceID string, delta, total uint64) *loggregator_v2.Envelope {
+				return &loggregator_v2.Envelope{
+					SourceId:   "source-id",
+					InstanceId: instanceID,
+					Tags:       map[string]string{},
+					Message: &loggregator_v2.Envelope_Counter{
+						Counter: &loggregator_v2.Counter{Name: "requests", Delta: delta, Total: total},
+					},
+				}
+			}
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{
+				counter("0", 2, 0),
+				counter("1", 5, 0),
+				counter("0", 3, 0),
+				counter("0", 0, 0),
+				// source switching to totals then back to deltas
+				counter("0", 4, 10),
+				counter("0", 1, 0),
+			}
+
+			gomega.Eventually(metricStore.GetPoints).Should(gomega.HaveLen(6))
+			values := make([]float64, 0)
+			for _, point := range metricStore.GetPoints() {
+				values = append(values, point.Metric().GetCounter().GetValue())
+			}
+			gomega.Expect(values).To(gomega.Equal([]float64{2, 5, 5, 5, 10, 11}))
+		})
+
+		ginkgo.It("adds deltas onto the last total of sources mixing totals and deltas", func() {
+			counter := func(delta, total uint64) *loggregator_v2.Envelope {
+				return &loggregator_v2.Envelope{
+					SourceId: "source-id",
+					Tags:     map[string]string{},
+					Message: &loggregator_v2.Envelope_Counter{
+						Counter: &loggregator_v2.Counter{Name: "mixed_requests", Delta: delta, Total: total},
+					},
+				}
+			}
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{
+				counter(0, 10),
+				counter(1, 0),
+				counter(1, 12),
+			}
+
+			gomega.Eventually(metricStore.GetPoints).Should(gomega.HaveLen(3))
+			values := make([]float64, 0)
+			for _, point := range metricStore.GetPoints() {
+				values = append(values, point.Metric().GetCounter().GetValue())
+			}
+			gomega.Expect(values).To(gomega.Equal([]float64{10, 11, 12}))
+		})
 	})
 
 	ginkgo.It("forwards all tags", func() {
@@ -286,7 +483,9 @@ var _ = ginkgo.Describe("Nozzle", func() {
 	})
 
 	ginkgo.Context("filter deployment", func() {
+		var droppedBefore float64
 		ginkgo.BeforeEach(func() {
+			droppedBefore = counterTotal(deploymentFilteredDropped())
 			filterDeployment.SetDeployments("cf", "bosh")
 			streamConnector.envelopes <- []*loggregator_v2.Envelope{
 				{
@@ -351,5 +550,34 @@ var _ = ginkgo.Describe("Nozzle", func() {
 			gomega.Expect(point2.Metric().Gauge.GetValue()).To(gomega.Equal(float64(1)))
 			gomega.Expect(transform.LabelPairsToLabelsMap(point2.Metric().Label)).To(gomega.HaveKeyWithValue("source_id", "source-id"))
 		})
+
+		ginkgo.It("counts envelopes from other deployments as dropped", func() {
+			gomega.Eventually(func() float64 {
+				return counterTotal(deploymentFilteredDropped()) - droppedBefore
+			}).Should(gomega.Equal(float64(1)))
+		})
+	})
+
+	ginkgo.Context("when the point buffer is full", func() {
+		ginkgo.It("counts discarded metrics as dropped", func() {
+			dropped := internalMetric.TotalDropped.WithLabelValues(metrics.DropStageOutput, metrics.DropReasonBufferFull)
+			droppedBefore := counterTotal(dropped)
+			// nothing reads from this buffer, every batch is discarded
+			fullNozzle := nozzle.NewNozzle(streamConnector, "firehose_exporter", 0,
+				make(chan []*metrics.RawMetric),
+				internalMetric,
+			)
+
+			fullNozzle.ReceivePoints([]*metrics.RawMetric{
+				metricmaker.NewRawMetricCounter("a_counter", map[string]string{}, 1),
+				metricmaker.NewRawMetricCounter("b_counter", map[string]string{}, 1),
+			})
+
+			gomega.Expect(counterTotal(dropped) - droppedBefore).To(gomega.Equal(float64(2)))
+		})
 	})
 })
+
+func deploymentFilteredDropped() prometheus.Counter {
+	return internalMetric.TotalDropped.WithLabelValues(metrics.DropStageFilter, metrics.DropReasonDeploymentFiltered)
+}
@@ -0,0 +1,115 @@
+package nozzle_test
+
+import (
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"github.com/cloudfoundry/firehose_exporter/nozzle"
+	"github.com/cloudfoundry/firehose_exporter/sharding"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+type peerReceiver struct {
+	mu     sync.Mutex
+	points []*metrics.RawMetric
+}
+
+func (r *peerReceiver) ReceivePoints(points []*metrics.RawMetric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.points = append(r.points, points...)
+}
+
+func (r *peerReceiver) ReceiveEnvelopes(_ []*loggregator_v2.Envelope) {}
+
+func (r *peerReceiver) Points() []*metrics.RawMetric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*metrics.RawMetric{}, r.points...)
+}
+
+var _ = ginkgo.Describe("when series are routed to peers", func() {
+	var (
+		streamConnector *spyStreamConnector
+		noz             *nozzle.Nozzle
+		pointBuffer     chan []*metrics.RawMetric
+		metricStore     *MetricStoreTesting
+		receiver        *peerReceiver
+		peer            *httptest.Server
+		router          *sharding.Router
+	)
+
+	ginkgo.BeforeEach(func() {
+		pointBuffer = make(chan []*metrics.RawMetric)
+		metricStore = NewMetricStoreTesting(pointBuffer)
+		streamConnector = newSpyStreamConnector()
+		receiver = &peerReceiver{}
+		peer = httptest.NewServer(sharding.NewPeerHandler(receiver, internalMetric))
+
+		var err error
+		router, err = sharding.NewRouter(
+			[]string{"http://self.local", peer.URL},
+			0,
+			internalMetric,
+			sharding.WithRouterBatch(100, 10*time.Millisecond),
+		)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		router.Start()
+
+		noz = nozzle.NewNozzle(streamConnector, "firehose_exporter", 0,
+			pointBuffer,
+			internalMetric,
+			nozzle.WithNozzleTimerRollup(
+				100*time.Millisecond,
+				[]string{"tag1", "tag2", "status_code"},
+				[]string{"tag1", "tag2"},
+			),
+			nozzle.WithPeerRouter(router),
+		)
+		go noz.Start()
+	})
+
+	ginkgo.AfterEach(func() {
+		peer.Close()
+	})
+
+	ginkgo.It("keeps only owned points and sends others to their owner", func() {
+		sourceIDs := []string{"source-a", "source-b", "source-c", "source-d", "source-e", "source-f", "source-g", "source-h"}
+		for _, sourceID := range sourceIDs {
+			addEnvelope(1, "counter", sourceID, streamConnector)
+		}
+
+		gomega.Eventually(func() int {
+			return len(metricStore.GetPoints()) + len(receiver.Points())
+		}).Should(gomega.Equal(len(sourceIDs)))
+		gomega.Expect(metricStore.GetPoints()).ToNot(gomega.BeEmpty())
+		gomega.Expect(receiver.Points()).ToNot(gomega.BeEmpty())
+		for _, point := range metricStore.GetPoints() {
+			gomega.Expect(router.Owner(point.ID())).To(gomega.Equal(0))
+		}
+		for _, point := range receiver.Points() {
+			gomega.Expect(router.Owner(point.ID())).To(gomega.Equal(1))
+		}
+	})
+
+	ginkgo.It("rolls up timers received from peers without node_index", func() {
+		noz.ReceiveEnvelopes([]*loggregator_v2.Envelope{
+			{
+				SourceId: "source-id",
+				Message: &loggregator_v2.Envelope_Timer{
+					Timer: &loggregator_v2.Timer{Name: "http", Start: 0, Stop: int64(time.Millisecond)},
+				},
+				Tags: map[string]string{"tag1": "t1", "tag2": "t2", "status_code": "200"},
+			},
+		})
+
+		gomega.Eventually(metricStore.GetPoints).ShouldNot(gomega.BeEmpty())
+		for _, label := range metricStore.GetPoints()[0].Metric().GetLabel() {
+			gomega.Expect(label.GetName()).ToNot(gomega.Equal("node_index"))
+		}
+	})
+})
@@ -0,0 +1,122 @@
+package nozzle
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"code.cloudfoundry.org/go-diodes"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	log "github.com/sirupsen/logrus"
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	defaultLaneName       = "default"
+	defaultLaneBufferSize = 100000
+)
+
+// PriorityLane gathers envelopes matching one of its origins or deployments in a buffer of its own,
+// lanes are drained in their order and envelopes matching no lane go in the default lane, drained last.
+type PriorityLane struct {
+	Name        string   `yaml:"name"`
+	Origins     []string `yaml:"origins"`
+	Deployments []string `yaml:"deployments"`
+	BufferSize  int      `yaml:"buffer_size"`
+}
+
+func (l PriorityLane) match(envelope *loggregator_v2.Envelope) bool {
+	tags := envelope.GetTags()
+	for _, origin := range l.Origins {
+		if tags["origin"] == origin {
+			return true
+		}
+	}
+	for _, deployment := range l.Deployments {
+		if tags["deployment"] == deployment {
+			return true
+		}
+	}
+	return false
+}
+
+func LoadPriorityLanes(path string) ([]PriorityLane, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lanes := make([]PriorityLane, 0)
+	if err := yaml.Unmarshal(content, &lanes); err != nil {
+		return nil, fmt.Errorf("could not parse priority lanes file %s: %w", path, err)
+	}
+	names := map[string]bool{defaultLaneName: true}
+	for i, lane := range lanes {
+		if lane.Name == "" || names[lane.Name] {
+			return nil, fmt.Errorf("priority lane %d: name must be set, unique and not %s", i, defaultLaneName)
+		}
+		names[lane.Name] = true
+		if lane.BufferSize < 0 {
+			return nil, fmt.Errorf("priority lane %s: buffer_size must not be negative", lane.Name)
+		}
+	}
+	return lanes, nil
+}
+
+// lane holds buffered envelopes of a priority lane, envelopes are set by the reader of each stream.
+type lane struct {
+	index  int
+	config PriorityLane
+	buffer *diodes.ManyToOne
+	// envelopes set minus envelopes read or overwritten, diodes don't tell their length
+	pending atomic.Int64
+}
+
+func newLane(index int, config PriorityLane, internalMetrics *metrics.InternalMetrics) *lane {
+	if config.BufferSize == 0 {
+		config.BufferSize = defaultLaneBufferSize
+	}
+	l := &lane{
+		index:  index,
+		config: config,
+	}
+	l.buffer = diodes.NewManyToOne(config.BufferSize, diodes.AlertFunc(func(missed int) {
+		l.pending.Add(-int64(missed))
+		internalMetrics.TotalEnvelopesDropped.Add(float64(missed))
+		internalMetrics.TotalDropped.WithLabelValues(metrics.DropStageIngress, metrics.DropReasonBufferFull).Add(float64(missed))
+		internalMetrics.TotalLaneEnvelopesDropped.WithLabelValues(config.Name).Add(float64(missed))
+		log.WithField("count", missed).WithField("lane", config.Name).Info("ingress buffer dropped envelopes")
+	}))
+	return l
+}
+
+func (l *lane) set(envelope *loggregator_v2.Envelope) {
+	l.pending.Add(1)
+	l.buffer.Set(diodes.GenericDataType(envelope))
+}
+
+// fillRatio gives the part of the buffer in use.
+func (l *lane) fillRatio() float64 {
+	return clampedRatio(l.pending.Load(), l.config.BufferSize)
+}
+
+// laneFor gives the first lane matching the envelope, default lane is given when none match.
+func (n *Nozzle) laneFor(envelope *loggregator_v2.Envelope) *lane {
+	for _, l := range n.lanes[:len(n.lanes)-1] {
+		if l.config.match(envelope) {
+			return l
+		}
+	}
+	return n.lanes[len(n.lanes)-1]
+}
+
+// nextEnvelope gives the next buffered envelope of the lane with the highest priority.
+func (n *Nozzle) nextEnvelope() (*lane, *loggregator_v2.Envelope, bool) {
+	for _, l := range n.lanes {
+		if data, found := l.buffer.TryNext(); found {
+			l.pending.Add(-1)
+			return l, (*loggregator_v2.Envelope)(data), true
+		}
+	}
+	return nil, nil, false
+}
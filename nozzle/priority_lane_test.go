@@ -0,0 +1,118 @@
+package nozzle_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/firehose_exporter/nozzle"
+)
+
+func counterEnvelope(name, origin, deployment string) *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		SourceId: origin,
+		Tags: map[string]string{
+			"origin":     origin,
+			"deployment": deployment,
+		},
+		Message: &loggregator_v2.Envelope_Counter{
+			Counter: &loggregator_v2.Counter{Name: name, Total: 1},
+		},
+	}
+}
+
+func pointOrigins(points []*metrics.RawMetric) []string {
+	origins := make([]string, len(points))
+	for i, point := range points {
+		origins[i] = point.Origin()
+	}
+	return origins
+}
+
+var _ = ginkgo.Describe("when envelopes are sorted in priority lanes", func() {
+	ginkgo.It("writes points of priority lanes first", func() {
+		// lanes are written one after the other, buffer is needed to not drop them
+		pointBuffer := make(chan []*metrics.RawMetric, 10)
+		metricStore := NewMetricStoreTesting(pointBuffer)
+		streamConnector := newSpyStreamConnector()
+		n := nozzle.NewNozzle(streamConnector, "firehose_exporter", 0,
+			pointBuffer,
+			internalMetric,
+			nozzle.WithNozzleTimerRollup(
+				100*time.Millisecond,
+				[]string{"tag1", "tag2", "status_code"},
+				[]string{"tag1", "tag2"},
+			),
+			nozzle.WithPriorityLanes(
+				nozzle.PriorityLane{Name: "platform", Origins: []string{"bbs"}, Deployments: []string{"cf"}},
+				nozzle.PriorityLane{Name: "services", Deployments: []string{"mysql"}},
+			),
+		)
+		go n.Start()
+
+		streamConnector.envelopes <- []*loggregator_v2.Envelope{
+			counterEnvelope("app_counter", "app", "apps"),
+			counterEnvelope("mysql_counter", "mysql", "mysql"),
+			counterEnvelope("rep_counter", "rep", "cf"),
+			counterEnvelope("bbs_counter", "bbs", "diego"),
+		}
+
+		gomega.Eventually(metricStore.GetPoints).Should(gomega.HaveLen(4))
+		origins := pointOrigins(metricStore.GetPoints())
+		gomega.Expect(origins[:2]).To(gomega.ConsistOf("rep", "bbs"))
+		gomega.Expect(origins[2:]).To(gomega.Equal([]string{"mysql", "app"}))
+	})
+})
+
+var _ = ginkgo.Describe("LoadPriorityLanes", func() {
+	var dir, path string
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "lanes")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		path = filepath.Join(dir, "lanes.yml")
+	})
+
+	ginkgo.AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	ginkgo.It("should load lanes in order", func() {
+		gomega.Expect(os.WriteFile(path, []byte(`
+- name: platform
+  origins: [rep, bbs]
+  buffer_size: 20000
+- name: services
+  deployments: [mysql]
+`), 0o600)).To(gomega.Succeed())
+
+		lanes, err := nozzle.LoadPriorityLanes(path)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(lanes).To(gomega.Equal([]nozzle.PriorityLane{
+			{Name: "platform", Origins: []string{"rep", "bbs"}, BufferSize: 20000},
+			{Name: "services", Deployments: []string{"mysql"}},
+		}))
+	})
+
+	ginkgo.It("should refuse lanes without unique name", func() {
+		gomega.Expect(os.WriteFile(path, []byte(`
+- name: platform
+- name: platform
+`), 0o600)).To(gomega.Succeed())
+
+		_, err := nozzle.LoadPriorityLanes(path)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should refuse a lane named as the default lane", func() {
+		gomega.Expect(os.WriteFile(path, []byte(`- name: default`), 0o600)).To(gomega.Succeed())
+
+		_, err := nozzle.LoadPriorityLanes(path)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})
@@ -8,6 +8,8 @@ import (
 	"github.com/cloudfoundry/firehose_exporter/metrics"
 	"github.com/cloudfoundry/firehose_exporter/transform"
 	"github.com/gogo/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var (
@@ -20,6 +22,11 @@ type CounterRollup struct {
 	countersInInterval *sync.Map
 	counters           *sync.Map
 	keyCleaningTime    *sync.Map
+	// time of the first event of each counter, exposed as created timestamp
+	createdAt *sync.Map
+	// tags of events labelling the exemplar of each counter, which is its last event
+	exemplarLabels []string
+	exemplars      *sync.Map
 
 	metricExpireIn        time.Duration
 	cleanPeriodicDuration time.Duration
@@ -34,6 +41,13 @@ func SetCounterCleaning(metricExpireIn time.Duration, cleanPeriodicDuration time
 	}
 }
 
+// SetCounterExemplarLabels makes each counter keep its last event as exemplar, labelled with these tags of the event.
+func SetCounterExemplarLabels(exemplarLabels []string) CounterOpt {
+	return func(r *CounterRollup) {
+		r.exemplarLabels = exemplarLabels
+	}
+}
+
 func NewCounterRollup(nodeIndex string, rollupTags []string, opts ...CounterOpt) *CounterRollup {
 	cr := &CounterRollup{
 		nodeIndex:             nodeIndex,
@@ -43,6 +57,8 @@ func NewCounterRollup(nodeIndex string, rollupTags []string, opts ...CounterOpt)
 		metricExpireIn:        2 * time.Hour,
 		cleanPeriodicDuration: 10 * time.Minute,
 		keyCleaningTime:       &sync.Map{},
+		createdAt:             &sync.Map{},
+		exemplars:             &sync.Map{},
 	}
 	for _, opt := range opts {
 		opt(cr)
@@ -67,6 +83,8 @@ func (r *CounterRollup) CleanPeriodic() {
 			r.keyCleaningTime.Delete(key)
 			r.counters.Delete(key)
 			r.countersInInterval.Delete(key)
+			r.createdAt.Delete(key)
+			r.exemplars.Delete(key)
 		}
 	}
 }
@@ -76,12 +94,18 @@ func (r *CounterRollup) Record(sourceID string, tags map[string]string, value in
 
 	r.countersInInterval.Store(key, struct{}{})
 
+	now := time.Now()
 	previousValue, ok := r.counters.Load(key)
 	if ok {
 		value = previousValue.(int64) + value
+	} else {
+		r.createdAt.Store(key, now)
 	}
 	r.counters.Store(key, value)
-	r.keyCleaningTime.Store(key, time.Now())
+	r.keyCleaningTime.Store(key, now)
+	if exemplar := exemplarFromTags(r.exemplarLabels, tags, 1, now); exemplar != nil {
+		r.exemplars.Store(key, exemplar)
+	}
 }
 
 func (r *CounterRollup) Rollup(timestamp int64) []*PointsBatch {
@@ -95,6 +119,12 @@ func (r *CounterRollup) Rollup(timestamp int64) []*PointsBatch {
 		value, _ := r.counters.Load(k)
 		metric := metricmaker.NewRawMetricCounter(metrics.GorouterHTTPCounterMetricName, labels, float64(value.(int64)))
 		metric.Metric().TimestampMs = proto.Int64(transform.NanosecondsToMilliseconds(timestamp))
+		if createdAt, ok := r.createdAt.Load(k); ok {
+			metric.Metric().Counter.CreatedTimestamp = timestamppb.New(createdAt.(time.Time))
+		}
+		if exemplar, ok := r.exemplars.Load(k); ok {
+			metric.Metric().Counter.Exemplar = exemplar.(*dto.Exemplar)
+		}
 		batches = append(batches, &PointsBatch{
 			Points: []*metrics.RawMetric{metric},
 			Size:   metric.EstimateMetricSize(),
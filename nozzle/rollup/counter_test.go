@@ -1,10 +1,12 @@
 package rollup_test
 
 import (
+	"strings"
 	"time"
 
 	"github.com/cloudfoundry/firehose_exporter/metrics"
 	"github.com/cloudfoundry/firehose_exporter/nozzle/rollup"
+	"github.com/cloudfoundry/firehose_exporter/transform"
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
 )
@@ -128,6 +130,53 @@ var _ = ginkgo.Describe("Counter Rollup", func() {
 		gomega.Expect(*points[0].Metric().Counter.Value).To(gomega.BeNumerically("==", float64(2)))
 	})
 
+	ginkgo.It("keeps the time of the first event as created timestamp", func() {
+		counterRollup := rollup.NewCounterRollup("0", nil)
+
+		before := time.Now()
+		counterRollup.Record("source-id", nil, 1)
+		points := extract(counterRollup.Rollup(0))
+		created := points[0].Metric().Counter.GetCreatedTimestamp().AsTime()
+		gomega.Expect(created).To(gomega.BeTemporally(">=", before))
+
+		counterRollup.Record("source-id", nil, 1)
+		points = extract(counterRollup.Rollup(1))
+		gomega.Expect(points[0].Metric().Counter.GetCreatedTimestamp().AsTime()).To(gomega.Equal(created))
+	})
+
+	ginkgo.It("keeps the last event of each counter as exemplar", func() {
+		counterRollup := rollup.NewCounterRollup(
+			"0",
+			[]string{"included-tag"},
+			rollup.SetCounterExemplarLabels([]string{"request_id", "vcap_request_id"}),
+		)
+
+		counterRollup.Record("source-id", map[string]string{"included-tag": "foo", "request_id": "req-1"}, 1)
+		counterRollup.Record("source-id", map[string]string{"included-tag": "foo", "request_id": "req-2"}, 1)
+		counterRollup.Record("source-id", map[string]string{"included-tag": "bar"}, 1)
+
+		points := extract(counterRollup.Rollup(0))
+		gomega.Expect(points).To(gomega.HaveLen(2))
+		for _, point := range points {
+			exemplar := point.Metric().Counter.GetExemplar()
+			if transform.LabelPairsToLabelsMap(point.Metric().Label)["included_tag"] == "bar" {
+				gomega.Expect(exemplar).To(gomega.BeNil())
+				continue
+			}
+			gomega.Expect(transform.LabelPairsToLabelsMap(exemplar.GetLabel())).To(gomega.Equal(map[string]string{"request_id": "req-2"}))
+			gomega.Expect(exemplar.GetValue()).To(gomega.Equal(1.0))
+		}
+	})
+
+	ginkgo.It("drops exemplars too long for OpenMetrics", func() {
+		counterRollup := rollup.NewCounterRollup("0", nil, rollup.SetCounterExemplarLabels([]string{"request_id"}))
+
+		counterRollup.Record("source-id", map[string]string{"request_id": strings.Repeat("a", 128)}, 1)
+
+		points := extract(counterRollup.Rollup(0))
+		gomega.Expect(points[0].Metric().Counter.GetExemplar()).To(gomega.BeNil())
+	})
+
 	ginkgo.Context("CleanPeriodic", func() {
 		ginkgo.It("should clean metrics after amount of time", func() {
 			counterRollup := rollup.NewCounterRollup(
@@ -1,6 +1,8 @@
 package rollup
 
 import (
+	"math"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,12 +14,26 @@ import (
 	dto "github.com/prometheus/client_model/go"
 )
 
+// ExemplarPolicy selects which event of a bucket since last rollup is the exemplar of this bucket.
+type ExemplarPolicy string
+
+const (
+	// ExemplarSlowest keeps the slowest event of each bucket, e.g. to find out the worst requests of a latency spike.
+	ExemplarSlowest ExemplarPolicy = "slowest"
+	// ExemplarLatest keeps the most recent event of each bucket, e.g. to link buckets to recent traces.
+	ExemplarLatest ExemplarPolicy = "latest"
+)
+
 type HistogramRollup struct {
 	nodeIndex            string
 	rollupTags           []string
 	histogramsInInterval *sync.Map
 	histograms           *sync.Map
 	keyCleaningTime      *sync.Map
+	// tags of events labelling exemplars of buckets, exemplars are chosen by policy
+	exemplarLabels []string
+	exemplarPolicy ExemplarPolicy
+	exemplars      *sync.Map
 
 	metricExpireIn        time.Duration
 	cleanPeriodicDuration time.Duration
@@ -32,6 +48,21 @@ func SetHistogramCleaning(metricExpireIn time.Duration, cleanPeriodicDuration ti
 	}
 }
 
+// SetHistogramExemplarLabels makes each bucket keep one of its events since last rollup as exemplar, labelled with
+// these tags of the event. A bucket without event since last rollup keeps its previous exemplar.
+func SetHistogramExemplarLabels(exemplarLabels []string) HistogramOpt {
+	return func(r *HistogramRollup) {
+		r.exemplarLabels = exemplarLabels
+	}
+}
+
+// SetHistogramExemplarPolicy selects the event kept as exemplar by each bucket, it defaults to ExemplarSlowest.
+func SetHistogramExemplarPolicy(exemplarPolicy ExemplarPolicy) HistogramOpt {
+	return func(r *HistogramRollup) {
+		r.exemplarPolicy = exemplarPolicy
+	}
+}
+
 func NewHistogramRollup(nodeIndex string, rollupTags []string, opts ...HistogramOpt) *HistogramRollup {
 	hr := &HistogramRollup{
 		nodeIndex:             nodeIndex,
@@ -41,6 +72,8 @@ func NewHistogramRollup(nodeIndex string, rollupTags []string, opts ...Histogram
 		metricExpireIn:        2 * time.Hour,
 		cleanPeriodicDuration: 10 * time.Minute,
 		keyCleaningTime:       &sync.Map{},
+		exemplarPolicy:        ExemplarSlowest,
+		exemplars:             &sync.Map{},
 	}
 
 	for _, opt := range opts {
@@ -67,6 +100,7 @@ func (r *HistogramRollup) CleanPeriodic() {
 			r.keyCleaningTime.Delete(key)
 			r.histograms.Delete(key)
 			r.histogramsInInterval.Delete(key)
+			r.exemplars.Delete(key)
 		}
 	}
 }
@@ -82,10 +116,17 @@ func (r *HistogramRollup) Record(sourceID string, tags map[string]string, value
 		r.histograms.Store(key, histo)
 	}
 
-	histo.(prometheus.Histogram).Observe(transform.NanosecondsToSeconds(value))
+	seconds := transform.NanosecondsToSeconds(value)
+	histo.(prometheus.Histogram).Observe(seconds)
+
+	now := time.Now()
+	if exemplar := exemplarFromTags(r.exemplarLabels, tags, seconds, now); exemplar != nil {
+		exemplars, _ := r.exemplars.LoadOrStore(key, newBucketExemplars(r.exemplarPolicy == ExemplarLatest))
+		exemplars.(*bucketExemplars).observe(exemplar)
+	}
 
 	r.histogramsInInterval.Store(key, struct{}{})
-	r.keyCleaningTime.Store(key, time.Now())
+	r.keyCleaningTime.Store(key, now)
 }
 
 func (r *HistogramRollup) Rollup(timestamp int64) []*PointsBatch {
@@ -100,6 +141,9 @@ func (r *HistogramRollup) Rollup(timestamp int64) []*PointsBatch {
 		histo, _ := r.histograms.Load(k)
 		_ = histo.(prometheus.Histogram).Write(m)
 		m.Label = transform.LabelsMapToLabelPairs(labels)
+		if exemplars, ok := r.exemplars.Load(k); ok {
+			exemplars.(*bucketExemplars).rollup(m.Histogram)
+		}
 
 		metric := metricmaker.NewRawMetricFromMetric(metrics.GorouterHTTPHistogramMetricName, m)
 		metric.Metric().TimestampMs = proto.Int64(transform.NanosecondsToMilliseconds(timestamp))
@@ -113,3 +157,52 @@ func (r *HistogramRollup) Rollup(timestamp int64) []*PointsBatch {
 
 	return batches
 }
+
+// bucketExemplars keeps an exemplar by bucket of default buckets, the last one being the +Inf bucket.
+type bucketExemplars struct {
+	mu        sync.Mutex
+	exemplars []*dto.Exemplar
+	// exemplars already rolled up are replaced by the next event of their bucket, even a faster one
+	rolledUp []bool
+	// each event replaces the exemplar of its bucket, instead of only slower ones
+	latest bool
+}
+
+func newBucketExemplars(latest bool) *bucketExemplars {
+	return &bucketExemplars{
+		latest:    latest,
+		exemplars: make([]*dto.Exemplar, len(prometheus.DefBuckets)+1),
+		rolledUp:  make([]bool, len(prometheus.DefBuckets)+1),
+	}
+}
+
+func (b *bucketExemplars) observe(exemplar *dto.Exemplar) {
+	i := sort.SearchFloat64s(prometheus.DefBuckets, exemplar.GetValue())
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.latest || b.exemplars[i] == nil || b.rolledUp[i] || exemplar.GetValue() >= b.exemplars[i].GetValue() {
+		b.exemplars[i] = exemplar
+		b.rolledUp[i] = false
+	}
+}
+
+// rollup sets exemplars on buckets of the histogram, the exemplar of the +Inf bucket needs a bucket of its own.
+func (b *bucketExemplars) rollup(histogram *dto.Histogram) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, exemplar := range b.exemplars {
+		if exemplar == nil {
+			continue
+		}
+		b.rolledUp[i] = true
+		if i < len(histogram.Bucket) {
+			histogram.Bucket[i].Exemplar = exemplar
+			continue
+		}
+		histogram.Bucket = append(histogram.Bucket, &dto.Bucket{
+			CumulativeCount: proto.Uint64(histogram.GetSampleCount()),
+			UpperBound:      proto.Float64(math.Inf(1)),
+			Exemplar:        exemplar,
+		})
+	}
+}
@@ -2,6 +2,7 @@ package rollup_test
 
 import (
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/cloudfoundry/firehose_exporter/metrics"
@@ -274,6 +275,83 @@ var _ = ginkgo.Describe("Histogram Rollup", func() {
 		gomega.Expect(transform.LabelPairsToLabelsMap(histograms[0].Points()[0].Metric().Label)).ToNot(gomega.HaveKey("excluded-tag"))
 	})
 
+	ginkgo.Context("exemplars", func() {
+		exemplarOf := func(histo *dto.Histogram, upperBound float64) *dto.Exemplar {
+			for _, bucket := range histo.GetBucket() {
+				if bucket.GetUpperBound() == upperBound {
+					return bucket.GetExemplar()
+				}
+			}
+			ginkgo.Fail(fmt.Sprintf("No bucket with upper bound %g", upperBound))
+			return nil
+		}
+		record := func(r *rollup.HistogramRollup, requestID string, duration time.Duration) {
+			r.Record("source-id", map[string]string{"request_id": requestID}, int64(duration))
+		}
+
+		ginkgo.It("keeps the slowest event of each bucket as exemplar", func() {
+			r := rollup.NewHistogramRollup("0", nil, rollup.SetHistogramExemplarLabels([]string{"request_id"}))
+			record(r, "fast", 30*time.Millisecond)
+			record(r, "slow", 40*time.Millisecond)
+			record(r, "faster", 26*time.Millisecond)
+			record(r, "slowest", 2*time.Second)
+
+			histo := extract(r.Rollup(0))[0].Points()[0].Metric().GetHistogram()
+			exemplar := exemplarOf(histo, 0.05)
+			gomega.Expect(transform.LabelPairsToLabelsMap(exemplar.GetLabel())).To(gomega.Equal(map[string]string{"request_id": "slow"}))
+			gomega.Expect(exemplar.GetValue()).To(gomega.Equal(0.04))
+			gomega.Expect(exemplarOf(histo, 2.5).GetLabel()[0].GetValue()).To(gomega.Equal("slowest"))
+			gomega.Expect(exemplarOf(histo, 0.005)).To(gomega.BeNil())
+		})
+
+		ginkgo.It("replaces exemplars already rolled up by any new event", func() {
+			r := rollup.NewHistogramRollup("0", nil, rollup.SetHistogramExemplarLabels([]string{"request_id"}))
+			record(r, "slow", 40*time.Millisecond)
+			record(r, "slowest", 2*time.Second)
+			r.Rollup(0)
+
+			record(r, "fast", 30*time.Millisecond)
+			histo := extract(r.Rollup(1))[0].Points()[0].Metric().GetHistogram()
+			gomega.Expect(exemplarOf(histo, 0.05).GetLabel()[0].GetValue()).To(gomega.Equal("fast"))
+			gomega.Expect(exemplarOf(histo, 2.5).GetLabel()[0].GetValue()).To(gomega.Equal("slowest"))
+		})
+
+		ginkgo.It("keeps the latest event of each bucket as exemplar with the latest policy", func() {
+			r := rollup.NewHistogramRollup("0", nil,
+				rollup.SetHistogramExemplarLabels([]string{"trace_id", "span_id"}),
+				rollup.SetHistogramExemplarPolicy(rollup.ExemplarLatest),
+			)
+			r.Record("source-id", map[string]string{"trace_id": "slow-trace", "span_id": "slow-span"}, int64(40*time.Millisecond))
+			r.Record("source-id", map[string]string{"trace_id": "latest-trace", "span_id": "latest-span"}, int64(30*time.Millisecond))
+
+			histo := extract(r.Rollup(0))[0].Points()[0].Metric().GetHistogram()
+			exemplar := exemplarOf(histo, 0.05)
+			gomega.Expect(transform.LabelPairsToLabelsMap(exemplar.GetLabel())).To(gomega.Equal(map[string]string{
+				"trace_id": "latest-trace",
+				"span_id":  "latest-span",
+			}))
+			gomega.Expect(exemplar.GetValue()).To(gomega.Equal(0.03))
+		})
+
+		ginkgo.It("gives a +Inf bucket to the exemplar of events above all buckets", func() {
+			r := rollup.NewHistogramRollup("0", nil, rollup.SetHistogramExemplarLabels([]string{"request_id"}))
+			record(r, "timeout", time.Minute)
+
+			histo := extract(r.Rollup(0))[0].Points()[0].Metric().GetHistogram()
+			gomega.Expect(exemplarOf(histo, math.Inf(1)).GetValue()).To(gomega.Equal(60.0))
+			gomega.Expect(histo.GetBucket()[len(histo.GetBucket())-1].GetCumulativeCount()).To(gomega.Equal(uint64(1)))
+		})
+
+		ginkgo.It("has no exemplar without exemplar labels", func() {
+			r := rollup.NewHistogramRollup("0", nil)
+			record(r, "slow", 40*time.Millisecond)
+
+			histo := extract(r.Rollup(0))[0].Points()[0].Metric().GetHistogram()
+			gomega.Expect(exemplarOf(histo, 0.05)).To(gomega.BeNil())
+			gomega.Expect(histo.GetCreatedTimestamp()).ToNot(gomega.BeNil())
+		})
+	})
+
 	ginkgo.Context("CleanPeriodic", func() {
 
 		ginkgo.It("should clean metrics after amount of time", func() {
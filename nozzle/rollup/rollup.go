@@ -2,9 +2,15 @@ package rollup
 
 import (
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type PointsBatch struct {
@@ -44,7 +50,32 @@ func labelsFromKey(key, nodeIndex string, rollupTags []string) map[string]string
 	}
 
 	labels["source_id"] = keyParts[0]
-	labels["node_index"] = nodeIndex
+	if nodeIndex != "" {
+		labels["node_index"] = nodeIndex
+	}
 
 	return labels
 }
+
+// exemplarFromTags gives an exemplar of the value labelled with exemplar labels found in tags, nil is returned
+// when tags have none of them or when they don't fit in an OpenMetrics exemplar.
+func exemplarFromTags(exemplarLabels []string, tags map[string]string, value float64, at time.Time) *dto.Exemplar {
+	var labels []*dto.LabelPair
+	runes := 0
+	for _, name := range exemplarLabels {
+		labelValue := tags[name]
+		if labelValue == "" {
+			continue
+		}
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(labelValue)
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(labelValue)})
+	}
+	if len(labels) == 0 || runes > prometheus.ExemplarMaxRunes {
+		return nil
+	}
+	return &dto.Exemplar{
+		Label:     labels,
+		Value:     proto.Float64(value),
+		Timestamp: timestamppb.New(at),
+	}
+}
@@ -0,0 +1,280 @@
+package nozzle
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	limitReasonRateLimited = "rate_limited"
+	limitReasonSampled     = "sampled"
+	otherSources           = "other"
+
+	limiterShards = 64
+)
+
+// SourceLimit gives the sampling and rate limit applied to envelopes of a source id.
+type SourceLimit struct {
+	SourceID string `yaml:"source_id"`
+	// Rate is the number of envelopes per second allowed, zero means no limit.
+	Rate float64 `yaml:"rate"`
+	// Burst is the number of envelopes allowed at once above rate, it is at least one.
+	Burst int `yaml:"burst"`
+	// SampleRatio is the ratio of envelopes kept before rate limiting, in ]0, 1]. Zero is the value of limits
+	// built without ratio and keeps all envelopes, files and flags default to 1 and refuse an explicit zero.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// UnmarshalYAML defaults the sample ratio to 1 and refuses a zero ratio, which would otherwise keep all envelopes.
+func (l *SourceLimit) UnmarshalYAML(value *yaml.Node) error {
+	type plain SourceLimit
+	limit := plain{SampleRatio: 1}
+	if err := value.Decode(&limit); err != nil {
+		return err
+	}
+	if limit.SampleRatio == 0 {
+		return fmt.Errorf("sample_ratio of %s must be above 0, use filters to drop all envelopes of a source id", limit.SourceID)
+	}
+	*l = SourceLimit(limit)
+	return nil
+}
+
+func (l SourceLimit) validate() error {
+	if l.Rate < 0 {
+		return fmt.Errorf("rate must not be negative")
+	}
+	if l.SampleRatio < 0 || l.SampleRatio > 1 {
+		return fmt.Errorf("sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+func LoadSourceLimits(path string) ([]SourceLimit, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	limits := make([]SourceLimit, 0)
+	if err := yaml.Unmarshal(content, &limits); err != nil {
+		return nil, fmt.Errorf("could not parse source limits file %s: %w", path, err)
+	}
+	return limits, nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refilled tells if the bucket got all its tokens back, it is then the same as a new bucket.
+func (b *tokenBucket) refilled(now time.Time, limit SourceLimit) bool {
+	return limit.Rate == 0 || b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(max(limit.Burst, 1))
+}
+
+// limiterShard holds buckets of the source ids hashed to it, so envelopes of different sources
+// rarely wait for each other.
+type limiterShard struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// SourceLimiter samples and rate limits envelopes by source id with a token bucket per source,
+// so a flooding source can't starve others. It is shared by readers of all streams.
+// Buckets are sharded by source id, those refilled are evicted regularly so sources which stopped
+// sending (e.g. deleted apps) are forgotten.
+type SourceLimiter struct {
+	defaultLimit  SourceLimit
+	limits        map[string]SourceLimit
+	shards        [limiterShards]limiterShard
+	sweepInterval time.Duration
+	// unix time in nanoseconds of the last sweep
+	sweptAt atomic.Int64
+
+	// sources which have their own source_id label on limited envelopes counter, once full other
+	// sources are counted under "other". Labels go to sources limited the most since last sweep.
+	labelsMu        sync.Mutex
+	maxSourceLabels int
+	labeledSources  map[string]struct{}
+	// envelopes limited since last sweep by source id
+	limitedCounts map[string]uint64
+
+	internalMetrics *metrics.InternalMetrics
+}
+
+type SourceLimiterOption func(*SourceLimiter)
+
+// WithSourceLimits overrides the default limit for some source ids.
+func WithSourceLimits(limits ...SourceLimit) SourceLimiterOption {
+	return func(l *SourceLimiter) {
+		for _, limit := range limits {
+			l.limits[limit.SourceID] = limit
+		}
+	}
+}
+
+// WithSweepInterval sets how often buckets which got all their tokens back are evicted, it defaults to a minute.
+func WithSweepInterval(sweepInterval time.Duration) SourceLimiterOption {
+	return func(l *SourceLimiter) {
+		l.sweepInterval = sweepInterval
+	}
+}
+
+// WithMaxSourceLabels sets the number of source ids which get their own label on limited envelopes counter.
+func WithMaxSourceLabels(maxSourceLabels int) SourceLimiterOption {
+	return func(l *SourceLimiter) {
+		l.maxSourceLabels = maxSourceLabels
+	}
+}
+
+func NewSourceLimiter(defaultLimit SourceLimit, internalMetrics *metrics.InternalMetrics, opts ...SourceLimiterOption) (*SourceLimiter, error) {
+	l := &SourceLimiter{
+		defaultLimit:    defaultLimit,
+		limits:          make(map[string]SourceLimit),
+		sweepInterval:   time.Minute,
+		maxSourceLabels: 50,
+		labeledSources:  make(map[string]struct{}),
+		limitedCounts:   make(map[string]uint64),
+		internalMetrics: internalMetrics,
+	}
+	for _, o := range opts {
+		o(l)
+	}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[string]*tokenBucket)
+	}
+	l.sweptAt.Store(time.Now().UnixNano())
+	if err := defaultLimit.validate(); err != nil {
+		return nil, fmt.Errorf("default source limit: %w", err)
+	}
+	for sourceID, limit := range l.limits {
+		if err := limit.validate(); err != nil {
+			return nil, fmt.Errorf("source limit for %s: %w", sourceID, err)
+		}
+	}
+	return l, nil
+}
+
+// Allow tells if an envelope of the source id can be processed now.
+func (l *SourceLimiter) Allow(sourceID string) bool {
+	limit := l.limit(sourceID)
+	now := time.Now()
+	// a single caller sweeps once the interval elapsed
+	sweptAt := l.sweptAt.Load()
+	if now.UnixNano()-sweptAt >= l.sweepInterval.Nanoseconds() && l.sweptAt.CompareAndSwap(sweptAt, now.UnixNano()) {
+		l.sweep(now)
+	}
+
+	if limit.SampleRatio > 0 && limit.SampleRatio < 1 && rand.Float64() >= limit.SampleRatio {
+		l.countLimited(sourceID, limitReasonSampled)
+		return false
+	}
+	if limit.Rate == 0 {
+		return true
+	}
+
+	burst := float64(max(limit.Burst, 1))
+	shard := &l.shards[xxhash.Sum64String(sourceID)%limiterShards]
+	shard.mu.Lock()
+	bucket, ok := shard.buckets[sourceID]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		shard.buckets[sourceID] = bucket
+	}
+	bucket.tokens = min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+	bucket.last = now
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+	shard.mu.Unlock()
+
+	if !allowed {
+		l.countLimited(sourceID, limitReasonRateLimited)
+	}
+	return allowed
+}
+
+// TrackedSources gives the number of source ids holding a token bucket.
+func (l *SourceLimiter) TrackedSources() int {
+	tracked := 0
+	for i := range l.shards {
+		l.shards[i].mu.Lock()
+		tracked += len(l.shards[i].buckets)
+		l.shards[i].mu.Unlock()
+	}
+	return tracked
+}
+
+func (l *SourceLimiter) limit(sourceID string) SourceLimit {
+	if limit, ok := l.limits[sourceID]; ok {
+		return limit
+	}
+	return l.defaultLimit
+}
+
+// sweep evicts buckets which got all their tokens back, one shard at a time, and gives labels
+// to sources limited the most since last sweep.
+func (l *SourceLimiter) sweep(now time.Time) {
+	l.relabel()
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.mu.Lock()
+		for sourceID, bucket := range shard.buckets {
+			if bucket.refilled(now, l.limit(sourceID)) {
+				delete(shard.buckets, sourceID)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// relabel keeps labels of the top limited sources since last sweep, series of other sources are removed
+// so a source limited once doesn't hold a label forever.
+func (l *SourceLimiter) relabel() {
+	l.labelsMu.Lock()
+	defer l.labelsMu.Unlock()
+	sourceIDs := make([]string, 0, len(l.limitedCounts))
+	for sourceID := range l.limitedCounts {
+		sourceIDs = append(sourceIDs, sourceID)
+	}
+	sort.Slice(sourceIDs, func(i, j int) bool {
+		return l.limitedCounts[sourceIDs[i]] > l.limitedCounts[sourceIDs[j]]
+	})
+	top := make(map[string]struct{}, l.maxSourceLabels)
+	for _, sourceID := range sourceIDs[:min(len(sourceIDs), l.maxSourceLabels)] {
+		top[sourceID] = struct{}{}
+	}
+	for sourceID := range l.labeledSources {
+		if _, ok := top[sourceID]; !ok {
+			l.internalMetrics.TotalEnvelopesLimited.DeleteLabelValues(sourceID, limitReasonRateLimited)
+			l.internalMetrics.TotalEnvelopesLimited.DeleteLabelValues(sourceID, limitReasonSampled)
+		}
+	}
+	l.labeledSources = top
+	l.limitedCounts = make(map[string]uint64, len(sourceIDs))
+}
+
+func (l *SourceLimiter) countLimited(sourceID string, reason string) {
+	label := sourceID
+	l.labelsMu.Lock()
+	l.limitedCounts[sourceID]++
+	if _, ok := l.labeledSources[sourceID]; !ok {
+		if len(l.labeledSources) < l.maxSourceLabels {
+			l.labeledSources[sourceID] = struct{}{}
+		} else {
+			label = otherSources
+		}
+	}
+	l.labelsMu.Unlock()
+	l.internalMetrics.TotalEnvelopesLimited.WithLabelValues(label, reason).Inc()
+	l.internalMetrics.TotalDropped.WithLabelValues(metrics.DropStageLimit, reason).Inc()
+}
@@ -0,0 +1,234 @@
+package nozzle_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/cloudfoundry/firehose_exporter/nozzle"
+)
+
+func limitedCount(sourceID, reason string) float64 {
+	m := &dto.Metric{}
+	_ = internalMetric.TotalEnvelopesLimited.WithLabelValues(sourceID, reason).Write(m)
+	return m.GetCounter().GetValue()
+}
+
+var _ = ginkgo.Describe("SourceLimiter", func() {
+	ginkgo.It("should rate limit each source on its own", func() {
+		limiter, err := nozzle.NewSourceLimiter(nozzle.SourceLimit{Rate: 1, Burst: 5}, internalMetric)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		before := limitedCount("noisy-source", "rate_limited")
+
+		allowed := 0
+		for i := 0; i < 20; i++ {
+			if limiter.Allow("noisy-source") {
+				allowed++
+			}
+		}
+		gomega.Expect(allowed).To(gomega.Equal(5))
+		gomega.Expect(limiter.Allow("quiet-source")).To(gomega.BeTrue())
+		gomega.Expect(limitedCount("noisy-source", "rate_limited") - before).To(gomega.Equal(15.0))
+	})
+
+	ginkgo.It("should refill tokens over time", func() {
+		limiter, err := nozzle.NewSourceLimiter(nozzle.SourceLimit{Rate: 100, Burst: 1}, internalMetric)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		gomega.Expect(limiter.Allow("source")).To(gomega.BeTrue())
+		gomega.Expect(limiter.Allow("source")).To(gomega.BeFalse())
+		time.Sleep(20 * time.Millisecond)
+		gomega.Expect(limiter.Allow("source")).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should sample envelopes", func() {
+		limiter, err := nozzle.NewSourceLimiter(nozzle.SourceLimit{SampleRatio: 0.25}, internalMetric)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		allowed := 0
+		for i := 0; i < 10000; i++ {
+			if limiter.Allow("sampled-source") {
+				allowed++
+			}
+		}
+		gomega.Expect(allowed).To(gomega.BeNumerically("~", 2500, 300))
+	})
+
+	ginkgo.It("should use limits of the source when given", func() {
+		limiter, err := nozzle.NewSourceLimiter(
+			nozzle.SourceLimit{Rate: 1, Burst: 1},
+			internalMetric,
+			nozzle.WithSourceLimits(nozzle.SourceLimit{SourceID: "platform"}),
+		)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		for i := 0; i < 10; i++ {
+			gomega.Expect(limiter.Allow("platform")).To(gomega.BeTrue())
+		}
+	})
+
+	ginkgo.It("should count sources over the labels cap as other", func() {
+		limiter, err := nozzle.NewSourceLimiter(
+			nozzle.SourceLimit{Rate: 1, Burst: 1},
+			internalMetric,
+			nozzle.WithMaxSourceLabels(1),
+		)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		before := limitedCount("other", "rate_limited")
+
+		for _, sourceID := range []string{"first-capped", "second-capped", "third-capped"} {
+			limiter.Allow(sourceID)
+			limiter.Allow(sourceID)
+		}
+		gomega.Expect(limitedCount("first-capped", "rate_limited")).To(gomega.Equal(1.0))
+		gomega.Expect(limitedCount("other", "rate_limited") - before).To(gomega.Equal(2.0))
+	})
+
+	ginkgo.It("should give labels to sources limited the most since last sweep", func() {
+		limiter, err := nozzle.NewSourceLimiter(
+			nozzle.SourceLimit{Rate: 0.001, Burst: 1},
+			internalMetric,
+			nozzle.WithMaxSourceLabels(1),
+			nozzle.WithSweepInterval(50*time.Millisecond),
+		)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		limiter.Allow("early-offender")
+		limiter.Allow("early-offender")
+		for i := 0; i < 10; i++ {
+			limiter.Allow("flooding-source")
+		}
+		gomega.Expect(limitedCount("early-offender", "rate_limited")).To(gomega.Equal(1.0))
+		gomega.Expect(limitedCount("flooding-source", "rate_limited")).To(gomega.Equal(0.0))
+
+		time.Sleep(60 * time.Millisecond)
+		limiter.Allow("flooding-source")
+		gomega.Expect(limitedCount("flooding-source", "rate_limited")).To(gomega.Equal(1.0))
+		gomega.Expect(limitedCount("early-offender", "rate_limited")).To(gomega.Equal(0.0))
+		limiter.Allow("early-offender")
+		gomega.Expect(limitedCount("early-offender", "rate_limited")).To(gomega.Equal(0.0))
+	})
+
+	ginkgo.It("should forget sources once their bucket is refilled", func() {
+		limiter, err := nozzle.NewSourceLimiter(
+			nozzle.SourceLimit{Rate: 10, Burst: 1},
+			internalMetric,
+			nozzle.WithSourceLimits(nozzle.SourceLimit{SourceID: "slow-app", Rate: 0.001, Burst: 1}),
+			nozzle.WithSweepInterval(0),
+		)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		for i := 0; i < 100; i++ {
+			limiter.Allow(fmt.Sprintf("deleted-app-%d", i))
+		}
+		limiter.Allow("slow-app")
+		gomega.Expect(limiter.TrackedSources()).To(gomega.Equal(101))
+
+		time.Sleep(150 * time.Millisecond)
+		gomega.Expect(limiter.Allow("active-app")).To(gomega.BeTrue())
+		gomega.Expect(limiter.TrackedSources()).To(gomega.Equal(2))
+		gomega.Expect(limiter.Allow("slow-app")).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should limit sources from concurrent streams", func() {
+		limiter, err := nozzle.NewSourceLimiter(nozzle.SourceLimit{Rate: 0.001, Burst: 10}, internalMetric)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		var allowed atomic.Int64
+		wg := sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if limiter.Allow("shared-source") {
+						allowed.Add(1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		gomega.Expect(allowed.Load()).To(gomega.Equal(int64(10)))
+	})
+
+	ginkgo.It("should refuse invalid limits", func() {
+		_, err := nozzle.NewSourceLimiter(nozzle.SourceLimit{SampleRatio: 2}, internalMetric)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should load limits from yaml", func() {
+		dir, err := os.MkdirTemp("", "limits")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "limits.yml")
+		gomega.Expect(os.WriteFile(path, []byte(`
+- source_id: noisy-app
+  rate: 10
+  burst: 20
+  sample_ratio: 0.5
+- source_id: platform
+`), 0o600)).To(gomega.Succeed())
+
+		limits, err := nozzle.LoadSourceLimits(path)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(limits).To(gomega.Equal([]nozzle.SourceLimit{
+			{SourceID: "noisy-app", Rate: 10, Burst: 20, SampleRatio: 0.5},
+			{SourceID: "platform", SampleRatio: 1},
+		}))
+	})
+
+	ginkgo.It("should refuse a zero sample ratio in yaml", func() {
+		dir, err := os.MkdirTemp("", "limits")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "limits.yml")
+		gomega.Expect(os.WriteFile(path, []byte(`
+- source_id: noisy-app
+  sample_ratio: 0
+`), 0o600)).To(gomega.Succeed())
+
+		_, err = nozzle.LoadSourceLimits(path)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})
+
+var _ = ginkgo.Describe("when envelopes are limited by source", func() {
+	ginkgo.It("only buffers allowed envelopes", func() {
+		pointBuffer := make(chan []*metrics.RawMetric)
+		metricStore := NewMetricStoreTesting(pointBuffer)
+		streamConnector := newSpyStreamConnector()
+		limiter, err := nozzle.NewSourceLimiter(
+			nozzle.SourceLimit{Rate: 1, Burst: 2},
+			internalMetric,
+			nozzle.WithSourceLimits(nozzle.SourceLimit{SourceID: "platform-source"}),
+		)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		n := nozzle.NewNozzle(streamConnector, "firehose_exporter", 0,
+			pointBuffer,
+			internalMetric,
+			nozzle.WithNozzleTimerRollup(
+				100*time.Millisecond,
+				[]string{"tag1", "tag2", "status_code"},
+				[]string{"tag1", "tag2"},
+			),
+			nozzle.WithSourceLimiter(limiter),
+		)
+		go n.Start()
+
+		for i := 0; i < 10; i++ {
+			addEnvelope(uint64(i), "counter", "noisy-source", streamConnector)
+		}
+		addEnvelope(1, "counter", "platform-source", streamConnector)
+
+		gomega.Eventually(metricStore.GetPoints).Should(gomega.HaveLen(3))
+		gomega.Consistently(metricStore.GetPoints, 600*time.Millisecond).Should(gomega.HaveLen(3))
+	})
+})
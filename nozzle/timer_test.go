@@ -6,6 +6,7 @@ import (
 	"github.com/cloudfoundry/firehose_exporter/metricmaker"
 	"github.com/cloudfoundry/firehose_exporter/metrics"
 	"github.com/cloudfoundry/firehose_exporter/nozzle"
+	"github.com/cloudfoundry/firehose_exporter/nozzle/rollup"
 	"github.com/cloudfoundry/firehose_exporter/transform"
 	"github.com/gogo/protobuf/proto"
 	dto "github.com/prometheus/client_model/go"
@@ -206,6 +207,8 @@ var _ = ginkgo.Describe("when the envelope is a Timer", func() {
 
 	ginkgo.It("only rolls up gorouter metrics with a peer_type of Server", func() {
 		intervalStart := time.Now().Truncate(100 * time.Millisecond).UnixNano()
+		dropped := internalMetric.TotalDropped.WithLabelValues(metrics.DropStageTimer, metrics.DropReasonGorouterClient)
+		droppedBefore := counterTotal(dropped)
 
 		streamConnector.envelopes <- []*loggregator_v2.Envelope{
 			{
@@ -304,6 +307,9 @@ var _ = ginkgo.Describe("when the envelope is a Timer", func() {
 		numberOfExpectedSeriesExcludingStatusCode := 1
 		numberOfExpectedPoints := numberOfExpectedSeriesIncludingStatusCode + numberOfExpectedSeriesExcludingStatusCode
 		gomega.Eventually(metricStore.GetPoints).Should(gomega.HaveLen(numberOfExpectedPoints))
+		gomega.Eventually(func() float64 {
+			return counterTotal(dropped) - droppedBefore
+		}).Should(gomega.Equal(float64(3)))
 
 		points := metricStore.GetPoints()
 		// _count points, per series including status_code
@@ -462,6 +468,8 @@ var _ = ginkgo.Describe("when the envelope is a Timer", func() {
 
 	ginkgo.It("skip metric with a source id in form of app guid", func() {
 		intervalStart := time.Now().Truncate(100 * time.Millisecond).UnixNano()
+		dropped := internalMetric.TotalDropped.WithLabelValues(metrics.DropStageTimer, metrics.DropReasonGUIDSource)
+		droppedBefore := counterTotal(dropped)
 
 		streamConnector.envelopes <- []*loggregator_v2.Envelope{
 			{
@@ -503,6 +511,77 @@ var _ = ginkgo.Describe("when the envelope is a Timer", func() {
 		gomega.Expect(labelsFirst).Should(gomega.HaveKeyWithValue("app_id", "6f0b4a14-0703-442c-bc80-bea78d31d5ab"))
 		labelsSecond := transform.LabelPairsToLabelsMap(metricStore.GetPoints()[1].Metric().GetLabel())
 		gomega.Expect(labelsSecond).Should(gomega.HaveKeyWithValue("app_id", "6f0b4a14-0703-442c-bc80-bea78d31d5ab"))
+		gomega.Eventually(func() float64 {
+			return counterTotal(dropped) - droppedBefore
+		}).Should(gomega.Equal(float64(1)))
+	})
+
+	ginkgo.Context("with trace tags", func() {
+		ginkgo.BeforeEach(func() {
+			noz = nozzle.NewNozzle(streamConnector, "firehose_exporter", 0,
+				pointBuffer,
+				internalMetric,
+				nozzle.WithNozzleTimerRollup(
+					100*time.Millisecond,
+					[]string{"tag1", "status_code", "trace_id"},
+					[]string{"tag1", "trace_id", "span_id"},
+				),
+				nozzle.WithTimerTraceTags("trace_id", "span_id"),
+				nozzle.WithTimerExemplarPolicy(rollup.ExemplarLatest),
+				nozzle.WithFilterSelector(filterSelector),
+				nozzle.WithFilterDeployment(filterDeployment),
+			)
+		})
+
+		ginkgo.It("labels exemplars of durations with trace tags kept out of rollup series", func() {
+			timer := func(traceID, spanID string, duration time.Duration) *loggregator_v2.Envelope {
+				return &loggregator_v2.Envelope{
+					Timestamp: time.Now().UnixNano(),
+					SourceId:  "source-id",
+					Message: &loggregator_v2.Envelope_Timer{
+						Timer: &loggregator_v2.Timer{
+							Name:  "http",
+							Start: 0,
+							Stop:  int64(duration),
+						},
+					},
+					Tags: map[string]string{
+						"tag1":        "t1",
+						"status_code": "200",
+						"trace_id":    traceID,
+						"span_id":     spanID,
+					},
+				}
+			}
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{
+				timer("4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", 40*time.Millisecond),
+				timer("80f198ee56343ba864fe8b2a57d3eff7", "e457b5a2e4d86bd1", 30*time.Millisecond),
+			}
+
+			gomega.Eventually(metricStore.GetPoints).Should(gomega.HaveLen(2))
+			var histo *dto.Metric
+			for _, point := range metricStore.GetPoints() {
+				labels := transform.LabelPairsToLabelsMap(point.Metric().GetLabel())
+				gomega.Expect(labels).ToNot(gomega.HaveKey("trace_id"))
+				gomega.Expect(labels).ToNot(gomega.HaveKey("span_id"))
+				if point.MetricName() == "http_duration_seconds" {
+					histo = point.Metric()
+				}
+			}
+			gomega.Expect(histo).ToNot(gomega.BeNil())
+			gomega.Expect(histo.GetHistogram().GetSampleCount()).To(gomega.Equal(uint64(2)))
+
+			var exemplar *dto.Exemplar
+			for _, bucket := range histo.GetHistogram().GetBucket() {
+				if bucket.GetUpperBound() == 0.05 {
+					exemplar = bucket.GetExemplar()
+				}
+			}
+			gomega.Expect(transform.LabelPairsToLabelsMap(exemplar.GetLabel())).To(gomega.Equal(map[string]string{
+				"trace_id": "80f198ee56343ba864fe8b2a57d3eff7",
+				"span_id":  "e457b5a2e4d86bd1",
+			}))
+		})
 	})
 })
 
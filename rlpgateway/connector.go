@@ -0,0 +1,197 @@
+package rlpgateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cloudfoundry/firehose_exporter/connection"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReasonRead is the reason of a stream ended by an error while reading it.
+const ReasonRead = "read"
+
+// StreamConnector reads envelopes from the RLP Gateway HTTP API with server sent events,
+// requests are authenticated with a UAA token of a client having the doppler.firehose or logs.admin scope.
+type StreamConnector struct {
+	client *loggregator.RLPGatewayClient
+	errs   chan error
+	// wait before opening again a stream the client gave up
+	restartInterval time.Duration
+}
+
+type Option func(*options)
+
+type options struct {
+	httpClient      *http.Client
+	maxRetries      int
+	restartInterval time.Duration
+	tracker         *connection.Tracker
+}
+
+// WithHTTPClient sets the http client used to reach the RLP Gateway, it must not have a timeout
+// as streams are long-lived requests.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = httpClient
+	}
+}
+
+// WithRetries sets how many times in a row a stream is reconnected before being given up,
+// then how long to wait before opening it again.
+func WithRetries(maxRetries int, restartInterval time.Duration) Option {
+	return func(o *options) {
+		o.maxRetries = maxRetries
+		o.restartInterval = restartInterval
+	}
+}
+
+// WithTracker reports the lifecycle of streams to the tracker, reasons of errors are http_<status code>
+// for refused streams, request when the gateway can't be reached and eof or read when a stream ends.
+func WithTracker(tracker *connection.Tracker) Option {
+	return func(o *options) {
+		o.tracker = tracker
+	}
+}
+
+func NewStreamConnector(gatewayURL string, uaa *UAAClient, opts ...Option) *StreamConnector {
+	o := &options{
+		httpClient:      &http.Client{},
+		maxRetries:      10,
+		restartInterval: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	var doer loggregator.Doer = &authenticatedDoer{httpClient: o.httpClient, uaa: uaa}
+	if o.tracker != nil {
+		doer = &trackingDoer{doer: doer, tracker: o.tracker}
+	}
+	errs := make(chan error, 1)
+	return &StreamConnector{
+		client: loggregator.NewRLPGatewayClient(
+			gatewayURL,
+			loggregator.WithRLPGatewayHTTPClient(doer),
+			loggregator.WithRLPGatewayClientLogger(log.StandardLogger()),
+			loggregator.WithRLPGatewayMaxRetries(o.maxRetries),
+			loggregator.WithRLPGatewayErrChan(errs),
+		),
+		errs:            errs,
+		restartInterval: o.restartInterval,
+	}
+}
+
+// Stream opens a stream for the request, the stream is opened again when the gateway client
+// gives up after too many failed reconnections, until ctx is done.
+func (c *StreamConnector) Stream(ctx context.Context, req *loggregator_v2.EgressBatchRequest) loggregator.EnvelopeStream {
+	stream := c.client.Stream(ctx, req)
+	return func() []*loggregator_v2.Envelope {
+		for {
+			// a stream only gives nil once closed
+			batch := stream()
+			if batch != nil || ctx.Err() != nil {
+				return batch
+			}
+			select {
+			case err := <-c.errs:
+				log.Warningf("RLP gateway stream closed: %s, opening it again in %s", err.Error(), c.restartInterval)
+			default:
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(c.restartInterval):
+			}
+			stream = c.client.Stream(ctx, req)
+		}
+	}
+}
+
+// authenticatedDoer sets a UAA token on requests, a request refused with 401 is sent again once with a new token.
+type authenticatedDoer struct {
+	httpClient *http.Client
+	uaa        *UAAClient
+}
+
+func (d *authenticatedDoer) Do(req *http.Request) (*http.Response, error) {
+	resp, err := d.do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	d.uaa.Invalidate()
+	return d.do(req.Clone(req.Context()))
+}
+
+func (d *authenticatedDoer) do(req *http.Request) (*http.Response, error) {
+	token, err := d.uaa.Token()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	return d.httpClient.Do(req)
+}
+
+// trackingDoer reports requests as stream attempts and the end of response bodies as disconnections.
+type trackingDoer struct {
+	doer    loggregator.Doer
+	tracker *connection.Tracker
+}
+
+func (d *trackingDoer) Do(req *http.Request) (*http.Response, error) {
+	d.tracker.Attempt()
+	resp, err := d.doer.Do(req)
+	if err != nil {
+		d.tracker.Failed(readReason(err, connection.ReasonRequest), err)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		d.tracker.Failed(fmt.Sprintf("http_%d", resp.StatusCode), fmt.Errorf("unexpected status code %d", resp.StatusCode))
+		return resp, nil
+	}
+	d.tracker.Connected()
+	resp.Body = &trackedBody{ReadCloser: resp.Body, tracker: d.tracker}
+	return resp, nil
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	tracker *connection.Tracker
+	once    sync.Once
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.disconnected(readReason(err, ReasonRead), err)
+	}
+	return n, err
+}
+
+func (b *trackedBody) Close() error {
+	b.disconnected(connection.ReasonEOF, io.EOF)
+	return b.ReadCloser.Close()
+}
+
+func (b *trackedBody) disconnected(reason string, err error) {
+	b.once.Do(func() {
+		b.tracker.Disconnected(reason, err)
+	})
+}
+
+func readReason(err error, fallback string) string {
+	switch {
+	case errors.Is(err, io.EOF):
+		return connection.ReasonEOF
+	case errors.Is(err, context.Canceled):
+		return connection.ReasonCanceled
+	}
+	return fallback
+}
@@ -0,0 +1,182 @@
+package rlpgateway_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/protoadapt"
+
+	"github.com/cloudfoundry/firehose_exporter/connection"
+	"github.com/cloudfoundry/firehose_exporter/rlpgateway"
+)
+
+// fakeGateway serves a batch as server sent events to requests having an accepted token,
+// it answers 503 to the first unavailable requests.
+type fakeGateway struct {
+	*httptest.Server
+	mu          sync.Mutex
+	accepted    string
+	unavailable int
+	queries     []string
+	tokens      []string
+}
+
+func newFakeGateway(accepted string, unavailable int, batch *loggregator_v2.EnvelopeBatch) *fakeGateway {
+	data, err := protojson.Marshal(protoadapt.MessageV2Of(batch))
+	gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+	f := &fakeGateway{accepted: accepted, unavailable: unavailable}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.queries = append(f.queries, r.URL.RawQuery)
+		f.tokens = append(f.tokens, r.Header.Get("Authorization"))
+		unavailable := f.unavailable > 0
+		f.unavailable--
+		f.mu.Unlock()
+
+		if r.URL.Path != "/v2/read" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "bearer "+f.accepted {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if unavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "event: heartbeat\ndata: 1\n\n")
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	return f
+}
+
+func (f *fakeGateway) seenQueries() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.queries...)
+}
+
+func (f *fakeGateway) seenTokens() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.tokens...)
+}
+
+var _ = ginkgo.Describe("StreamConnector", func() {
+	var uaa *fakeUAA
+	var gateway *fakeGateway
+	var ctx context.Context
+	var cancel context.CancelFunc
+	batch := &loggregator_v2.EnvelopeBatch{
+		Batch: []*loggregator_v2.Envelope{
+			{
+				SourceId: "bosh-system-metrics-forwarder",
+				Message: &loggregator_v2.Envelope_Gauge{
+					Gauge: &loggregator_v2.Gauge{
+						Metrics: map[string]*loggregator_v2.GaugeValue{
+							"system_cpu_user": {Unit: "Percent", Value: 12},
+						},
+					},
+				},
+			},
+		},
+	}
+	request := &loggregator_v2.EgressBatchRequest{
+		ShardId: "firehose_exporter",
+		Selectors: []*loggregator_v2.Selector{
+			{Message: &loggregator_v2.Selector_Gauge{Gauge: &loggregator_v2.GaugeSelector{}}},
+		},
+	}
+
+	ginkgo.BeforeEach(func() {
+		uaa = newFakeUAA(3600)
+		ctx, cancel = context.WithCancel(context.Background())
+	})
+
+	ginkgo.AfterEach(func() {
+		cancel()
+		gateway.Close()
+		uaa.Close()
+	})
+
+	receive := func(connector *rlpgateway.StreamConnector) []*loggregator_v2.Envelope {
+		envelopes := make(chan []*loggregator_v2.Envelope, 1)
+		stream := connector.Stream(ctx, request)
+		go func() {
+			envelopes <- stream()
+		}()
+		var received []*loggregator_v2.Envelope
+		gomega.Eventually(envelopes, 5*time.Second).Should(gomega.Receive(&received))
+		return received
+	}
+
+	ginkgo.It("should stream envelopes with a uaa token", func() {
+		gateway = newFakeGateway("token-1", 0, batch)
+		connector := rlpgateway.NewStreamConnector(gateway.URL, rlpgateway.NewUAAClient(uaa.URL, "firehose", "s3cr3t"))
+
+		received := receive(connector)
+		gomega.Expect(received).To(gomega.HaveLen(1))
+		gomega.Expect(received[0].GetSourceId()).To(gomega.Equal("bosh-system-metrics-forwarder"))
+		gomega.Expect(received[0].GetGauge().GetMetrics()["system_cpu_user"].GetValue()).To(gomega.Equal(float64(12)))
+		gomega.Expect(gateway.seenTokens()).To(gomega.Equal([]string{"bearer token-1"}))
+		gomega.Expect(gateway.seenQueries()).To(gomega.Equal([]string{"shard_id=firehose_exporter&gauge"}))
+	})
+
+	ginkgo.It("should get a new token when gateway refuses current one", func() {
+		gateway = newFakeGateway("token-2", 0, batch)
+		connector := rlpgateway.NewStreamConnector(gateway.URL, rlpgateway.NewUAAClient(uaa.URL, "firehose", "s3cr3t"))
+
+		gomega.Expect(receive(connector)).To(gomega.HaveLen(1))
+		gomega.Expect(gateway.seenTokens()).To(gomega.Equal([]string{"bearer token-1", "bearer token-2"}))
+		gomega.Expect(uaa.tokenRequests()).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("should open stream again when gateway client gives up", func() {
+		gateway = newFakeGateway("token-1", 3, batch)
+		connector := rlpgateway.NewStreamConnector(
+			gateway.URL,
+			rlpgateway.NewUAAClient(uaa.URL, "firehose", "s3cr3t"),
+			rlpgateway.WithRetries(1, 10*time.Millisecond),
+		)
+
+		gomega.Expect(receive(connector)).To(gomega.HaveLen(1))
+		gomega.Expect(gateway.seenTokens()).To(gomega.HaveLen(4))
+	})
+
+	ginkgo.It("should track attempts, connections and disconnections of streams", func() {
+		gateway = newFakeGateway("token-1", 1, batch)
+		tracker := connection.NewTracker(gateway.URL, internalMetric)
+		connector := rlpgateway.NewStreamConnector(
+			gateway.URL,
+			rlpgateway.NewUAAClient(uaa.URL, "firehose", "s3cr3t"),
+			rlpgateway.WithTracker(tracker),
+		)
+
+		gomega.Expect(receive(connector)).To(gomega.HaveLen(1))
+		s := tracker.Status()
+		gomega.Expect(s.Attempts).To(gomega.Equal(uint64(2)))
+		gomega.Expect(s.Connects).To(gomega.Equal(uint64(1)))
+		gomega.Expect(s.Connected).To(gomega.Equal(1))
+		gomega.Expect(s.LastError).To(gomega.Equal("unexpected status code 503"))
+
+		cancel()
+		gomega.Eventually(func() uint64 {
+			return tracker.Status().Disconnects
+		}).Should(gomega.Equal(uint64(1)))
+		gomega.Expect(tracker.Status().Connected).To(gomega.Equal(0))
+		gomega.Expect(tracker.Status().LastError).To(gomega.ContainSubstring("context canceled"))
+	})
+})
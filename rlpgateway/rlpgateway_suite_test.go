@@ -0,0 +1,16 @@
+package rlpgateway_test
+
+import (
+	"testing"
+
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var internalMetric = metrics.NewInternalMetrics("firehose", "test")
+
+func TestRLPGateway(t *testing.T) {
+	gomega.RegisterFailHandler(ginkgo.Fail)
+	ginkgo.RunSpecs(t, "RLP Gateway Suite")
+}
@@ -0,0 +1,100 @@
+package rlpgateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UAAClient gets tokens from UAA with the client credentials grant, a token is reused
+// until 90% of its lifetime elapsed, it is then fetched again on next use.
+type UAAClient struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	httpClient   *http.Client
+
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time
+}
+
+type UAAOption func(*UAAClient)
+
+// WithUAAHTTPClient sets the http client used to reach UAA, it defaults to a client with a 30s timeout.
+func WithUAAHTTPClient(httpClient *http.Client) UAAOption {
+	return func(c *UAAClient) {
+		c.httpClient = httpClient
+	}
+}
+
+func NewUAAClient(uaaURL, clientID, clientSecret string, opts ...UAAOption) *UAAClient {
+	c := &UAAClient{
+		tokenURL:     strings.TrimSuffix(uaaURL, "/") + "/oauth/token",
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Token gives a valid access token, fetching a new one if needed.
+func (c *UAAClient) Token() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.refreshAt) {
+		return c.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest(http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	fetchedAt := time.Now()
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not request token to uaa: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("uaa refused token request with status %d: %s", resp.StatusCode, body)
+	}
+
+	token := tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("could not decode uaa token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("uaa token response has no access token")
+	}
+	c.token = token.AccessToken
+	c.refreshAt = fetchedAt.Add(time.Duration(token.ExpiresIn) * time.Second * 9 / 10)
+	return c.token, nil
+}
+
+// Invalidate makes next call to Token fetch a new token, e.g. when current one was refused.
+func (c *UAAClient) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ""
+}
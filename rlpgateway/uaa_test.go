@@ -0,0 +1,102 @@
+package rlpgateway_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/firehose_exporter/rlpgateway"
+)
+
+// fakeUAA gives token-1, token-2... to the client firehose with secret s3cr3t.
+type fakeUAA struct {
+	*httptest.Server
+	mu        sync.Mutex
+	requests  int
+	expiresIn int
+}
+
+func newFakeUAA(expiresIn int) *fakeUAA {
+	f := &fakeUAA{expiresIn: expiresIn}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if r.URL.Path != "/oauth/token" || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !ok || clientID != "firehose" || clientSecret != "s3cr3t" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.mu.Lock()
+		f.requests++
+		requests := f.requests
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":%d}`, requests, f.expiresIn)
+	}))
+	return f
+}
+
+func (f *fakeUAA) tokenRequests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+var _ = ginkgo.Describe("UAAClient", func() {
+	var uaa *fakeUAA
+
+	ginkgo.AfterEach(func() {
+		uaa.Close()
+	})
+
+	ginkgo.It("should get a token with client credentials and reuse it while it is valid", func() {
+		uaa = newFakeUAA(3600)
+		client := rlpgateway.NewUAAClient(uaa.URL, "firehose", "s3cr3t")
+
+		token, err := client.Token()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(token).To(gomega.Equal("token-1"))
+
+		token, err = client.Token()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(token).To(gomega.Equal("token-1"))
+		gomega.Expect(uaa.tokenRequests()).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should get a new token once current one expires", func() {
+		uaa = newFakeUAA(0)
+		client := rlpgateway.NewUAAClient(uaa.URL+"/", "firehose", "s3cr3t")
+
+		_, err := client.Token()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		token, err := client.Token()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(token).To(gomega.Equal("token-2"))
+	})
+
+	ginkgo.It("should get a new token once invalidated", func() {
+		uaa = newFakeUAA(3600)
+		client := rlpgateway.NewUAAClient(uaa.URL, "firehose", "s3cr3t")
+
+		_, err := client.Token()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		client.Invalidate()
+		token, err := client.Token()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(token).To(gomega.Equal("token-2"))
+	})
+
+	ginkgo.It("should fail when uaa refuses credentials", func() {
+		uaa = newFakeUAA(3600)
+		client := rlpgateway.NewUAAClient(uaa.URL, "firehose", "wrong")
+
+		_, err := client.Token()
+		gomega.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("status 401")))
+	})
+})
@@ -0,0 +1,59 @@
+package sharding
+
+import (
+	"errors"
+	"net/http"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxBatchBytes bounds the body of batches sent by peers, a batch of default size is far below it.
+const maxBatchBytes = 32 << 20
+
+// Receiver takes points and envelopes sent by peers, they must not be routed again.
+type Receiver interface {
+	ReceivePoints(points []*metrics.RawMetric)
+	ReceiveEnvelopes(envelopes []*loggregator_v2.Envelope)
+}
+
+type peerHandler struct {
+	receiver        Receiver
+	internalMetrics *metrics.InternalMetrics
+}
+
+// NewPeerHandler gives the handler to serve on PeerPath.
+func NewPeerHandler(receiver Receiver, internalMetrics *metrics.InternalMetrics) http.Handler {
+	return &peerHandler{
+		receiver:        receiver,
+		internalMetrics: internalMetrics,
+	}
+}
+
+func (h *peerHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	points, envelopes, err := decodeBatch(http.MaxBytesReader(w, req.Body, maxBatchBytes))
+	if err != nil {
+		log.Warningf("Could not decode batch from peer: %s", err.Error())
+		status := http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	h.internalMetrics.TotalPeerReceived.WithLabelValues(kindPoint).Add(float64(len(points)))
+	h.internalMetrics.TotalPeerReceived.WithLabelValues(kindEnvelope).Add(float64(len(envelopes)))
+	if len(points) > 0 {
+		h.receiver.ReceivePoints(points)
+	}
+	if len(envelopes) > 0 {
+		h.receiver.ReceiveEnvelopes(envelopes)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
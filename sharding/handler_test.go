@@ -0,0 +1,43 @@
+package sharding_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/firehose_exporter/sharding"
+)
+
+var _ = ginkgo.Describe("PeerHandler", func() {
+	var receiver *spyReceiver
+	var handler http.Handler
+
+	ginkgo.BeforeEach(func() {
+		receiver = &spyReceiver{}
+		handler = sharding.NewPeerHandler(receiver, internalMetric)
+	})
+
+	post := func(body []byte) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, sharding.PeerPath, bytes.NewReader(body)))
+		return rec
+	}
+
+	ginkgo.It("should refuse a batch which can't be decoded", func() {
+		gomega.Expect(post([]byte("not a batch")).Code).To(gomega.Equal(http.StatusBadRequest))
+	})
+
+	ginkgo.It("should refuse a batch too large to be read", func() {
+		// gob matches fields by name, the batch only carries a huge envelope batch
+		batch := struct{ Envelopes []byte }{Envelopes: make([]byte, 33<<20)}
+		buf := &bytes.Buffer{}
+		gomega.Expect(gob.NewEncoder(buf).Encode(&batch)).To(gomega.Succeed())
+
+		gomega.Expect(post(buf.Bytes()).Code).To(gomega.Equal(http.StatusRequestEntityTooLarge))
+		gomega.Expect(receiver.Envelopes()).To(gomega.BeEmpty())
+	})
+})
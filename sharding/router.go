@@ -0,0 +1,218 @@
+package sharding
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// PeerPath is the path on which instances receive points and envelopes owned by them.
+	PeerPath = "/peer/v1/batch"
+
+	kindPoint    = "point"
+	kindEnvelope = "envelope"
+)
+
+// Router gives each series to exactly one instance of a group of peers by hashmod on its key,
+// points and envelopes owned by another peer are batched and sent to it.
+// All peers must be given the same list of addresses in the same order.
+type Router struct {
+	self    int
+	senders []*peerSender
+
+	client        *http.Client
+	username      string
+	password      string
+	queueSize     int
+	maxBatchSize  int
+	flushInterval time.Duration
+}
+
+type RouterOption func(*Router)
+
+func WithRouterHTTPClient(client *http.Client) RouterOption {
+	return func(r *Router) {
+		r.client = client
+	}
+}
+
+func WithRouterBasicAuth(username, password string) RouterOption {
+	return func(r *Router) {
+		r.username = username
+		r.password = password
+	}
+}
+
+func WithRouterQueueSize(size int) RouterOption {
+	return func(r *Router) {
+		r.queueSize = size
+	}
+}
+
+func WithRouterBatch(maxBatchSize int, flushInterval time.Duration) RouterOption {
+	return func(r *Router) {
+		r.maxBatchSize = maxBatchSize
+		r.flushInterval = flushInterval
+	}
+}
+
+// NewRouter creates a router for peers given by their base url, self is the index of this instance in peers.
+func NewRouter(peers []string, self int, internalMetrics *metrics.InternalMetrics, opts ...RouterOption) (*Router, error) {
+	if self < 0 || self >= len(peers) {
+		return nil, fmt.Errorf("index %d of this instance is out of the %d peers", self, len(peers))
+	}
+	r := &Router{
+		self:          self,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		queueSize:     100000,
+		maxBatchSize:  1000,
+		flushInterval: 500 * time.Millisecond,
+	}
+	for _, o := range opts {
+		o(r)
+	}
+
+	r.senders = make([]*peerSender, len(peers))
+	for i, address := range peers {
+		if i == self {
+			continue
+		}
+		r.senders[i] = &peerSender{
+			router:          r,
+			address:         address,
+			points:          make(chan *metrics.RawMetric, r.queueSize),
+			envelopes:       make(chan *loggregator_v2.Envelope, r.queueSize),
+			internalMetrics: internalMetrics,
+		}
+	}
+	return r, nil
+}
+
+// Start starts sending batches to peers.
+func (r *Router) Start() {
+	for _, sender := range r.senders {
+		if sender != nil {
+			go sender.run()
+		}
+	}
+}
+
+// Owner gives the index of the peer owning the given key.
+func (r *Router) Owner(key uint64) int {
+	return int(key % uint64(len(r.senders)))
+}
+
+// RoutePoint tells if this instance owns the point, otherwise point is queued for its owner.
+func (r *Router) RoutePoint(point *metrics.RawMetric) bool {
+	owner := r.Owner(point.ID())
+	if owner == r.self {
+		return true
+	}
+	r.senders[owner].sendPoint(point)
+	return false
+}
+
+// RouteEnvelope tells if this instance owns the envelope key, otherwise envelope is queued for its owner.
+func (r *Router) RouteEnvelope(key uint64, envelope *loggregator_v2.Envelope) bool {
+	owner := r.Owner(key)
+	if owner == r.self {
+		return true
+	}
+	r.senders[owner].sendEnvelope(envelope)
+	return false
+}
+
+type peerSender struct {
+	router          *Router
+	address         string
+	points          chan *metrics.RawMetric
+	envelopes       chan *loggregator_v2.Envelope
+	internalMetrics *metrics.InternalMetrics
+}
+
+func (s *peerSender) sendPoint(point *metrics.RawMetric) {
+	select {
+	case s.points <- point:
+	default:
+		s.internalMetrics.TotalPeerForwardDropped.WithLabelValues(s.address, kindPoint).Inc()
+		s.internalMetrics.TotalDropped.WithLabelValues(metrics.DropStagePeer, metrics.DropReasonBufferFull).Inc()
+	}
+}
+
+func (s *peerSender) sendEnvelope(envelope *loggregator_v2.Envelope) {
+	select {
+	case s.envelopes <- envelope:
+	default:
+		s.internalMetrics.TotalPeerForwardDropped.WithLabelValues(s.address, kindEnvelope).Inc()
+		s.internalMetrics.TotalDropped.WithLabelValues(metrics.DropStagePeer, metrics.DropReasonBufferFull).Inc()
+	}
+}
+
+func (s *peerSender) run() {
+	points := make([]*metrics.RawMetric, 0)
+	envelopes := make([]*loggregator_v2.Envelope, 0)
+	ticker := time.NewTicker(s.router.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case point := <-s.points:
+			points = append(points, point)
+		case envelope := <-s.envelopes:
+			envelopes = append(envelopes, envelope)
+		case <-ticker.C:
+			if len(points) > 0 || len(envelopes) > 0 {
+				s.flush(points, envelopes)
+				points, envelopes = points[:0], envelopes[:0]
+			}
+			continue
+		}
+		if len(points)+len(envelopes) >= s.router.maxBatchSize {
+			s.flush(points, envelopes)
+			points, envelopes = points[:0], envelopes[:0]
+		}
+	}
+}
+
+func (s *peerSender) flush(points []*metrics.RawMetric, envelopes []*loggregator_v2.Envelope) {
+	err := s.post(points, envelopes)
+	if err != nil {
+		log.WithField("peer", s.address).Warningf("Could not send batch to peer: %s", err.Error())
+		s.internalMetrics.TotalPeerForwardDropped.WithLabelValues(s.address, kindPoint).Add(float64(len(points)))
+		s.internalMetrics.TotalPeerForwardDropped.WithLabelValues(s.address, kindEnvelope).Add(float64(len(envelopes)))
+		s.internalMetrics.TotalDropped.WithLabelValues(metrics.DropStagePeer, metrics.DropReasonSendFailed).Add(float64(len(points) + len(envelopes)))
+		return
+	}
+	s.internalMetrics.TotalPeerForwarded.WithLabelValues(s.address, kindPoint).Add(float64(len(points)))
+	s.internalMetrics.TotalPeerForwarded.WithLabelValues(s.address, kindEnvelope).Add(float64(len(envelopes)))
+}
+
+func (s *peerSender) post(points []*metrics.RawMetric, envelopes []*loggregator_v2.Envelope) error {
+	body, err := encodeBatch(points, envelopes)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.address+PeerPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if s.router.username != "" && s.router.password != "" {
+		req.SetBasicAuth(s.router.username, s.router.password)
+	}
+	resp, err := s.router.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status code %s", strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package sharding_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cloudfoundry/firehose_exporter/metricmaker"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/firehose_exporter/sharding"
+)
+
+type spyReceiver struct {
+	mu        sync.Mutex
+	points    []*metrics.RawMetric
+	envelopes []*loggregator_v2.Envelope
+}
+
+func (r *spyReceiver) ReceivePoints(points []*metrics.RawMetric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.points = append(r.points, points...)
+}
+
+func (r *spyReceiver) ReceiveEnvelopes(envelopes []*loggregator_v2.Envelope) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.envelopes = append(r.envelopes, envelopes...)
+}
+
+func (r *spyReceiver) Points() []*metrics.RawMetric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*metrics.RawMetric{}, r.points...)
+}
+
+func (r *spyReceiver) Envelopes() []*loggregator_v2.Envelope {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*loggregator_v2.Envelope{}, r.envelopes...)
+}
+
+var _ = ginkgo.Describe("Router", func() {
+	var receiver *spyReceiver
+	var peer *httptest.Server
+	var router *sharding.Router
+	var authHeader string
+
+	ginkgo.BeforeEach(func() {
+		receiver = &spyReceiver{}
+		handler := sharding.NewPeerHandler(receiver, internalMetric)
+		peer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			authHeader = req.Header.Get("Authorization")
+			gomega.Expect(req.URL.Path).To(gomega.Equal(sharding.PeerPath))
+			handler.ServeHTTP(w, req)
+		}))
+
+		var err error
+		router, err = sharding.NewRouter(
+			[]string{"http://self.local", peer.URL},
+			0,
+			internalMetric,
+			sharding.WithRouterBatch(100, 10*time.Millisecond),
+			sharding.WithRouterBasicAuth("user", "pass"),
+		)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		router.Start()
+	})
+
+	ginkgo.AfterEach(func() {
+		peer.Close()
+	})
+
+	ginkgo.It("should refuse an index out of peers", func() {
+		_, err := sharding.NewRouter([]string{"http://self.local"}, 1, internalMetric)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should give ownership by hashmod on key", func() {
+		gomega.Expect(router.Owner(4)).To(gomega.Equal(0))
+		gomega.Expect(router.Owner(7)).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should keep owned points and send others to their owner", func() {
+		owned := 0
+		sent := make([]*metrics.RawMetric, 0)
+		for i := 0; i < 20; i++ {
+			point := metricmaker.NewRawMetricGauge("my_metric", map[string]string{
+				"origin":   "my-origin",
+				"variadic": string(rune('a' + i)),
+			}, float64(i))
+			point.SetHelp("my help")
+			point.SetUnit("bytes")
+			point.SetEnvelopeTimestamp(int64(i + 1))
+			if router.RoutePoint(point) {
+				gomega.Expect(router.Owner(point.ID())).To(gomega.Equal(0))
+				owned++
+				continue
+			}
+			sent = append(sent, point)
+		}
+		gomega.Expect(owned).To(gomega.BeNumerically(">", 0))
+		gomega.Expect(sent).ToNot(gomega.BeEmpty())
+
+		gomega.Eventually(receiver.Points).Should(gomega.HaveLen(len(sent)))
+		for i, point := range receiver.Points() {
+			gomega.Expect(point.ID()).To(gomega.Equal(sent[i].ID()))
+			gomega.Expect(point.MetricName()).To(gomega.Equal("my_metric"))
+			gomega.Expect(point.Origin()).To(gomega.Equal("my-origin"))
+			gomega.Expect(point.Help()).To(gomega.Equal("my help"))
+			gomega.Expect(point.Unit()).To(gomega.Equal("bytes"))
+			gomega.Expect(point.EnvelopeTimestamp()).To(gomega.Equal(sent[i].EnvelopeTimestamp()))
+			gomega.Expect(point.Metric().GetGauge().GetValue()).To(gomega.Equal(sent[i].Metric().GetGauge().GetValue()))
+		}
+		gomega.Expect(authHeader).To(gomega.HavePrefix("Basic "))
+	})
+
+	ginkgo.It("should send envelopes to their owner", func() {
+		envelope := &loggregator_v2.Envelope{
+			SourceId: "gorouter",
+			Tags:     map[string]string{"app_id": "my-app"},
+			Message: &loggregator_v2.Envelope_Timer{
+				Timer: &loggregator_v2.Timer{Name: "http", Start: 1, Stop: 2},
+			},
+		}
+		gomega.Expect(router.RouteEnvelope(2, envelope)).To(gomega.BeTrue())
+		gomega.Expect(router.RouteEnvelope(3, envelope)).To(gomega.BeFalse())
+
+		gomega.Eventually(receiver.Envelopes).Should(gomega.HaveLen(1))
+		received := receiver.Envelopes()[0]
+		gomega.Expect(received.GetSourceId()).To(gomega.Equal("gorouter"))
+		gomega.Expect(received.GetTags()).To(gomega.HaveKeyWithValue("app_id", "my-app"))
+		gomega.Expect(received.GetTimer().GetStop()).To(gomega.Equal(int64(2)))
+	})
+})
@@ -0,0 +1,16 @@
+package sharding_test
+
+import (
+	"testing"
+
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var internalMetric = metrics.NewInternalMetrics("firehose", "test")
+
+func TestSharding(t *testing.T) {
+	gomega.RegisterFailHandler(ginkgo.Fail)
+	ginkgo.RunSpecs(t, "Sharding Suite")
+}
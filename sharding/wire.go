@@ -0,0 +1,89 @@
+package sharding
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/protoadapt"
+)
+
+type wirePoint struct {
+	Name   string
+	Origin string
+	Help   string
+	Unit   string
+	// unix time in nanoseconds of the source envelope
+	EnvelopeTimestamp int64
+	// dto.Metric in protobuf
+	Metric []byte
+}
+
+type wireBatch struct {
+	Points []wirePoint
+	// loggregator_v2.EnvelopeBatch in protobuf, generated with the legacy protobuf API
+	// so it is adapted to the current one
+	Envelopes []byte
+}
+
+func encodeBatch(points []*metrics.RawMetric, envelopes []*loggregator_v2.Envelope) ([]byte, error) {
+	batch := wireBatch{
+		Points: make([]wirePoint, 0, len(points)),
+	}
+	for _, point := range points {
+		metric, err := proto.Marshal(point.Metric())
+		if err != nil {
+			return nil, fmt.Errorf("could not marshal point %s: %w", point.MetricName(), err)
+		}
+		batch.Points = append(batch.Points, wirePoint{
+			Name:              point.MetricName(),
+			Origin:            point.Origin(),
+			Help:              point.Help(),
+			Unit:              point.Unit(),
+			EnvelopeTimestamp: point.EnvelopeTimestamp(),
+			Metric:            metric,
+		})
+	}
+	if len(envelopes) > 0 {
+		envelopeBatch, err := proto.Marshal(protoadapt.MessageV2Of(&loggregator_v2.EnvelopeBatch{Batch: envelopes}))
+		if err != nil {
+			return nil, fmt.Errorf("could not marshal envelopes: %w", err)
+		}
+		batch.Envelopes = envelopeBatch
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(&batch); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeBatch(r io.Reader) ([]*metrics.RawMetric, []*loggregator_v2.Envelope, error) {
+	batch := wireBatch{}
+	if err := gob.NewDecoder(r).Decode(&batch); err != nil {
+		return nil, nil, err
+	}
+	points := make([]*metrics.RawMetric, 0, len(batch.Points))
+	for _, wp := range batch.Points {
+		metric := &dto.Metric{}
+		if err := proto.Unmarshal(wp.Metric, metric); err != nil {
+			return nil, nil, fmt.Errorf("could not unmarshal point %s: %w", wp.Name, err)
+		}
+		point := metrics.NewRawMetric(wp.Name, wp.Origin, metric)
+		point.SetHelp(wp.Help)
+		point.SetUnit(wp.Unit)
+		point.SetEnvelopeTimestamp(wp.EnvelopeTimestamp)
+		points = append(points, point)
+	}
+	envelopeBatch := &loggregator_v2.EnvelopeBatch{}
+	if err := proto.Unmarshal(batch.Envelopes, protoadapt.MessageV2Of(envelopeBatch)); err != nil {
+		return nil, nil, fmt.Errorf("could not unmarshal envelopes: %w", err)
+	}
+	return points, envelopeBatch.GetBatch(), nil
+}
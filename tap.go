@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/cloudfoundry/firehose_exporter/connection"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"github.com/cloudfoundry/firehose_exporter/tap"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	tapCmd = kingpin.Command("tap", "Print envelopes matching filters as json lines, or as converted prometheus samples, to troubleshoot without the exporter")
+
+	tapShardID = tapCmd.Flag(
+		"shard_id", "Shard id of the tap stream, a random one is used when empty, it must differ from the one of exporters or they would miss envelopes",
+	).Default("").String()
+
+	tapSourceIDs = tapCmd.Flag(
+		"source_id", "Only print envelopes of this source id, can be repeated, types without filter.source_ids.* flag are only received from these source ids",
+	).Strings()
+
+	tapNames = tapCmd.Flag(
+		"name", "Only print counters, timers and gauge metrics with this name, can be repeated",
+	).Strings()
+
+	tapTags = tapCmd.Flag(
+		"tag", "Only print envelopes having this tag, as name=value, can be repeated",
+	).StringMap()
+
+	tapFormat = tapCmd.Flag(
+		"format", "Print envelopes as json lines (json) or samples made by the exporter conversion (prometheus)",
+	).Default(tap.FormatJSON).Enum(tap.FormatJSON, tap.FormatPrometheus)
+
+	tapCount = tapCmd.Flag(
+		"count", "Stop after printing this number of envelopes, 0 for no limit",
+	).Default("0").Int()
+
+	tapDuration = tapCmd.Flag(
+		"duration", "Stop after this duration, 0 for no limit",
+	).Default("0s").Duration()
+)
+
+func runTap() {
+	shardID := *tapShardID
+	if shardID == "" {
+		shardID = fmt.Sprintf("firehose_exporter_tap_%08x", rand.Uint32())
+	}
+	im := metrics.NewInternalMetrics(*metricsNamespace, *metricsEnvironment)
+	streamer, err := MakeStreamer(im, connection.NewTracker(*loggingURL, im))
+	if err != nil {
+		log.Panicf("Could not create streamer: %s", err.Error())
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	log.WithField("shard_id", shardID).Info("Starting tap")
+	err = tap.NewTap(streamer, shardID, MakeFilterSelector(*tapSourceIDs), MakeFilterDeployment(), os.Stdout,
+		tap.WithFilter(tap.Filter{
+			SourceIDs: *tapSourceIDs,
+			Names:     *tapNames,
+			Tags:      *tapTags,
+		}),
+		tap.WithFormat(*tapFormat),
+		tap.WithCount(*tapCount),
+		tap.WithDuration(*tapDuration),
+	).Run(ctx)
+	if err != nil {
+		log.Fatalf("Tap failed: %s", err.Error())
+	}
+}
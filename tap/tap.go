@@ -0,0 +1,244 @@
+package tap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/cloudfoundry/firehose_exporter/metricmaker"
+	"github.com/cloudfoundry/firehose_exporter/metrics"
+	"github.com/cloudfoundry/firehose_exporter/nozzle"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/protoadapt"
+)
+
+const (
+	// FormatJSON prints each envelope as a json line, as given by the RLP Gateway.
+	FormatJSON = "json"
+	// FormatPrometheus prints samples made from envelopes by the metric maker, as the exporter would store them.
+	// Timers are only exposed through rollups, they are printed as json.
+	FormatPrometheus = "prometheus"
+)
+
+// Filter selects envelopes to print, an empty field selects all envelopes.
+type Filter struct {
+	SourceIDs []string
+	// Names of counters, timers or metrics of gauges, other metrics of gauges are removed.
+	Names []string
+	// Tags which envelopes must have with the same value.
+	Tags map[string]string
+}
+
+// Tap prints envelopes of its own shard group to help troubleshooting, like the cf nozzle plugin.
+type Tap struct {
+	connector        nozzle.StreamConnector
+	shardID          string
+	filterSelector   *nozzle.FilterSelector
+	filterDeployment *nozzle.FilterDeployment
+	out              io.Writer
+
+	filter   Filter
+	format   string
+	count    int
+	duration time.Duration
+}
+
+type Option func(*Tap)
+
+func WithFilter(filter Filter) Option {
+	return func(t *Tap) {
+		t.filter = filter
+	}
+}
+
+func WithFormat(format string) Option {
+	return func(t *Tap) {
+		t.format = format
+	}
+}
+
+// WithCount stops the tap once count envelopes were printed.
+func WithCount(count int) Option {
+	return func(t *Tap) {
+		t.count = count
+	}
+}
+
+// WithDuration stops the tap after duration.
+func WithDuration(duration time.Duration) Option {
+	return func(t *Tap) {
+		t.duration = duration
+	}
+}
+
+// NewTap creates a tap reading a stream of shardID, it must not be the shard id of exporters
+// or they would miss the envelopes given to the tap.
+func NewTap(connector nozzle.StreamConnector, shardID string, filterSelector *nozzle.FilterSelector, filterDeployment *nozzle.FilterDeployment, out io.Writer, opts ...Option) *Tap {
+	t := &Tap{
+		connector:        connector,
+		shardID:          shardID,
+		filterSelector:   filterSelector,
+		filterDeployment: filterDeployment,
+		out:              out,
+		format:           FormatJSON,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Run prints envelopes until count is reached, duration elapsed or ctx is done.
+func (t *Tap) Run(ctx context.Context) error {
+	if t.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.duration)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	rx := t.connector.Stream(ctx, &loggregator_v2.EgressBatchRequest{
+		ShardId:          t.shardID,
+		UsePreferredTags: true,
+		Selectors:        t.filterSelector.ToSelectorTypes(),
+	})
+	printed := 0
+	for ctx.Err() == nil {
+		for _, envelope := range rx() {
+			if !t.match(envelope) {
+				continue
+			}
+			if err := t.print(envelope); err != nil {
+				return err
+			}
+			printed++
+			if t.count > 0 && printed >= t.count {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Tap) match(envelope *loggregator_v2.Envelope) bool {
+	if t.filterDeployment.IsFiltered(envelope) {
+		return false
+	}
+	if len(t.filter.SourceIDs) > 0 && !contains(t.filter.SourceIDs, envelope.GetSourceId()) {
+		return false
+	}
+	for name, value := range t.filter.Tags {
+		if envelopeValue, ok := envelope.GetTags()[name]; !ok || envelopeValue != value {
+			return false
+		}
+	}
+
+	switch envelope.Message.(type) {
+	case *loggregator_v2.Envelope_Gauge:
+		t.filterSelector.FilterGaugeMetrics(envelope)
+		if len(t.filter.Names) > 0 {
+			for name := range envelope.GetGauge().GetMetrics() {
+				if !contains(t.filter.Names, name) {
+					delete(envelope.GetGauge().GetMetrics(), name)
+				}
+			}
+		}
+		return len(envelope.GetGauge().GetMetrics()) > 0
+	case *loggregator_v2.Envelope_Counter:
+		return len(t.filter.Names) == 0 || contains(t.filter.Names, envelope.GetCounter().GetName())
+	case *loggregator_v2.Envelope_Timer:
+		return len(t.filter.Names) == 0 || contains(t.filter.Names, envelope.GetTimer().GetName())
+	}
+	return false
+}
+
+func (t *Tap) print(envelope *loggregator_v2.Envelope) error {
+	if t.format == FormatPrometheus && envelope.GetTimer() == nil {
+		for _, point := range metricmaker.NewRawMetricsFromEnvelop(envelope) {
+			if _, err := io.WriteString(t.out, SampleLine(point)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	line, err := EnvelopeLine(envelope)
+	if err != nil {
+		return fmt.Errorf("could not marshal envelope: %w", err)
+	}
+	_, err = io.WriteString(t.out, line+"\n")
+	return err
+}
+
+// EnvelopeLine gives the envelope as a json line, as given by the RLP Gateway. Envelopes are generated with
+// the legacy protobuf API, they are adapted to the current one.
+func EnvelopeLine(envelope *loggregator_v2.Envelope) (string, error) {
+	content, err := protojson.Marshal(protoadapt.MessageV2Of(envelope))
+	if err != nil {
+		return "", err
+	}
+	// protojson output has no stable spacing, lines are compacted so they don't differ between builds
+	line := &bytes.Buffer{}
+	if err := json.Compact(line, content); err != nil {
+		return "", err
+	}
+	return line.String(), nil
+}
+
+// ParseEnvelopeLine reads an envelope from a json line as printed by EnvelopeLine.
+func ParseEnvelopeLine(line string) (*loggregator_v2.Envelope, error) {
+	envelope := &loggregator_v2.Envelope{}
+	if err := protojson.Unmarshal([]byte(line), protoadapt.MessageV2Of(envelope)); err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// SampleLine gives the point in prometheus text format, without help and type.
+func SampleLine(point *metrics.RawMetric) string {
+	metric := point.Metric()
+	labels := make([]string, 0, len(metric.GetLabel()))
+	for _, label := range metric.GetLabel() {
+		labels = append(labels, label.GetName()+`="`+labelValueReplacer.Replace(label.GetValue())+`"`)
+	}
+	sort.Strings(labels)
+
+	var value float64
+	switch *point.MetricType() {
+	case dto.MetricType_COUNTER:
+		value = metric.GetCounter().GetValue()
+	case dto.MetricType_GAUGE:
+		value = metric.GetGauge().GetValue()
+	default:
+		value = metric.GetUntyped().GetValue()
+	}
+
+	line := point.MetricName()
+	if len(labels) > 0 {
+		line += "{" + strings.Join(labels, ",") + "}"
+	}
+	line += " " + strconv.FormatFloat(value, 'g', -1, 64)
+	if metric.TimestampMs != nil {
+		line += " " + strconv.FormatInt(metric.GetTimestampMs(), 10)
+	}
+	return line + "\n"
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package tap_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/firehose_exporter/nozzle"
+	"github.com/cloudfoundry/firehose_exporter/tap"
+)
+
+// fakeStreamConnector gives its batches then blocks until ctx is done.
+type fakeStreamConnector struct {
+	batches  chan []*loggregator_v2.Envelope
+	requests []*loggregator_v2.EgressBatchRequest
+}
+
+func (c *fakeStreamConnector) Stream(ctx context.Context, req *loggregator_v2.EgressBatchRequest) loggregator.EnvelopeStream {
+	c.requests = append(c.requests, req)
+	return func() []*loggregator_v2.Envelope {
+		select {
+		case batch := <-c.batches:
+			return batch
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func counterEnvelope(sourceID, name string, total uint64, tags map[string]string) *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		SourceId: sourceID,
+		Tags:     tags,
+		Message: &loggregator_v2.Envelope_Counter{
+			Counter: &loggregator_v2.Counter{Name: name, Total: total},
+		},
+	}
+}
+
+func gaugeEnvelope(sourceID string, values map[string]float64) *loggregator_v2.Envelope {
+	gaugeMetrics := make(map[string]*loggregator_v2.GaugeValue)
+	for name, value := range values {
+		gaugeMetrics[name] = &loggregator_v2.GaugeValue{Unit: "bytes", Value: value}
+	}
+	return &loggregator_v2.Envelope{
+		SourceId: sourceID,
+		Tags:     map[string]string{},
+		Message: &loggregator_v2.Envelope_Gauge{
+			Gauge: &loggregator_v2.Gauge{Metrics: gaugeMetrics},
+		},
+	}
+}
+
+func lines(out *bytes.Buffer) []string {
+	return strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+}
+
+var _ = ginkgo.Describe("Tap", func() {
+	var connector *fakeStreamConnector
+	var out *bytes.Buffer
+
+	ginkgo.BeforeEach(func() {
+		connector = &fakeStreamConnector{batches: make(chan []*loggregator_v2.Envelope, 10)}
+		out = &bytes.Buffer{}
+	})
+
+	ginkgo.It("should print matching envelopes as json lines until count is reached", func() {
+		connector.batches <- []*loggregator_v2.Envelope{
+			counterEnvelope("bbs", "requests", 1, map[string]string{"deployment": "cf"}),
+			counterEnvelope("rep", "requests", 2, map[string]string{"deployment": "cf"}),
+			counterEnvelope("bbs", "failures", 3, map[string]string{"deployment": "cf"}),
+			counterEnvelope("bbs", "requests", 4, map[string]string{"deployment": "cf", "job": "diego-api"}),
+			counterEnvelope("bbs", "requests", 5, map[string]string{"deployment": "other", "job": "diego-api"}),
+		}
+		connector.batches <- []*loggregator_v2.Envelope{
+			counterEnvelope("bbs", "requests", 6, map[string]string{"deployment": "cf", "job": "diego-api"}),
+			counterEnvelope("bbs", "requests", 7, map[string]string{"deployment": "cf", "job": "diego-api"}),
+		}
+
+		t := tap.NewTap(connector, "firehose_exporter_tap", nozzle.NewFilterSelector(), nozzle.NewFilterDeployment("cf"), out,
+			tap.WithFilter(tap.Filter{
+				SourceIDs: []string{"bbs"},
+				Names:     []string{"requests"},
+				Tags:      map[string]string{"job": "diego-api"},
+			}),
+			tap.WithCount(2),
+		)
+		gomega.Expect(t.Run(context.Background())).To(gomega.Succeed())
+
+		gomega.Expect(lines(out)).To(gomega.Equal([]string{
+			`{"source_id":"bbs","tags":{"deployment":"cf","job":"diego-api"},"counter":{"name":"requests","total":"4"}}`,
+			`{"source_id":"bbs","tags":{"deployment":"cf","job":"diego-api"},"counter":{"name":"requests","total":"6"}}`,
+		}))
+		gomega.Expect(connector.requests).To(gomega.HaveLen(1))
+		gomega.Expect(connector.requests[0].ShardId).To(gomega.Equal("firehose_exporter_tap"))
+		gomega.Expect(connector.requests[0].Selectors).To(gomega.HaveLen(3))
+	})
+
+	ginkgo.It("should only keep gauge metrics of enabled types and given names", func() {
+		connector.batches <- []*loggregator_v2.Envelope{
+			gaugeEnvelope("rep", map[string]float64{"memory": 1, "a_gauge": 2, "another_gauge": 3}),
+			gaugeEnvelope("rep", map[string]float64{"memory": 4}),
+			gaugeEnvelope("rep", map[string]float64{"a_gauge": 5}),
+		}
+
+		t := tap.NewTap(connector, "firehose_exporter_tap", nozzle.NewFilterSelector("ValueMetric"), nozzle.NewFilterDeployment(), out,
+			tap.WithFilter(tap.Filter{Names: []string{"memory", "a_gauge"}}),
+			tap.WithCount(2),
+		)
+		gomega.Expect(t.Run(context.Background())).To(gomega.Succeed())
+
+		gomega.Expect(lines(out)).To(gomega.Equal([]string{
+			`{"source_id":"rep","gauge":{"metrics":{"a_gauge":{"unit":"bytes","value":2}}}}`,
+			`{"source_id":"rep","gauge":{"metrics":{"a_gauge":{"unit":"bytes","value":5}}}}`,
+		}))
+	})
+
+	ginkgo.It("should print samples made by the metric maker in prometheus format", func() {
+		connector.batches <- []*loggregator_v2.Envelope{
+			counterEnvelope("bbs", "requests", 4, map[string]string{"job": "diego-api"}),
+		}
+
+		t := tap.NewTap(connector, "firehose_exporter_tap", nozzle.NewFilterSelector(), nozzle.NewFilterDeployment(), out,
+			tap.WithFormat(tap.FormatPrometheus),
+			tap.WithCount(1),
+		)
+		gomega.Expect(t.Run(context.Background())).To(gomega.Succeed())
+
+		gomega.Expect(lines(out)).To(gomega.Equal([]string{
+			`requests{bosh_job_name="diego-api",job="diego-api",source_id="bbs"} 4`,
+		}))
+	})
+
+	ginkgo.It("should stop after duration", func() {
+		t := tap.NewTap(connector, "firehose_exporter_tap", nozzle.NewFilterSelector(), nozzle.NewFilterDeployment(), out,
+			tap.WithDuration(50*time.Millisecond),
+		)
+		done := make(chan error)
+		go func() {
+			done <- t.Run(context.Background())
+		}()
+		gomega.Eventually(done).Should(gomega.Receive(gomega.BeNil()))
+		gomega.Expect(out.Len()).To(gomega.Equal(0))
+	})
+})
+
+var _ = ginkgo.Describe("EnvelopeLine", func() {
+	ginkgo.It("should give a compact json line which can be parsed back", func() {
+		envelope := counterEnvelope("bbs", "requests", 4, map[string]string{"deployment": "cf", "job": "diego-api"})
+
+		line, err := tap.EnvelopeLine(envelope)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(line).To(gomega.Equal(`{"source_id":"bbs","tags":{"deployment":"cf","job":"diego-api"},"counter":{"name":"requests","total":"4"}}`))
+
+		parsed, err := tap.ParseEnvelopeLine(line)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(parsed.GetSourceId()).To(gomega.Equal("bbs"))
+		gomega.Expect(parsed.GetTags()).To(gomega.Equal(envelope.GetTags()))
+		gomega.Expect(parsed.GetCounter().GetTotal()).To(gomega.Equal(uint64(4)))
+	})
+
+	ginkgo.It("should refuse a line which is not an envelope", func() {
+		_, err := tap.ParseEnvelopeLine(`{"unknown":1}`)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})